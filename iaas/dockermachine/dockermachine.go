@@ -5,13 +5,20 @@
 package dockermachine
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/machine/libmachine"
 	"github.com/docker/machine/libmachine/drivers"
@@ -21,16 +28,56 @@ import (
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
 	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/docker/machine/libmachine/state"
 	"github.com/pkg/errors"
+	tsuruErrors "github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/iaas"
+	tsuruLog "github.com/tsuru/tsuru/log"
 )
 
+var runSSHCommand = func(h *host.Host, command string) (string, error) {
+	return h.RunSSHCommand(command)
+}
+
+// closeTimeout is the maximum time Close waits for outstanding operations
+// before closing the libmachine API.
+var closeTimeout = 5 * time.Minute
+
+// deleteMachinesParallelism is the maximum number of machines removed at the
+// same time by DeleteMachines.
+var deleteMachinesParallelism = 5
+
+// subnetCounter is shared by every DockerMachine, so that machines created by
+// short lived instances are still distributed across subnets.
+var (
+	subnetCounter uint64
+	subnetIntn    = rand.Intn
+)
+
+// The libmachine log writers are global, they are set once to these writers,
+// which copy the output to the writers of the running operations.
+var (
+	libmachineOut     = &logMux{}
+	libmachineErr     = &logMux{}
+	installLogWriters sync.Once
+)
+
+// ErrDockerMachineClosed is returned by operations started after the
+// DockerMachine is closed.
+var ErrDockerMachineClosed = errors.New("docker machine is closed")
+
 type DockerMachine struct {
 	io.Closer
 	client    libmachine.API
+	store     MachineStore
 	StorePath string
 	CertsPath string
 	temp      bool
+	outWriter io.Writer
+	errWriter io.Writer
+	opsMu     sync.Mutex
+	ops       sync.WaitGroup
+	closed    bool
 }
 
 type DockerMachineConfig struct {
@@ -39,15 +86,60 @@ type DockerMachineConfig struct {
 	ErrWriter io.Writer
 	StorePath string
 	IsDebug   bool
+	// Store is used to save and look up the hosts of the machines, defaults
+	// to the libmachine file store in StorePath. See MachineStore.
+	Store MachineStore
+}
+
+// MachineStore persists the hosts managed by DockerMachine, identified by
+// their names. It's only used to save, look up and remove stored hosts: hosts
+// are still built and created by the libmachine API, which saves the created
+// hosts in its own file store in StorePath before CreateMachine saves them in
+// the MachineStore.
+type MachineStore interface {
+	List() ([]string, error)
+	Save(*host.Host) error
+	Remove(name string) error
+	Get(name string) (*host.Host, error)
+	Exists(name string) (bool, error)
+}
+
+// libmachineStore is the MachineStore backed by the libmachine API store.
+type libmachineStore struct {
+	api libmachine.API
+}
+
+func (s *libmachineStore) List() ([]string, error) {
+	return s.api.List()
+}
+
+func (s *libmachineStore) Save(h *host.Host) error {
+	return s.api.Save(h)
+}
+
+func (s *libmachineStore) Remove(name string) error {
+	return s.api.Remove(name)
+}
+
+func (s *libmachineStore) Get(name string) (*host.Host, error) {
+	return s.api.Load(name)
+}
+
+func (s *libmachineStore) Exists(name string) (bool, error) {
+	return s.api.Exists(name)
 }
 
 type DockerMachineAPI interface {
 	io.Closer
-	CreateMachine(CreateMachineOpts) (*Machine, error)
-	DeleteMachine(*iaas.Machine) error
+	CreateMachine(context.Context, CreateMachineOpts) (*Machine, error)
+	DeleteMachine(context.Context, *iaas.Machine, DeleteMachineOpts) error
+	DeleteMachines(context.Context, []*iaas.Machine, DeleteMachineOpts) error
+	ScaleMachine(context.Context, *iaas.Machine, ScaleMachineOpts) error
+	RefreshMachine(*iaas.Machine) (*Machine, error)
 	RegisterMachine(RegisterMachineOpts) (*Machine, error)
 	List() ([]*Machine, error)
 	DeleteAll() error
+	ValidateCredentials(driverName string, params map[string]interface{}) error
 }
 
 type CreateMachineOpts struct {
@@ -59,8 +151,134 @@ type CreateMachineOpts struct {
 	RegistryMirror            string
 	DockerEngineStorageDriver string
 	ArbitraryFlags            []string
+	DockerEngineOpts          *DockerEngineOpts
+	UserData                  string
+	SSHKeyPath                string
+	SSHKeyName                string
+	Tags                      map[string]string
+	DryRun                    bool
+	// Idempotent makes CreateMachine return an existing running host with
+	// the same name, instead of trying to create it again.
+	Idempotent bool
+	// UsePrivateIP sets the machine address to the private IP reported by the
+	// driver instead of the public one.
+	UsePrivateIP bool
+	// IAMInstanceProfile is the name of the IAM instance profile attached to
+	// the machine. It only grants permissions to the created machine, the
+	// static keys in Params, if any, are still forwarded and used to call the
+	// cloud API on creation.
+	IAMInstanceProfile string
+	// Spot requests a spot instance instead of an on-demand one, optionally
+	// bidding SpotPrice, for drivers supporting it.
+	Spot      bool
+	SpotPrice string
+	// RootVolumeSizeGB and RootVolumeType override the size and type of the
+	// machine root volume, for drivers supporting it. Zero values keep the
+	// driver defaults.
+	RootVolumeSizeGB int
+	RootVolumeType   string
+	// SecurityGroupIDs attaches existing security groups to the machine by
+	// ID, for drivers supporting it. It can't be combined with security
+	// group names set in Params.
+	SecurityGroupIDs []string
+	// Subnets is a set of subnets, possibly in different availability zones,
+	// from which one is picked by SubnetStrategy for each created machine,
+	// for drivers supporting it.
+	Subnets        []string
+	SubnetStrategy SubnetStrategy
+	// AvailabilityZone places the machine in the given zone, e.g. us-east-1b,
+	// for drivers supporting it. It sets the driver region and zone and must
+	// match the zone of the subnet, if one is set.
+	AvailabilityZone string
+	// ExtraVolumes are data volumes created and attached to the machine
+	// after it's created, before PostCreateScript runs, for drivers
+	// supporting it.
+	ExtraVolumes []VolumeSpec
+	// PostCreateScript, when set, is executed over ssh on the machine after
+	// docker is provisioned. A failure in the script fails the creation.
+	PostCreateScript string
+	// ProgressCallback, when set, is called with a message describing each
+	// stage of the machine creation.
+	ProgressCallback func(msg string)
+}
+
+// DockerEngineOpts holds docker daemon options applied to the engine of
+// created machines, in addition to the ones set directly in
+// CreateMachineOpts.
+type DockerEngineOpts struct {
+	InsecureRegistry []string
+	RegistryMirror   []string
+	StorageDriver    string
+	ArbitraryFlags   []string
+}
+
+// VolumeSpec describes an extra volume attached to a created machine.
+type VolumeSpec struct {
+	SizeGB int
+	// Type is the driver specific volume type, e.g. gp2 for amazonec2. An
+	// empty type uses the cloud provider default.
+	Type string
+	// DeviceName is the device the volume is exposed as in the machine, e.g.
+	// /dev/sdf.
+	DeviceName string
+}
+
+// SubnetStrategy selects one of the subnets in CreateMachineOpts for each
+// created machine.
+type SubnetStrategy string
+
+const (
+	// SubnetStrategyRoundRobin picks the subnets in order, it's the default
+	// strategy.
+	SubnetStrategyRoundRobin SubnetStrategy = "round-robin"
+	// SubnetStrategyRandom picks a random subnet.
+	SubnetStrategyRandom SubnetStrategy = "random"
+)
+
+func (s SubnetStrategy) pick(subnets []string) (string, error) {
+	switch s {
+	case "", SubnetStrategyRoundRobin:
+		n := atomic.AddUint64(&subnetCounter, 1) - 1
+		return subnets[n%uint64(len(subnets))], nil
+	case SubnetStrategyRandom:
+		return subnets[subnetIntn(len(subnets))], nil
+	}
+	return "", errors.Errorf("invalid subnet strategy %q: must be one of %s, %s", s, SubnetStrategyRoundRobin, SubnetStrategyRandom)
+}
+
+type ScaleMachineOpts struct {
+	InstanceType string
+}
+
+type DeleteMachineOpts struct {
+	// Force removes the host from the store even if the driver reports the
+	// machine as not found, e.g. when it was terminated out-of-band.
+	Force bool
+	// DryRun resolves the hosts that would be removed and reports them to
+	// DryRunCallback, without removing them from the driver or the store.
+	DryRun bool
+	// DryRunCallback is called with each host resolved in dry-run mode. It
+	// may be called concurrently by DeleteMachines.
+	DryRunCallback func(DeleteTarget)
+}
+
+// DeleteTarget describes a host that would be removed by DeleteMachine.
+type DeleteTarget struct {
+	Name   string
+	Driver string
+	// State is the host state reported by the driver, empty if it's gone.
+	State string
+	// Gone is set when the driver reports the host as not found, removing
+	// it requires Force.
+	Gone bool
+	// Stored reports whether the host is in the machine store.
+	Stored bool
 }
 
+// MachineStatusDryRun is the status of machines returned by CreateMachine in
+// dry-run mode, which are validated but never created.
+const MachineStatusDryRun = "dry-run"
+
 type RegisterMachineOpts struct {
 	Base          *iaas.Machine
 	DriverName    string
@@ -70,6 +288,42 @@ type RegisterMachineOpts struct {
 type Machine struct {
 	Base *iaas.Machine
 	Host *host.Host
+	// ProvisionDuration is the time taken by CreateMachine until the host was
+	// created and running, zero for existing machines and dry runs.
+	ProvisionDuration time.Duration
+}
+
+// Region returns the region where the machine was created, as configured in
+// the driver.
+func (m *Machine) Region() string {
+	return m.customDataString("Region")
+}
+
+// VpcID returns the id of the VPC where the machine was created.
+func (m *Machine) VpcID() string {
+	return m.customDataString("VpcId")
+}
+
+// SubnetID returns the id of the subnet where the machine was created.
+func (m *Machine) SubnetID() string {
+	return m.customDataString("SubnetId")
+}
+
+// SecurityGroups returns the names of the security groups of the machine.
+func (m *Machine) SecurityGroups() []string {
+	groups, _ := m.Base.CustomData["SecurityGroupNames"].([]interface{})
+	var names []string
+	for _, g := range groups {
+		if name, ok := g.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (m *Machine) customDataString(key string) string {
+	v, _ := m.Base.CustomData[key].(string)
+	return v
 }
 
 func NewDockerMachine(config DockerMachineConfig) (DockerMachineAPI, error) {
@@ -100,16 +354,17 @@ func NewDockerMachine(config DockerMachineConfig) (DockerMachineAPI, error) {
 			return nil, errors.Wrap(err, "failed to copy ca key file")
 		}
 	}
-	if config.OutWriter != nil {
-		log.SetOutWriter(config.OutWriter)
-	} else {
-		log.SetOutWriter(ioutil.Discard)
+	outWriter, errWriter := config.OutWriter, config.ErrWriter
+	if outWriter == nil {
+		outWriter = ioutil.Discard
 	}
-	if config.ErrWriter != nil {
-		log.SetOutWriter(config.ErrWriter)
-	} else {
-		log.SetOutWriter(ioutil.Discard)
+	if errWriter == nil {
+		errWriter = ioutil.Discard
 	}
+	installLogWriters.Do(func() {
+		log.SetOutWriter(libmachineOut)
+		log.SetErrWriter(libmachineErr)
+	})
 	log.SetDebug(config.IsDebug)
 	client := libmachine.NewClient(storePath, certsPath)
 	client.IsDebug = config.IsDebug
@@ -123,18 +378,149 @@ func NewDockerMachine(config DockerMachineConfig) (DockerMachineAPI, error) {
 		StorePath: storePath,
 		CertsPath: certsPath,
 		client:    client,
+		store:     config.Store,
 		temp:      temp,
+		outWriter: outWriter,
+		errWriter: errWriter,
 	}, nil
 }
 
+// Close waits for outstanding operations, up to closeTimeout, before closing
+// the libmachine API, so their hosts are not left half persisted in the
+// store. Operations started after Close return ErrDockerMachineClosed.
 func (d *DockerMachine) Close() error {
+	d.opsMu.Lock()
+	d.closed = true
+	d.opsMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.ops.Wait()
+		close(done)
+	}()
+	var errWait error
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		errWait = errors.Errorf("timeout after %v waiting for outstanding operations", closeTimeout)
+		tsuruLog.Errorf("[docker-machine] closing with outstanding operations: %v", errWait)
+	}
 	if d.temp {
 		os.RemoveAll(d.StorePath)
 	}
-	return d.client.Close()
+	err := d.client.Close()
+	if err != nil {
+		return err
+	}
+	return errWait
+}
+
+// machineStore returns the store used to persist the hosts, the configured
+// one or the libmachine store.
+func (d *DockerMachine) machineStore() MachineStore {
+	if d.store != nil {
+		return d.store
+	}
+	return &libmachineStore{api: d.client}
 }
 
-func (d *DockerMachine) CreateMachine(opts CreateMachineOpts) (*Machine, error) {
+// startOperation registers an outstanding operation, which Close waits for.
+// The returned function must be called when the operation finishes.
+func (d *DockerMachine) startOperation() (func(), error) {
+	d.opsMu.Lock()
+	defer d.opsMu.Unlock()
+	if d.closed {
+		return nil, ErrDockerMachineClosed
+	}
+	d.ops.Add(1)
+	return d.ops.Done, nil
+}
+
+// CreateMachine creates a new host using the given driver. If ctx is done
+// before the host is created, CreateMachine returns the context error and the
+// host is removed in background as soon as its creation finishes.
+func (d *DockerMachine) CreateMachine(ctx context.Context, opts CreateMachineOpts) (*Machine, error) {
+	t0 := time.Now()
+	done, err := d.startOperation()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	releaseLogs := d.captureLogs()
+	defer func() { releaseLogs() }()
+	err = validateDriver(opts.DriverName)
+	if err != nil {
+		return nil, err
+	}
+	// the driver options are changed below, the caller params are copied so
+	// that they can be reused, e.g. when creating several machines.
+	params := make(map[string]interface{}, len(opts.Params))
+	for k, v := range opts.Params {
+		params[k] = v
+	}
+	opts.Params = params
+	if opts.Idempotent && !opts.DryRun {
+		m, errExisting := d.existingMachine(opts.Name)
+		if m != nil || errExisting != nil {
+			return m, errExisting
+		}
+	}
+	err = setDriverParam(opts.Params, sshKeyPathParams, opts.DriverName, opts.SSHKeyPath, "ssh key path")
+	if err != nil {
+		return nil, err
+	}
+	err = setDriverParam(opts.Params, sshKeyNameParams, opts.DriverName, opts.SSHKeyName, "ssh key name")
+	if err != nil {
+		return nil, err
+	}
+	err = setDriverParam(opts.Params, iamInstanceProfileParams, opts.DriverName, opts.IAMInstanceProfile, "iam instance profile")
+	if err != nil {
+		return nil, err
+	}
+	if opts.RootVolumeSizeGB < 0 {
+		return nil, errors.Errorf("root volume size must be positive, got %d", opts.RootVolumeSizeGB)
+	}
+	if opts.RootVolumeSizeGB > 0 {
+		err = setDriverParam(opts.Params, rootVolumeSizeParams, opts.DriverName, strconv.Itoa(opts.RootVolumeSizeGB), "root volume size")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = setDriverParam(opts.Params, rootVolumeTypeParams, opts.DriverName, opts.RootVolumeType, "root volume type")
+	if err != nil {
+		return nil, err
+	}
+	if opts.Spot {
+		err = setDriverParam(opts.Params, spotInstanceParams, opts.DriverName, "true", "spot instance")
+		if err != nil {
+			return nil, err
+		}
+		err = setDriverParam(opts.Params, spotPriceParams, opts.DriverName, opts.SpotPrice, "spot price")
+		if err != nil {
+			return nil, err
+		}
+	} else if opts.SpotPrice != "" {
+		return nil, errors.New("spot price requires spot instances")
+	}
+	err = setSubnetParam(opts.Params, opts.DriverName, opts.Subnets, opts.SubnetStrategy)
+	if err != nil {
+		return nil, err
+	}
+	err = setSecurityGroupIDsParams(opts.Params, opts.DriverName, opts.SecurityGroupIDs)
+	if err != nil {
+		return nil, err
+	}
+	err = setAvailabilityZoneParams(opts.Params, opts.DriverName, opts.AvailabilityZone)
+	if err != nil {
+		return nil, err
+	}
+	err = validateExtraVolumes(opts.DriverName, opts.ExtraVolumes)
+	if err != nil {
+		return nil, err
+	}
+	setDriverTags(opts.Params, opts.DriverName, opts.Tags)
+	if _, ok := privateIPFields[opts.DriverName]; opts.UsePrivateIP && !ok {
+		return nil, errors.Errorf("private ip is not supported by driver %q", opts.DriverName)
+	}
 	rawDriver, err := json.Marshal(&drivers.BaseDriver{
 		MachineName: opts.Name,
 		StorePath:   d.StorePath,
@@ -146,10 +532,52 @@ func (d *DockerMachine) CreateMachine(opts CreateMachineOpts) (*Machine, error)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to initialize host")
 	}
+	if opts.UserData != "" {
+		userDataFile, errUserData := writeUserDataFile(opts.DriverName, opts.UserData, opts.Params)
+		if errUserData != nil {
+			return nil, errUserData
+		}
+		defer os.Remove(userDataFile)
+	}
+	opts.progress("validating driver options")
 	err = configureDriver(h.Driver, opts.Params)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to configure driver")
 	}
+	if len(opts.SecurityGroupIDs) > 0 {
+		rawIDs, errMarshal := json.Marshal(map[string][]string{
+			securityGroupIDFields[opts.DriverName]: opts.SecurityGroupIDs,
+		})
+		if errMarshal != nil {
+			return nil, errors.Wrap(errMarshal, "failed to marshal security group ids")
+		}
+		err = json.Unmarshal(rawIDs, h.Driver)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to set security group ids")
+		}
+	}
+	if opts.AvailabilityZone != "" {
+		err = checkSubnetZone(h.Driver, opts.DriverName, opts.AvailabilityZone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.DryRun {
+		err = h.Driver.PreCreateCheck()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to validate driver")
+		}
+		return &Machine{
+			Base: &iaas.Machine{
+				Id:     opts.Name,
+				Status: MachineStatusDryRun,
+				CreationParams: map[string]string{
+					"driver": opts.DriverName,
+				},
+			},
+			Host: h,
+		}, nil
+	}
 	engineOpts := h.HostOptions.EngineOptions
 	if opts.InsecureRegistry != "" {
 		engineOpts.InsecureRegistry = []string{opts.InsecureRegistry}
@@ -164,18 +592,214 @@ func (d *DockerMachine) CreateMachine(opts CreateMachineOpts) (*Machine, error)
 		engineOpts.StorageDriver = opts.DockerEngineStorageDriver
 	}
 	engineOpts.ArbitraryFlags = opts.ArbitraryFlags
+	if dockerOpts := opts.DockerEngineOpts; dockerOpts != nil {
+		engineOpts.InsecureRegistry = append(engineOpts.InsecureRegistry, dockerOpts.InsecureRegistry...)
+		engineOpts.RegistryMirror = append(engineOpts.RegistryMirror, dockerOpts.RegistryMirror...)
+		if dockerOpts.StorageDriver != "" {
+			engineOpts.StorageDriver = dockerOpts.StorageDriver
+		}
+		engineOpts.ArbitraryFlags = append(append([]string{}, opts.ArbitraryFlags...), dockerOpts.ArbitraryFlags...)
+	}
 	if h.AuthOptions() != nil {
 		h.AuthOptions().StorePath = d.StorePath
 	}
-	errCreate := d.client.Create(h)
+	opts.progress("creating host, waiting for ssh and provisioning docker")
+	configuredData, err := driverCustomData(h.Driver)
+	if err != nil {
+		return nil, err
+	}
+	createCh := make(chan error, 1)
+	go func() {
+		createCh <- d.client.Create(h)
+	}()
+	var errCreate error
+	select {
+	case errCreate = <-createCh:
+	case <-ctx.Done():
+		// libmachine creates can't be interrupted, the host is removed once
+		// the create finishes, in a new operation so that Close waits for it.
+		// The logs are still captured until then.
+		d.ops.Add(1)
+		restoreLogs := releaseLogs
+		releaseLogs = func() {}
+		go func() {
+			defer d.ops.Done()
+			defer restoreLogs()
+			<-createCh
+			errRemove := d.removeHost(h, true)
+			if errRemove != nil {
+				tsuruLog.Errorf("[docker-machine] failed to remove host %q after cancellation: %v", h.Name, errRemove)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+	// libmachine only saves the host in its own store, the host is saved in
+	// the configured store even if the creation failed so that it can be
+	// found and removed later.
+	if d.store != nil {
+		errSave := d.store.Save(h)
+		if errSave != nil && errCreate == nil {
+			errCreate = errors.Wrap(errSave, "failed to save host")
+		}
+	}
 	machine, err := newMachine(h)
+	if machine != nil {
+		for k, v := range configuredData {
+			if _, ok := machine.Base.CustomData[k]; !ok {
+				machine.Base.CustomData[k] = v
+			}
+		}
+	}
 	if errCreate != nil {
 		return machine, errors.Wrap(errCreate, "failed to create host")
 	}
+	if machine != nil {
+		machine.ProvisionDuration = time.Since(t0)
+	}
+	if err == nil && opts.UsePrivateIP {
+		privateIP, _ := machine.Base.CustomData[privateIPFields[opts.DriverName]].(string)
+		if privateIP == "" {
+			return machine, errors.New("failed to retrieve host private ip")
+		}
+		machine.Base.Address = privateIP
+	}
+	if err == nil && len(opts.ExtraVolumes) > 0 {
+		opts.progress("attaching extra volumes")
+		errAttach := volumeAttachers[opts.DriverName](machine.Base.CustomData, opts.ExtraVolumes)
+		if errAttach != nil {
+			return machine, errors.WithMessage(errAttach, "failed to attach extra volumes")
+		}
+	}
+	if err == nil && opts.PostCreateScript != "" {
+		opts.progress("running post create script")
+		out, errScript := runSSHCommand(h, opts.PostCreateScript)
+		if errScript != nil {
+			return machine, errors.Wrapf(errScript, "failed to run post create script: %s", out)
+		}
+	}
+	if err == nil {
+		opts.progress("machine created")
+	}
 	return machine, errors.Wrap(err, "failed to create machine")
 }
 
-func (d *DockerMachine) DeleteMachine(m *iaas.Machine) error {
+// ValidateCredentials checks the cloud credentials in params by performing a
+// cheap authenticated call with the driver, allowing misconfigured drivers to
+// fail before any machine is created. The params are not modified.
+func (d *DockerMachine) ValidateCredentials(driverName string, params map[string]interface{}) error {
+	err := validateDriver(driverName)
+	if err != nil {
+		return err
+	}
+	validator, ok := credentialsValidators[driverName]
+	if !ok {
+		return errors.Errorf("credentials validation is not supported by driver %q", driverName)
+	}
+	done, err := d.startOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer d.captureLogs()()
+	driverOpts := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		driverOpts[k] = v
+	}
+	rawDriver, err := json.Marshal(&drivers.BaseDriver{
+		StorePath: d.StorePath,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal base driver")
+	}
+	h, err := d.client.NewHost(driverName, rawDriver)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize host")
+	}
+	err = configureDriver(h.Driver, driverOpts)
+	if err != nil {
+		return errors.WithMessage(err, "failed to configure driver")
+	}
+	driverData, err := driverCustomData(h.Driver)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(validator(driverData), "invalid credentials")
+}
+
+// existingMachine returns the machine stored with the given name, or nil if
+// there is none. An error is returned if the existing machine is not running.
+func (d *DockerMachine) existingMachine(name string) (*Machine, error) {
+	exists, err := d.machineStore().Exists(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check existing host")
+	}
+	if !exists {
+		return nil, nil
+	}
+	h, err := d.machineStore().Get(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load existing host")
+	}
+	st, err := h.Driver.GetState()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get existing host state")
+	}
+	if st != state.Running {
+		return nil, errors.Errorf("host %q already exists and is not running: %s", name, st)
+	}
+	return newMachine(h)
+}
+
+func (o *CreateMachineOpts) progress(msg string) {
+	if o.ProgressCallback != nil {
+		o.ProgressCallback(msg)
+	}
+}
+
+func (d *DockerMachine) DeleteMachine(ctx context.Context, m *iaas.Machine, opts DeleteMachineOpts) error {
+	done, err := d.startOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer d.captureLogs()()
+	return d.deleteMachine(ctx, m, opts)
+}
+
+// DeleteMachines deletes the machines concurrently, up to
+// deleteMachinesParallelism at a time. A failure deleting a machine does not
+// prevent the others from being deleted, all failures are returned together.
+func (d *DockerMachine) DeleteMachines(ctx context.Context, ms []*iaas.Machine, opts DeleteMachineOpts) error {
+	done, err := d.startOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer d.captureLogs()()
+	sem := make(chan struct{}, deleteMachinesParallelism)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	multiErr := tsuruErrors.NewMultiError()
+	for _, m := range ms {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m *iaas.Machine) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if errDelete := d.deleteMachine(ctx, m, opts); errDelete != nil {
+				mu.Lock()
+				multiErr.Add(fmt.Errorf("failed to delete machine %q: %v", m.Id, errDelete))
+				mu.Unlock()
+			}
+		}(m)
+	}
+	wg.Wait()
+	return multiErr.ToError()
+}
+
+func (d *DockerMachine) deleteMachine(ctx context.Context, m *iaas.Machine, opts DeleteMachineOpts) error {
 	rawDriver, err := json.Marshal(m.CustomData)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal machine data")
@@ -184,20 +808,259 @@ func (d *DockerMachine) DeleteMachine(m *iaas.Machine) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to initialize host")
 	}
-	err = host.Driver.Remove()
+	host.Name = m.Id
+	if opts.DryRun {
+		return d.reportDeleteTarget(host, m.CreationParams["driver"], opts.DryRunCallback)
+	}
+	removeCh := make(chan error, 1)
+	go func() {
+		removeCh <- d.removeHost(host, opts.Force)
+	}()
+	select {
+	case err = <-removeCh:
+		return err
+	case <-ctx.Done():
+		// the removal can't be interrupted, it's waited for in a new
+		// operation so that Close doesn't return while it's running.
+		d.ops.Add(1)
+		go func() {
+			defer d.ops.Done()
+			if errRemove := <-removeCh; errRemove != nil {
+				tsuruLog.Errorf("[docker-machine] failed to remove host %q after cancellation: %v", host.Name, errRemove)
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+// captureLogs copies the libmachine log output to the writers of the
+// DockerMachine and to the tsuru logger, at debug level, until the returned
+// function is called. As the libmachine logger is global, the output of
+// concurrent operations may be mixed.
+func (d *DockerMachine) captureLogs() func() {
+	removeOut := libmachineOut.add(d.outWriter)
+	removeErr := libmachineErr.add(d.errWriter)
+	return func() {
+		removeOut()
+		removeErr()
+	}
+}
+
+// logMux writes to every added writer. The output is also copied once to the
+// tsuru logger while there's any writer.
+type logMux struct {
+	mu      sync.Mutex
+	writers map[int]io.Writer
+	nextID  int
+}
+
+// add adds w to the writers, until the returned function is called.
+func (m *logMux) add(w io.Writer) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writers == nil {
+		m.writers = make(map[int]io.Writer)
+	}
+	id := m.nextID
+	m.nextID++
+	m.writers[id] = w
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.writers, id)
+	}
+}
+
+func (m *logMux) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	writers := make([]io.Writer, 0, len(m.writers))
+	for _, w := range m.writers {
+		writers = append(writers, w)
+	}
+	m.mu.Unlock()
+	if len(writers) == 0 {
+		return len(p), nil
+	}
+	for _, w := range writers {
+		w.Write(p)
+	}
+	return (&debugLogWriter{}).Write(p)
+}
+
+type debugLogWriter struct{}
+
+func (w *debugLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		tsuruLog.Debugf("[docker-machine] %s", line)
+	}
+	return len(p), nil
+}
+
+// reportDeleteTarget calls callback with the state of the host in the driver
+// and in the store, without changing them.
+func (d *DockerMachine) reportDeleteTarget(h *host.Host, driverName string, callback func(DeleteTarget)) error {
+	target := DeleteTarget{Name: h.Name, Driver: driverName}
+	st, err := h.Driver.GetState()
 	if err != nil {
-		return errors.Wrap(err, "failed to remove host")
+		if !isNotFoundError(err) {
+			return errors.Wrap(err, "failed to get host state")
+		}
+		target.Gone = true
+	} else {
+		target.State = st.String()
+	}
+	target.Stored, err = d.machineStore().Exists(h.Name)
+	if err != nil {
+		return errors.Wrap(err, "failed to check host in store")
+	}
+	if callback != nil {
+		callback(target)
+	}
+	return nil
+}
+
+// removeHost removes the host from the driver and from the store. With force,
+// the host is removed from the store even if the driver fails to find it.
+func (d *DockerMachine) removeHost(h *host.Host, force bool) error {
+	err := h.Driver.Remove()
+	if err != nil {
+		if !force || !isNotFoundError(err) {
+			return errors.Wrap(err, "failed to remove host")
+		}
+		tsuruLog.Errorf("[docker-machine] ignoring error removing host %q from driver: %v", h.Name, err)
+	}
+	return d.machineStore().Remove(h.Name)
+}
+
+// notFoundErrorPatterns are lowercase fragments of the errors returned by
+// drivers when the machine does not exist anymore.
+var notFoundErrorPatterns = []string{
+	"not found",
+	"notfound",
+	"does not exist",
+	"no such",
+}
+
+func isNotFoundError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range notFoundErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScaleMachine changes the instance type of an existing machine. The host is
+// stopped and resized by the provider, then started again. The new instance
+// type is persisted on the stored host and on the machine CustomData, which
+// are left untouched if any step fails. Canceling ctx interrupts the resize
+// with the provider.
+func (d *DockerMachine) ScaleMachine(ctx context.Context, m *iaas.Machine, opts ScaleMachineOpts) error {
+	done, err := d.startOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer d.captureLogs()()
+	driverName := m.CreationParams["driver"]
+	field, ok := instanceTypeFields[driverName]
+	if !ok {
+		return errors.Errorf("scale is not supported by driver %q", driverName)
+	}
+	if opts.InstanceType == "" {
+		return errors.New("instance type is required")
+	}
+	h, err := d.machineStore().Get(m.Id)
+	if err != nil {
+		return errors.Wrap(err, "failed to load host")
+	}
+	driverData, err := driverCustomData(h.Driver)
+	if err != nil {
+		return err
+	}
+	err = instanceResizers[driverName](ctx, driverData, opts.InstanceType)
+	if err != nil {
+		return errors.Wrap(err, "failed to resize host")
+	}
+	err = h.Driver.Start()
+	if err != nil {
+		return errors.Wrap(err, "failed to start host")
+	}
+	rawType, err := json.Marshal(map[string]string{field: opts.InstanceType})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal instance type")
+	}
+	err = json.Unmarshal(rawType, h.Driver)
+	if err != nil {
+		return errors.Wrap(err, "failed to update host driver")
+	}
+	err = d.machineStore().Save(h)
+	if err != nil {
+		return errors.Wrap(err, "failed to save host")
+	}
+	driverData, err = driverCustomData(h.Driver)
+	if err != nil {
+		return err
 	}
-	return d.client.Remove(m.Id)
+	driverData[field] = opts.InstanceType
+	m.CustomData = driverData
+	return nil
+}
+
+// RefreshMachine queries the driver for the current state of the stored
+// host, returning the machine with its status, address and custom data
+// updated. The address is only updated while the host is running, as
+// stopped hosts have none, and machines addressed by their private IP keep
+// being so.
+func (d *DockerMachine) RefreshMachine(m *iaas.Machine) (*Machine, error) {
+	done, err := d.startOperation()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	h, err := d.machineStore().Get(m.Id)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load host")
+	}
+	st, err := h.Driver.GetState()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get host state")
+	}
+	driverData, err := driverCustomData(h.Driver)
+	if err != nil {
+		return nil, err
+	}
+	base := *m
+	base.Status = st.String()
+	base.CustomData = driverData
+	if st == state.Running {
+		address, err := h.Driver.GetIP()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to retrieve host ip")
+		}
+		if field, ok := privateIPFields[m.CreationParams["driver"]]; ok && m.Address != "" && m.Address == m.CustomData[field] {
+			address, _ = driverData[field].(string)
+		}
+		if address != "" {
+			base.Address = address
+		}
+	}
+	return &Machine{Base: &base, Host: h}, nil
 }
 
 func (d *DockerMachine) DeleteAll() error {
-	hosts, err := d.client.List()
+	done, err := d.startOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+	hosts, err := d.machineStore().List()
 	if err != nil {
 		return err
 	}
 	for _, n := range hosts {
-		h, errLoad := d.client.Load(n)
+		h, errLoad := d.machineStore().Get(n)
 		if errLoad != nil {
 			return errLoad
 		}
@@ -213,6 +1076,11 @@ func (d *DockerMachine) DeleteAll() error {
 // the current running DockerMachine. It expects all data needed to Marshal
 // the host/driver to be available on CustomData.
 func (d *DockerMachine) RegisterMachine(opts RegisterMachineOpts) (*Machine, error) {
+	done, err := d.startOperation()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 	if !d.temp {
 		return nil, errors.New("register is only available without user defined StorePath")
 	}
@@ -244,11 +1112,11 @@ func (d *DockerMachine) RegisterMachine(opts RegisterMachineOpts) (*Machine, err
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	err = d.client.Save(h)
+	err = d.machineStore().Save(h)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	savedHost, err := d.client.Load(h.Name)
+	savedHost, err := d.machineStore().Get(h.Name)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -258,14 +1126,21 @@ func (d *DockerMachine) RegisterMachine(opts RegisterMachineOpts) (*Machine, err
 	}, nil
 }
 
+// List returns a Machine for each host known by the libmachine store, which
+// may be used to find hosts orphaned by failed operations.
 func (d *DockerMachine) List() ([]*Machine, error) {
-	names, err := d.client.List()
+	done, err := d.startOperation()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	names, err := d.machineStore().List()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	var machines []*Machine
 	for _, n := range names {
-		h, err := d.client.Load(n)
+		h, err := d.machineStore().Get(n)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -278,8 +1153,8 @@ func (d *DockerMachine) List() ([]*Machine, error) {
 	return machines, nil
 }
 
-func newMachine(h *host.Host) (*Machine, error) {
-	rawDriver, err := json.Marshal(h.Driver)
+func driverCustomData(driver drivers.Driver) (map[string]interface{}, error) {
+	rawDriver, err := json.Marshal(driver)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to marshal host driver")
 	}
@@ -288,6 +1163,14 @@ func newMachine(h *host.Host) (*Machine, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to unmarshal host driver")
 	}
+	return driverData, nil
+}
+
+func newMachine(h *host.Host) (*Machine, error) {
+	driverData, err := driverCustomData(h.Driver)
+	if err != nil {
+		return nil, err
+	}
 	m := &Machine{
 		Base: &iaas.Machine{
 			Id:         h.Name,
@@ -322,6 +1205,165 @@ func newMachine(h *host.Host) (*Machine, error) {
 	return m, nil
 }
 
+// writeUserDataFile writes userData to a temporary file and sets it on the
+// driver option used to pass user data files to the driver.
+func writeUserDataFile(driverName, userData string, driverOpts map[string]interface{}) (string, error) {
+	param, ok := userDataFileParams[driverName]
+	if !ok {
+		return "", errors.Errorf("user data is not supported by driver %q", driverName)
+	}
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create userdata file")
+	}
+	defer f.Close()
+	_, err = f.WriteString(userData)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "failed to write userdata file")
+	}
+	driverOpts[param] = f.Name()
+	return f.Name(), nil
+}
+
+// setSubnetParam sets the subnet option of the driver with a subnet picked
+// from subnets, unless a subnet is already set in driverOpts.
+func setSubnetParam(driverOpts map[string]interface{}, driverName string, subnets []string, strategy SubnetStrategy) error {
+	if len(subnets) == 0 {
+		return nil
+	}
+	param, ok := subnetParams[driverName]
+	if !ok {
+		return errors.Errorf("subnets are not supported by driver %q", driverName)
+	}
+	if subnet, ok := driverOpts[param]; ok && subnet != "" {
+		return errors.Errorf("subnets can't be used with a subnet set in %s", param)
+	}
+	subnet, err := strategy.pick(subnets)
+	if err != nil {
+		return err
+	}
+	driverOpts[param] = subnet
+	return nil
+}
+
+// setAvailabilityZoneParams sets the region and zone options of the driver
+// from zone, failing if they are already set to a different region or zone.
+func setAvailabilityZoneParams(driverOpts map[string]interface{}, driverName, zone string) error {
+	if zone == "" {
+		return nil
+	}
+	regionParam, ok := regionParams[driverName]
+	if !ok {
+		return errors.Errorf("availability zone is not supported by driver %q", driverName)
+	}
+	zoneParam := zoneParams[driverName]
+	if len(zone) < 2 {
+		return errors.Errorf("invalid availability zone %q", zone)
+	}
+	region, letter := zone[:len(zone)-1], zone[len(zone)-1:]
+	if v, ok := driverOpts[regionParam]; ok && v != "" && v != region {
+		return errors.Errorf("availability zone %q is not in region %v set in %s", zone, v, regionParam)
+	}
+	if v, ok := driverOpts[zoneParam]; ok && v != "" && v != letter {
+		return errors.Errorf("availability zone %q conflicts with zone %v set in %s", zone, v, zoneParam)
+	}
+	driverOpts[regionParam] = region
+	driverOpts[zoneParam] = letter
+	return nil
+}
+
+// checkSubnetZone fails if the subnet configured in the driver is not in the
+// given availability zone.
+func checkSubnetZone(driver drivers.Driver, driverName, zone string) error {
+	driverData, err := driverCustomData(driver)
+	if err != nil {
+		return err
+	}
+	subnetZone, err := subnetZoneLookups[driverName](driverData)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve subnet availability zone")
+	}
+	if subnetZone != "" && subnetZone != zone {
+		return errors.Errorf("availability zone %q conflicts with zone %q of the subnet", zone, subnetZone)
+	}
+	return nil
+}
+
+// setSecurityGroupIDsParams validates that security group ids are supported
+// by the driver and not ambiguous with security group names in driverOpts,
+// clearing the driver default names.
+func setSecurityGroupIDsParams(driverOpts map[string]interface{}, driverName string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, ok := securityGroupIDFields[driverName]; !ok {
+		return errors.Errorf("security group ids are not supported by driver %q", driverName)
+	}
+	param := securityGroupNameParams[driverName]
+	if names, ok := driverOpts[param]; ok && names != "" {
+		return errors.Errorf("security group ids can't be used with security group names set in %s", param)
+	}
+	driverOpts[param] = []string{}
+	return nil
+}
+
+// validateExtraVolumes checks that the driver supports extra volumes and
+// that every volume has a size and a device name.
+func validateExtraVolumes(driverName string, volumes []VolumeSpec) error {
+	if len(volumes) == 0 {
+		return nil
+	}
+	if _, ok := volumeAttachers[driverName]; !ok {
+		return errors.Errorf("extra volumes are not supported by driver %q", driverName)
+	}
+	for _, volume := range volumes {
+		if volume.SizeGB <= 0 {
+			return errors.Errorf("extra volume size must be positive, got %d", volume.SizeGB)
+		}
+		if volume.DeviceName == "" {
+			return errors.New("extra volume device name is required")
+		}
+	}
+	return nil
+}
+
+// setDriverParam sets value on the driver option mapped to driverName in
+// driverParams, failing if the driver has no such option.
+func setDriverParam(driverOpts map[string]interface{}, driverParams map[string]string, driverName, value, desc string) error {
+	if value == "" {
+		return nil
+	}
+	param, ok := driverParams[driverName]
+	if !ok {
+		return errors.Errorf("%s is not supported by driver %q", desc, driverName)
+	}
+	driverOpts[param] = value
+	return nil
+}
+
+// setDriverTags adds tags to the driver tags option, using the key1,value1
+// format expected by amazonec2. Drivers without support for key/value tags
+// ignore them.
+func setDriverTags(driverOpts map[string]interface{}, driverName string, tags map[string]string) {
+	if len(tags) == 0 || driverName != "amazonec2" {
+		return
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	if existing, ok := driverOpts["amazonec2-tags"].(string); ok && existing != "" {
+		parts = append(parts, existing)
+	}
+	for _, k := range keys {
+		parts = append(parts, k, tags[k])
+	}
+	driverOpts["amazonec2-tags"] = strings.Join(parts, ",")
+}
+
 func configureDriver(driver drivers.Driver, driverOpts map[string]interface{}) error {
 	opts := &rpcdriver.RPCFlags{Values: driverOpts}
 	for _, c := range driver.GetCreateFlags() {
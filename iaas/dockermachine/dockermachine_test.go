@@ -5,12 +5,30 @@
 package dockermachine
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/docker/machine/drivers/amazonec2"
+	"github.com/docker/machine/drivers/fakedriver"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/host"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/pkg/errors"
 	"github.com/tsuru/tsuru/iaas"
+	tsuruLog "github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/safe"
 	check "gopkg.in/check.v1"
 )
 
@@ -78,6 +96,67 @@ func (s *S) TestClose(c *check.C) {
 	c.Assert(pathInfo, check.IsNil)
 }
 
+func (s *S) TestCloseWaitsOutstandingCreate(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{createWait: make(chan struct{}), createCh: make(chan struct{})}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	createErrCh := make(chan error)
+	go func() {
+		_, createErr := dm.CreateMachine(context.Background(), CreateMachineOpts{
+			Name:       "my-machine",
+			DriverName: "fakedriver",
+			Params:     map[string]interface{}{},
+		})
+		createErrCh <- createErr
+	}()
+	<-fakeAPI.createCh
+	closeErrCh := make(chan error)
+	go func() {
+		closeErrCh <- dm.Close()
+	}()
+	select {
+	case <-closeErrCh:
+		c.Fatal("close returned with outstanding create")
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "other-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.Equals, ErrDockerMachineClosed)
+	close(fakeAPI.createWait)
+	c.Assert(<-createErrCh, check.IsNil)
+	c.Assert(<-closeErrCh, check.IsNil)
+	c.Assert(fakeAPI.closed, check.Equals, true)
+}
+
+func (s *S) TestCloseTimeoutOutstandingCreate(c *check.C) {
+	defer func(old time.Duration) { closeTimeout = old }(closeTimeout)
+	closeTimeout = 100 * time.Millisecond
+	fakeAPI := &fakeLibMachineAPI{createWait: make(chan struct{}), createCh: make(chan struct{})}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	createErrCh := make(chan error)
+	go func() {
+		_, createErr := dm.CreateMachine(context.Background(), CreateMachineOpts{
+			Name:       "my-machine",
+			DriverName: "fakedriver",
+			Params:     map[string]interface{}{},
+		})
+		createErrCh <- createErr
+	}()
+	<-fakeAPI.createCh
+	err = dm.Close()
+	c.Assert(err, check.ErrorMatches, "timeout after 100ms waiting for outstanding operations")
+	close(fakeAPI.createWait)
+	c.Assert(<-createErrCh, check.ErrorMatches, "failed to create host: store closed")
+}
+
 func (s *S) TestCreateMachine(c *check.C) {
 	fakeAPI := &fakeLibMachineAPI{}
 	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
@@ -101,7 +180,7 @@ func (s *S) TestCreateMachine(c *check.C) {
 		RegistryMirror:         "http://registry-mirror.com",
 		ArbitraryFlags:         []string{"flag1", "flag2"},
 	}
-	m, err := dm.CreateMachine(opts)
+	m, err := dm.CreateMachine(context.Background(), opts)
 	c.Assert(err, check.IsNil)
 	base := m.Base
 	c.Assert(base.Id, check.Equals, "my-machine")
@@ -126,23 +205,1554 @@ func (s *S) TestCreateMachine(c *check.C) {
 	c.Assert(engineOpts.ArbitraryFlags, check.DeepEquals, []string{"flag1", "flag2"})
 }
 
-func (s *S) TestDeleteMachine(c *check.C) {
+func (s *S) TestCreateMachineDockerEngineOpts(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	opts := CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+			"amazonec2-subnet-id":  "subnet-id",
+		},
+		RegistryMirror: "http://registry-mirror.com",
+		ArbitraryFlags: []string{"flag1"},
+		DockerEngineOpts: &DockerEngineOpts{
+			InsecureRegistry: []string{"registry.com", "registry2.com"},
+			RegistryMirror:   []string{"http://registry-mirror2.com"},
+			StorageDriver:    "overlay2",
+			ArbitraryFlags:   []string{"log-driver=json-file", "log-opt=max-size=10m"},
+		},
+	}
+	_, err = dm.CreateMachine(context.Background(), opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(fakeAPI.Hosts), check.Equals, 1)
+	engineOpts := fakeAPI.Hosts[0].HostOptions.EngineOptions
+	c.Assert(engineOpts.InsecureRegistry, check.DeepEquals, []string{"registry.com", "registry2.com"})
+	c.Assert(engineOpts.RegistryMirror, check.DeepEquals, []string{"http://registry-mirror.com", "http://registry-mirror2.com"})
+	c.Assert(engineOpts.StorageDriver, check.Equals, "overlay2")
+	c.Assert(engineOpts.ArbitraryFlags, check.DeepEquals, []string{"flag1", "log-driver=json-file", "log-opt=max-size=10m"})
+	c.Assert(opts.ArbitraryFlags, check.DeepEquals, []string{"flag1"})
+}
+
+func (s *S) TestCreateMachinePostCreateScript(c *check.C) {
+	defer func(old func(*host.Host, string) (string, error)) { runSSHCommand = old }(runSSHCommand)
+	var executed []string
+	runSSHCommand = func(h *host.Host, command string) (string, error) {
+		state, err := h.Driver.GetState()
+		c.Assert(err, check.IsNil)
+		c.Assert(state.String(), check.Equals, "Running")
+		executed = append(executed, h.Name+": "+command)
+		return "", nil
+	}
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:             "my-machine",
+		DriverName:       "fakedriver",
+		Params:           map[string]interface{}{},
+		PostCreateScript: "mount /dev/xvdb /data",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(executed, check.DeepEquals, []string{"my-machine: mount /dev/xvdb /data"})
+}
+
+func (s *S) TestCreateMachinePostCreateScriptFailure(c *check.C) {
+	defer func(old func(*host.Host, string) (string, error)) { runSSHCommand = old }(runSSHCommand)
+	runSSHCommand = func(h *host.Host, command string) (string, error) {
+		return "mount: /data: special device /dev/xvdb does not exist", errors.New("exit status 32")
+	}
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:             "my-machine",
+		DriverName:       "fakedriver",
+		Params:           map[string]interface{}{},
+		PostCreateScript: "mount /dev/xvdb /data",
+	})
+	c.Assert(err, check.ErrorMatches, "failed to run post create script: mount: /data: special device /dev/xvdb does not exist: exit status 32")
+	c.Assert(m, check.NotNil)
+	c.Assert(m.Base.Id, check.Equals, "my-machine")
+}
+
+func (s *S) TestCreateMachineUsePrivateIP(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{privateIP: "10.0.0.5"}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	opts := CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+			"amazonec2-subnet-id":  "subnet-id",
+		},
+	}
+	m, err := dm.CreateMachine(context.Background(), opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Base.Address, check.Equals, "192.168.10.3")
+	opts.Name = "my-private-machine"
+	opts.UsePrivateIP = true
+	m, err = dm.CreateMachine(context.Background(), opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Base.Address, check.Equals, "10.0.0.5")
+}
+
+func (s *S) TestCreateMachineUsePrivateIPUnsupportedDriver(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:         "my-machine",
+		DriverName:   "fakedriver",
+		Params:       map[string]interface{}{},
+		UsePrivateIP: true,
+	})
+	c.Assert(err, check.ErrorMatches, `private ip is not supported by driver "fakedriver"`)
+	c.Assert(fakeAPI.FakeStore, check.IsNil)
+}
+
+func (s *S) TestCreateMachineIdempotent(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	opts := CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+		Idempotent: true,
+	}
+	m1, err := dm.CreateMachine(context.Background(), opts)
+	c.Assert(err, check.IsNil)
+	m2, err := dm.CreateMachine(context.Background(), opts)
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 1)
+	c.Assert(m2.Base.Id, check.Equals, "my-machine")
+	c.Assert(m2.Base.Address, check.Equals, m1.Base.Address)
+	c.Assert(m2.Host, check.Equals, fakeAPI.Hosts[0])
+}
+
+func (s *S) TestCreateMachineIdempotentNotRunning(c *check.C) {
 	fakeAPI := &fakeLibMachineAPI{}
 	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
 	c.Assert(err, check.IsNil)
 	defer dmAPI.Close()
 	dm := dmAPI.(*DockerMachine)
 	dm.client = fakeAPI
-	m, err := dm.CreateMachine(CreateMachineOpts{
+	opts := CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+		Idempotent: true,
+	}
+	_, err = dm.CreateMachine(context.Background(), opts)
+	c.Assert(err, check.IsNil)
+	fakeAPI.Hosts[0].Driver.(*fakedriver.Driver).MockState = state.Stopped
+	_, err = dm.CreateMachine(context.Background(), opts)
+	c.Assert(err, check.ErrorMatches, `host "my-machine" already exists and is not running: Stopped`)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 1)
+}
+
+func (s *S) TestCreateMachineLogsLibmachineOutput(c *check.C) {
+	logBuf := safe.NewBuffer(nil)
+	tsuruLog.SetLogger(tsuruLog.NewWriterLogger(logBuf, true))
+	defer tsuruLog.SetLogger(nil)
+	fakeAPI := &fakeLibMachineAPI{}
+	outBuf := &bytes.Buffer{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{OutWriter: outBuf})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
 		Name:       "my-machine",
 		DriverName: "fakedriver",
 		Params:     map[string]interface{}{},
 	})
 	c.Assert(err, check.IsNil)
-	c.Assert(len(fakeAPI.Hosts), check.Equals, 1)
-	err = dm.DeleteMachine(m.Base)
+	c.Assert(logBuf.String(), check.Matches, `(?s).*\[docker-machine\] Creating machine my-machine\.\.\..*`)
+	c.Assert(outBuf.String(), check.Equals, "Creating machine my-machine...\n")
+	logBuf.Reset()
+	log.Info("after create")
+	c.Assert(logBuf.String(), check.Equals, "")
+	c.Assert(outBuf.String(), check.Equals, "Creating machine my-machine...\n")
+}
+
+func (s *S) TestCreateMachineConcurrentLogs(c *check.C) {
+	fakeAPI1 := &fakeLibMachineAPI{createWait: make(chan struct{}), createCh: make(chan struct{})}
+	outBuf1 := safe.NewBuffer(nil)
+	dmAPI1, err := NewDockerMachine(DockerMachineConfig{OutWriter: outBuf1})
 	c.Assert(err, check.IsNil)
-	c.Assert(len(fakeAPI.Hosts), check.Equals, 0)
+	defer dmAPI1.Close()
+	dm1 := dmAPI1.(*DockerMachine)
+	dm1.client = fakeAPI1
+	createErrCh1 := make(chan error)
+	go func() {
+		_, createErr := dm1.CreateMachine(context.Background(), CreateMachineOpts{
+			Name:       "my-machine",
+			DriverName: "fakedriver",
+			Params:     map[string]interface{}{},
+		})
+		createErrCh1 <- createErr
+	}()
+	<-fakeAPI1.createCh
+	outBuf2 := safe.NewBuffer(nil)
+	dmAPI2, err := NewDockerMachine(DockerMachineConfig{OutWriter: outBuf2})
+	c.Assert(err, check.IsNil)
+	defer dmAPI2.Close()
+	dm2 := dmAPI2.(*DockerMachine)
+	dm2.client = &fakeLibMachineAPI{}
+	_, err = dm2.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "other-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(outBuf2.String(), check.Equals, "Creating machine other-machine...\n")
+	log.Info("first create")
+	close(fakeAPI1.createWait)
+	c.Assert(<-createErrCh1, check.IsNil)
+	c.Assert(outBuf1.String(), check.Equals, "Creating machine other-machine...\nfirst create\n")
+	c.Assert(outBuf2.String(), check.Equals, "Creating machine other-machine...\n")
+}
+
+func (s *S) TestCreateMachineKeepsDriverDetails(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key":     "access-key",
+			"amazonec2-secret-key":     "secret-key",
+			"amazonec2-vpc-id":         "vpc-id",
+			"amazonec2-security-group": "sg1,sg2",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Region(), check.Equals, "us-east-1")
+	c.Assert(m.VpcID(), check.Equals, "vpc-id")
+	c.Assert(m.SecurityGroups(), check.DeepEquals, []string{"sg1", "sg2"})
+	c.Assert(m.Base.CustomData["MockIP"], check.Equals, "192.168.10.3")
+	m, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine-2",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+			"amazonec2-subnet-id":  "subnet-id",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.SubnetID(), check.Equals, "subnet-id")
+}
+
+func (s *S) TestCreateMachineContextCanceled(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{createWait: make(chan struct{})}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	m, err := dm.CreateMachine(ctx, CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.Equals, context.Canceled)
+	c.Assert(m, check.IsNil)
+	closeErrCh := make(chan error)
+	go func() {
+		closeErrCh <- dm.Close()
+	}()
+	select {
+	case <-closeErrCh:
+		c.Fatal("close returned with outstanding create")
+	case <-time.After(100 * time.Millisecond):
+	}
+	fakeAPI.mu.Lock()
+	c.Assert(fakeAPI.removed, check.HasLen, 0)
+	fakeAPI.mu.Unlock()
+	close(fakeAPI.createWait)
+	c.Assert(<-closeErrCh, check.IsNil)
+	c.Assert(fakeAPI.removed, check.DeepEquals, []string{"my-machine"})
+}
+
+func (s *S) TestCreateMachineUnknownDriver(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec3",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.ErrorMatches, `unknown driver "amazonec3": must be one of amazonec2, .* or have a docker-machine-driver-amazonec3 binary in PATH`)
+	c.Assert(fakeAPI.driverName, check.Equals, "")
+}
+
+func (s *S) TestCreateMachineUserData(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params:     driverOpts,
+		UserData:   "#cloud-config\nruncmd: []",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.ec2Driver.UserDataFile, check.Not(check.Equals), "")
+	c.Assert(driverOpts["amazonec2-userdata"], check.IsNil)
+	c.Assert(fakeAPI.userData, check.Equals, "#cloud-config\nruncmd: []")
+	_, err = os.Stat(fakeAPI.ec2Driver.UserDataFile)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestCreateMachineUserDataUnsupportedDriver(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+		UserData:   "#cloud-config",
+	})
+	c.Assert(err, check.ErrorMatches, `user data is not supported by driver "fakedriver"`)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineSSHKey(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params:     driverOpts,
+		SSHKeyPath: "/keys/id_rsa",
+		SSHKeyName: "my-key",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(driverOpts, check.DeepEquals, map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+	})
+	c.Assert(fakeAPI.ec2Driver.SSHPrivateKeyPath, check.Equals, "/keys/id_rsa")
+	c.Assert(fakeAPI.ec2Driver.KeyName, check.Equals, "my-key")
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "other-machine",
+		DriverName: "amazonec2",
+		SSHKeyPath: "/keys/id_rsa",
+	})
+	c.Assert(err, check.ErrorMatches, "failed to configure driver.*")
+}
+
+func (s *S) TestCreateMachineSSHKeyUnsupportedDriver(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+		SSHKeyName: "my-key",
+	})
+	c.Assert(err, check.ErrorMatches, `ssh key name is not supported by driver "fakedriver"`)
+	c.Assert(fakeAPI.FakeStore, check.IsNil)
+}
+
+func (s *S) TestCreateMachineIAMInstanceProfile(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:               "my-machine",
+		DriverName:         "amazonec2",
+		Params:             driverOpts,
+		IAMInstanceProfile: "node-profile",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(driverOpts["amazonec2-iam-instance-profile"], check.IsNil)
+	c.Assert(fakeAPI.ec2Driver.IamInstanceProfile, check.Equals, "node-profile")
+	c.Assert(fakeAPI.ec2Driver.AccessKey, check.Equals, "access-key")
+	c.Assert(fakeAPI.ec2Driver.SecretKey, check.Equals, "secret-key")
+}
+
+func (s *S) TestCreateMachineIAMInstanceProfileUnsupportedDriver(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:               "my-machine",
+		DriverName:         "fakedriver",
+		Params:             map[string]interface{}{},
+		IAMInstanceProfile: "node-profile",
+	})
+	c.Assert(err, check.ErrorMatches, `iam instance profile is not supported by driver "fakedriver"`)
+}
+
+func (s *S) TestCreateMachineProvisionDuration(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{createWait: make(chan struct{})}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	time.AfterFunc(50*time.Millisecond, func() { close(fakeAPI.createWait) })
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.ProvisionDuration >= 50*time.Millisecond, check.Equals, true, check.Commentf("duration: %v", m.ProvisionDuration))
+	c.Assert(m.ProvisionDuration < 5*time.Second, check.Equals, true, check.Commentf("duration: %v", m.ProvisionDuration))
+	existing, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Idempotent: true,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(existing.ProvisionDuration, check.Equals, time.Duration(0))
+}
+
+func (s *S) TestCreateMachineEngineInstallURL(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:                   "my-machine",
+		DriverName:             "fakedriver",
+		DockerEngineInstallURL: "http://mirror.internal/install-docker.sh",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Host.HostOptions.EngineOptions.InstallURL, check.Equals, "http://mirror.internal/install-docker.sh")
+	m, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine-2",
+		DriverName: "fakedriver",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Host.HostOptions.EngineOptions.InstallURL, check.Equals, drivers.DefaultEngineInstallURL)
+}
+
+func (s *S) TestCreateMachineRootVolume(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:             "my-machine",
+		DriverName:       "amazonec2",
+		Params:           driverOpts,
+		RootVolumeSizeGB: 100,
+		RootVolumeType:   "io1",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.ec2Driver.RootSize, check.Equals, int64(100))
+	c.Assert(fakeAPI.ec2Driver.VolumeType, check.Equals, "io1")
+}
+
+func (s *S) TestCreateMachineRootVolumeDefaults(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params:     driverOpts,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.ec2Driver.RootSize, check.Equals, int64(16))
+	c.Assert(fakeAPI.ec2Driver.VolumeType, check.Equals, "gp2")
+}
+
+func (s *S) TestCreateMachineRootVolumeInvalid(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:             "my-machine",
+		DriverName:       "amazonec2",
+		Params:           map[string]interface{}{},
+		RootVolumeSizeGB: -10,
+	})
+	c.Assert(err, check.ErrorMatches, `root volume size must be positive, got -10`)
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:           "my-machine",
+		DriverName:     "fakedriver",
+		Params:         map[string]interface{}{},
+		RootVolumeType: "io1",
+	})
+	c.Assert(err, check.ErrorMatches, `root volume type is not supported by driver "fakedriver"`)
+}
+
+func (s *S) TestCreateMachineSubnets(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	params := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+	}
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+			Name:       fmt.Sprintf("my-machine-%d", i),
+			DriverName: "amazonec2",
+			Params:     params,
+			Subnets:    []string{"subnet-a", "subnet-b", "subnet-c"},
+		})
+		c.Assert(err, check.IsNil)
+		counts[fakeAPI.ec2Driver.SubnetId]++
+	}
+	c.Assert(counts, check.DeepEquals, map[string]int{"subnet-a": 2, "subnet-b": 2, "subnet-c": 2})
+}
+
+func (s *S) TestCreateMachineSubnetsRandom(c *check.C) {
+	defer func() { subnetIntn = rand.Intn }()
+	var picks []int
+	subnetIntn = func(n int) int {
+		c.Assert(n, check.Equals, 2)
+		picks = append(picks, 1)
+		return 1
+	}
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+		},
+		Subnets:        []string{"subnet-a", "subnet-b"},
+		SubnetStrategy: SubnetStrategyRandom,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(picks, check.HasLen, 1)
+	c.Assert(fakeAPI.ec2Driver.SubnetId, check.Equals, "subnet-b")
+}
+
+func (s *S) TestCreateMachineSubnetsInvalid(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:           "my-machine",
+		DriverName:     "amazonec2",
+		Params:         map[string]interface{}{},
+		Subnets:        []string{"subnet-a"},
+		SubnetStrategy: "closest",
+	})
+	c.Assert(err, check.ErrorMatches, `invalid subnet strategy "closest": must be one of round-robin, random`)
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params:     map[string]interface{}{"amazonec2-subnet-id": "subnet-id"},
+		Subnets:    []string{"subnet-a"},
+	})
+	c.Assert(err, check.ErrorMatches, `subnets can't be used with a subnet set in amazonec2-subnet-id`)
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+		Subnets:    []string{"subnet-a"},
+	})
+	c.Assert(err, check.ErrorMatches, `subnets are not supported by driver "fakedriver"`)
+}
+
+func (s *S) TestCreateMachineExtraVolumes(c *check.C) {
+	defer func(old func(map[string]interface{}, []VolumeSpec) error) { volumeAttachers["amazonec2"] = old }(volumeAttachers["amazonec2"])
+	var driverData map[string]interface{}
+	var attached []VolumeSpec
+	volumeAttachers["amazonec2"] = func(data map[string]interface{}, volumes []VolumeSpec) error {
+		driverData = data
+		attached = volumes
+		return nil
+	}
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	volumes := []VolumeSpec{
+		{SizeGB: 100, Type: "gp2", DeviceName: "/dev/sdf"},
+		{SizeGB: 500, Type: "st1", DeviceName: "/dev/sdg"},
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+			"amazonec2-region":     "us-west-2",
+			"amazonec2-zone":       "b",
+			"amazonec2-subnet-id":  "subnet-id",
+		},
+		ExtraVolumes: volumes,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(attached, check.DeepEquals, volumes)
+	c.Assert(driverData["Region"], check.Equals, "us-west-2")
+	c.Assert(driverData["Zone"], check.Equals, "b")
+	c.Assert(driverData["AccessKey"], check.Equals, "access-key")
+	c.Assert(driverData["MockName"], check.Equals, "my-machine")
+	volumeAttachers["amazonec2"] = func(data map[string]interface{}, volumes []VolumeSpec) error {
+		return errors.New("VolumeLimitExceeded")
+	}
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine-2",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+			"amazonec2-subnet-id":  "subnet-id",
+		},
+		ExtraVolumes: volumes,
+	})
+	c.Assert(err, check.ErrorMatches, "failed to attach extra volumes: VolumeLimitExceeded")
+	c.Assert(m, check.NotNil)
+}
+
+func (s *S) TestCreateMachineExtraVolumesInvalid(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	tests := []struct {
+		driver  string
+		volume  VolumeSpec
+		errorRe string
+	}{
+		{driver: "fakedriver", volume: VolumeSpec{SizeGB: 10, DeviceName: "/dev/sdf"}, errorRe: `extra volumes are not supported by driver "fakedriver"`},
+		{driver: "amazonec2", volume: VolumeSpec{DeviceName: "/dev/sdf"}, errorRe: `extra volume size must be positive, got 0`},
+		{driver: "amazonec2", volume: VolumeSpec{SizeGB: 10}, errorRe: `extra volume device name is required`},
+	}
+	for _, tt := range tests {
+		_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+			Name:         "my-machine",
+			DriverName:   tt.driver,
+			Params:       map[string]interface{}{},
+			ExtraVolumes: []VolumeSpec{tt.volume},
+		})
+		c.Assert(err, check.ErrorMatches, tt.errorRe)
+	}
+}
+
+func (s *S) TestCreateMachineAvailabilityZone(c *check.C) {
+	defer func(old func(map[string]interface{}) (string, error)) { subnetZoneLookups["amazonec2"] = old }(subnetZoneLookups["amazonec2"])
+	subnetZoneLookups["amazonec2"] = func(data map[string]interface{}) (string, error) {
+		zones := map[string]string{"subnet-a": "us-west-2a", "subnet-b": "us-west-2b"}
+		return zones[data["SubnetId"].(string)], nil
+	}
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+			"amazonec2-subnet-id":  "subnet-b",
+		},
+		AvailabilityZone: "us-west-2b",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.ec2Driver.Region, check.Equals, "us-west-2")
+	c.Assert(fakeAPI.ec2Driver.Zone, check.Equals, "b")
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine-2",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+		},
+		Subnets:          []string{"subnet-a"},
+		AvailabilityZone: "us-west-2b",
+	})
+	c.Assert(err, check.ErrorMatches, `availability zone "us-west-2b" conflicts with zone "us-west-2a" of the subnet`)
+}
+
+func (s *S) TestCreateMachineAvailabilityZoneInvalid(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	tests := []struct {
+		driver  string
+		params  map[string]interface{}
+		zone    string
+		errorRe string
+	}{
+		{driver: "fakedriver", zone: "us-east-1a", errorRe: `availability zone is not supported by driver "fakedriver"`},
+		{driver: "amazonec2", zone: "a", errorRe: `invalid availability zone "a"`},
+		{driver: "amazonec2", params: map[string]interface{}{"amazonec2-region": "us-east-1"}, zone: "us-west-2a", errorRe: `availability zone "us-west-2a" is not in region us-east-1 set in amazonec2-region`},
+		{driver: "amazonec2", params: map[string]interface{}{"amazonec2-zone": "c"}, zone: "us-west-2a", errorRe: `availability zone "us-west-2a" conflicts with zone c set in amazonec2-zone`},
+	}
+	for _, tt := range tests {
+		params := tt.params
+		if params == nil {
+			params = map[string]interface{}{}
+		}
+		_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+			Name:             "my-machine",
+			DriverName:       tt.driver,
+			Params:           params,
+			AvailabilityZone: tt.zone,
+		})
+		c.Assert(err, check.ErrorMatches, tt.errorRe)
+	}
+}
+
+func (s *S) TestCreateMachineSecurityGroupIDs(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:             "my-machine",
+		DriverName:       "amazonec2",
+		Params:           driverOpts,
+		SecurityGroupIDs: []string{"sg-1", "sg-2"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.ec2Driver.SecurityGroupIds, check.DeepEquals, []string{"sg-1", "sg-2"})
+	c.Assert(fakeAPI.ec2Driver.SecurityGroupNames, check.HasLen, 0)
+	c.Assert(fakeAPI.ec2Driver.AccessKey, check.Equals, "access-key")
+}
+
+func (s *S) TestCreateMachineSecurityGroupIDsInvalid(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-security-group": "sg-name",
+		},
+		SecurityGroupIDs: []string{"sg-1"},
+	})
+	c.Assert(err, check.ErrorMatches, `security group ids can't be used with security group names set in amazonec2-security-group`)
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:             "my-machine",
+		DriverName:       "fakedriver",
+		Params:           map[string]interface{}{},
+		SecurityGroupIDs: []string{"sg-1"},
+	})
+	c.Assert(err, check.ErrorMatches, `security group ids are not supported by driver "fakedriver"`)
+}
+
+func (s *S) TestCreateMachineSpot(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params:     driverOpts,
+		Spot:       true,
+		SpotPrice:  "0.10",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.ec2Driver.RequestSpotInstance, check.Equals, true)
+	c.Assert(fakeAPI.ec2Driver.SpotPrice, check.Equals, "0.10")
+}
+
+func (s *S) TestCreateMachineSpotUnsupportedDriver(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+		Spot:       true,
+	})
+	c.Assert(err, check.ErrorMatches, `spot instance is not supported by driver "fakedriver"`)
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params:     map[string]interface{}{},
+		SpotPrice:  "0.10",
+	})
+	c.Assert(err, check.ErrorMatches, "spot price requires spot instances")
+	c.Assert(fakeAPI.FakeStore, check.IsNil)
+}
+
+func (s *S) TestCreateMachineProgressCallback(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	var msgs []string
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+		ProgressCallback: func(msg string) {
+			msgs = append(msgs, msg)
+		},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(msgs, check.DeepEquals, []string{
+		"validating driver options",
+		"creating host, waiting for ssh and provisioning docker",
+		"machine created",
+	})
+}
+
+func (s *S) TestCreateMachineTags(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{
+		"amazonec2-access-key": "access-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-subnet-id":  "subnet-id",
+		"amazonec2-tags":       "env,prod",
+	}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params:     driverOpts,
+		Tags:       map[string]string{"team": "admin", "app": "myapp"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.ec2Driver.Tags, check.Equals, "env,prod,app,myapp,team,admin")
+}
+
+func (s *S) TestCreateMachineTagsIgnoredByOtherDrivers(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	driverOpts := map[string]interface{}{}
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     driverOpts,
+		Tags:       map[string]string{"team": "admin"},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(driverOpts, check.DeepEquals, map[string]interface{}{})
+}
+
+func (s *S) TestCreateMachineDryRun(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+		DryRun:     true,
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Base.Id, check.Equals, "my-machine")
+	c.Assert(m.Base.Status, check.Equals, MachineStatusDryRun)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineDryRunValidationError(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "amazonec2",
+		Params: map[string]interface{}{
+			"amazonec2-access-key": "access-key",
+			"amazonec2-secret-key": "secret-key",
+		},
+		DryRun: true,
+	})
+	c.Assert(err, check.ErrorMatches, "failed to configure driver: .*amazonec2-subnet-id.*")
+	c.Assert(fakeAPI.Hosts, check.HasLen, 0)
+	c.Assert(fakeAPI.ec2Driver, check.IsNil)
+}
+
+type memoryStore struct {
+	mu    sync.Mutex
+	hosts map[string]*host.Host
+}
+
+func (m *memoryStore) List() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *memoryStore) Save(h *host.Host) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hosts == nil {
+		m.hosts = map[string]*host.Host{}
+	}
+	m.hosts[h.Name] = h
+	return nil
+}
+
+func (m *memoryStore) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.hosts[name]; !ok {
+		return errors.Errorf("host %q not found", name)
+	}
+	delete(m.hosts, name)
+	return nil
+}
+
+func (m *memoryStore) Get(name string) (*host.Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.hosts[name]
+	if !ok {
+		return nil, errors.Errorf("host %q not found", name)
+	}
+	return h, nil
+}
+
+func (m *memoryStore) Exists(name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.hosts[name]
+	return ok, nil
+}
+
+func (s *S) TestDockerMachineCustomStore(c *check.C) {
+	store := &memoryStore{}
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{Store: store})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	names, err := store.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.DeepEquals, []string{"my-machine"})
+	machines, err := dm.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 1)
+	c.Assert(machines[0].Base.Id, check.Equals, "my-machine")
+	existing, err := dm.existingMachine("my-machine")
+	c.Assert(err, check.IsNil)
+	c.Assert(existing.Base.Id, check.Equals, "my-machine")
+	err = dm.DeleteMachine(context.Background(), m.Base, DeleteMachineOpts{})
+	c.Assert(err, check.IsNil)
+	names, err = store.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(names, check.HasLen, 0)
+	c.Assert(fakeAPI.removed, check.IsNil)
+}
+
+func (s *S) TestDeleteMachine(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(fakeAPI.Hosts), check.Equals, 1)
+	err = dm.DeleteMachine(context.Background(), m.Base, DeleteMachineOpts{})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(fakeAPI.Hosts), check.Equals, 0)
+}
+
+func (s *S) TestDeleteMachineContextCanceled(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	fakeAPI.removeWait = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err = dm.DeleteMachine(ctx, m.Base, DeleteMachineOpts{})
+	c.Assert(err, check.Equals, context.Canceled)
+	closeErrCh := make(chan error)
+	go func() {
+		closeErrCh <- dm.Close()
+	}()
+	select {
+	case <-closeErrCh:
+		c.Fatal("close returned with outstanding removal")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(fakeAPI.removeWait)
+	c.Assert(<-closeErrCh, check.IsNil)
+	c.Assert(fakeAPI.removed, check.DeepEquals, []string{"my-machine"})
+	c.Assert(fakeAPI.Hosts, check.HasLen, 0)
+}
+
+func (s *S) TestDeleteMachineForceNotFound(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 1)
+	fakeAPI.removeErr = errors.New("InvalidInstanceID.NotFound: The instance ID 'i-123' does not exist")
+	err = dm.DeleteMachine(context.Background(), m.Base, DeleteMachineOpts{})
+	c.Assert(err, check.ErrorMatches, "failed to remove host: InvalidInstanceID.NotFound.*")
+	c.Assert(fakeAPI.Hosts, check.HasLen, 1)
+	err = dm.DeleteMachine(context.Background(), m.Base, DeleteMachineOpts{Force: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 0)
+	c.Assert(fakeAPI.removed, check.DeepEquals, []string{"my-machine"})
+}
+
+func (s *S) TestDeleteMachineForceOtherError(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	fakeAPI.removeErr = errors.New("UnauthorizedOperation")
+	err = dm.DeleteMachine(context.Background(), m.Base, DeleteMachineOpts{Force: true})
+	c.Assert(err, check.ErrorMatches, "failed to remove host: UnauthorizedOperation")
+	c.Assert(fakeAPI.Hosts, check.HasLen, 1)
+}
+
+func (s *S) TestDeleteMachines(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	var machines []*iaas.Machine
+	for _, name := range []string{"m1", "m2", "m3"} {
+		m, errCreate := dm.CreateMachine(context.Background(), CreateMachineOpts{
+			Name:       name,
+			DriverName: "fakedriver",
+			Params:     map[string]interface{}{},
+		})
+		c.Assert(errCreate, check.IsNil)
+		machines = append(machines, m.Base)
+	}
+	c.Assert(fakeAPI.Hosts, check.HasLen, 3)
+	fakeAPI.removeErrs = map[string]error{"m2": errors.New("UnauthorizedOperation")}
+	err = dm.DeleteMachines(context.Background(), machines, DeleteMachineOpts{})
+	c.Assert(err, check.ErrorMatches, `failed to delete machine "m2": failed to remove host: UnauthorizedOperation`)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 1)
+	c.Assert(fakeAPI.Hosts[0].Name, check.Equals, "m2")
+	sort.Strings(fakeAPI.removed)
+	c.Assert(fakeAPI.removed, check.DeepEquals, []string{"m1", "m3"})
+}
+
+func (s *S) TestDeleteMachinesDryRun(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	var machines []*iaas.Machine
+	for _, name := range []string{"m1", "m2"} {
+		m, errCreate := dm.CreateMachine(context.Background(), CreateMachineOpts{
+			Name:       name,
+			DriverName: "fakedriver",
+			Params:     map[string]interface{}{},
+		})
+		c.Assert(errCreate, check.IsNil)
+		machines = append(machines, m.Base)
+	}
+	machines = append(machines, &iaas.Machine{
+		Id:             "m3",
+		CreationParams: map[string]string{"driver": "fakedriver"},
+		CustomData:     map[string]interface{}{"MockName": "m3"},
+	})
+	fakeAPI.stateErrs = map[string]error{"m2": errors.New("InvalidInstanceID.NotFound: The instance ID 'i-123' does not exist")}
+	var mu sync.Mutex
+	var targets []DeleteTarget
+	err = dm.DeleteMachines(context.Background(), machines, DeleteMachineOpts{
+		DryRun: true,
+		DryRunCallback: func(target DeleteTarget) {
+			mu.Lock()
+			defer mu.Unlock()
+			targets = append(targets, target)
+		},
+	})
+	c.Assert(err, check.IsNil)
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	c.Assert(targets, check.DeepEquals, []DeleteTarget{
+		{Name: "m1", Driver: "fakedriver", Stored: true},
+		{Name: "m2", Driver: "fakedriver", Gone: true, Stored: true},
+		{Name: "m3", Driver: "fakedriver"},
+	})
+	c.Assert(fakeAPI.Hosts, check.HasLen, 2)
+	c.Assert(fakeAPI.removed, check.IsNil)
+	fakeAPI.stateErrs = map[string]error{"m1": errors.New("UnauthorizedOperation")}
+	err = dm.DeleteMachine(context.Background(), machines[0], DeleteMachineOpts{DryRun: true})
+	c.Assert(err, check.ErrorMatches, "failed to get host state: UnauthorizedOperation")
+	c.Assert(fakeAPI.Hosts, check.HasLen, 2)
+}
+
+func (s *S) TestValidateCredentials(c *check.C) {
+	defer func(old func(map[string]interface{}) error) { credentialsValidators["amazonec2"] = old }(credentialsValidators["amazonec2"])
+	var driverData map[string]interface{}
+	credentialsValidators["amazonec2"] = func(data map[string]interface{}) error {
+		driverData = data
+		if data["AccessKey"] != "valid-key" {
+			return errors.New("AuthFailure: AWS was not able to validate the provided access credentials")
+		}
+		return nil
+	}
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	params := map[string]interface{}{
+		"amazonec2-access-key": "invalid-key",
+		"amazonec2-secret-key": "secret-key",
+		"amazonec2-region":     "us-east-1",
+		"amazonec2-subnet-id":  "subnet-id",
+	}
+	err = dm.ValidateCredentials("amazonec2", params)
+	c.Assert(err, check.ErrorMatches, "invalid credentials: AuthFailure: .*")
+	c.Assert(driverData["SecretKey"], check.Equals, "secret-key")
+	c.Assert(driverData["Region"], check.Equals, "us-east-1")
+	c.Assert(params, check.HasLen, 4)
+	params["amazonec2-access-key"] = "valid-key"
+	err = dm.ValidateCredentials("amazonec2", params)
+	c.Assert(err, check.IsNil)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 0)
+}
+
+func (s *S) TestValidateCredentialsUnsupportedDriver(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	err = dm.ValidateCredentials("fakedriver", map[string]interface{}{})
+	c.Assert(err, check.ErrorMatches, `credentials validation is not supported by driver "fakedriver"`)
+}
+
+func (s *S) TestValidateEC2Credentials(c *check.C) {
+	var called bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		r.ParseForm()
+		c.Check(r.Form.Get("Action"), check.Equals, "DescribeRegions")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`<Response><Errors><Error><Code>AuthFailure</Code><Message>invalid credentials</Message></Error></Errors></Response>`))
+	}))
+	defer srv.Close()
+	err := validateEC2Credentials(map[string]interface{}{
+		"AccessKey": "access-key",
+		"SecretKey": "secret-key",
+		"Region":    "us-east-1",
+		"Endpoint":  srv.URL,
+	})
+	c.Assert(err, check.ErrorMatches, "(?s)AuthFailure: invalid credentials.*")
+	c.Assert(called, check.Equals, true)
+}
+
+func (s *S) TestAttachEC2Volumes(c *check.C) {
+	var mu sync.Mutex
+	var calls []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		calls = append(calls, r.Form)
+		n := len(calls)
+		mu.Unlock()
+		switch r.Form.Get("Action") {
+		case "CreateVolume":
+			fmt.Fprintf(w, `<CreateVolumeResponse><volumeId>vol-%d</volumeId><status>creating</status></CreateVolumeResponse>`, n)
+		case "DescribeVolumes":
+			fmt.Fprintf(w, `<DescribeVolumesResponse><volumeSet><item><volumeId>%s</volumeId><status>available</status></item></volumeSet></DescribeVolumesResponse>`, r.Form.Get("VolumeId.1"))
+		case "AttachVolume":
+			fmt.Fprintf(w, `<AttachVolumeResponse><volumeId>%s</volumeId><status>attaching</status></AttachVolumeResponse>`, r.Form.Get("VolumeId"))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	err := attachEC2Volumes(map[string]interface{}{
+		"AccessKey":  "access-key",
+		"SecretKey":  "secret-key",
+		"Region":     "us-east-1",
+		"Zone":       "c",
+		"Endpoint":   srv.URL,
+		"InstanceId": "i-1234",
+	}, []VolumeSpec{
+		{SizeGB: 100, Type: "io1", DeviceName: "/dev/sdf"},
+		{SizeGB: 20, DeviceName: "/dev/sdg"},
+	})
+	c.Assert(err, check.IsNil)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(calls, check.HasLen, 6)
+	get := func(i int, keys ...string) []string {
+		values := make([]string, len(keys))
+		for j, k := range keys {
+			values[j] = calls[i].Get(k)
+		}
+		return values
+	}
+	createKeys := []string{"Action", "AvailabilityZone", "Size", "VolumeType"}
+	c.Assert(get(0, createKeys...), check.DeepEquals, []string{"CreateVolume", "us-east-1c", "100", "io1"})
+	c.Assert(get(1, "Action", "VolumeId.1"), check.DeepEquals, []string{"DescribeVolumes", "vol-1"})
+	attachKeys := []string{"Action", "Device", "InstanceId", "VolumeId"}
+	c.Assert(get(2, attachKeys...), check.DeepEquals, []string{"AttachVolume", "/dev/sdf", "i-1234", "vol-1"})
+	c.Assert(get(3, createKeys...), check.DeepEquals, []string{"CreateVolume", "us-east-1c", "20", ""})
+	c.Assert(get(5, attachKeys...), check.DeepEquals, []string{"AttachVolume", "/dev/sdg", "i-1234", "vol-4"})
+}
+
+func (s *S) TestEC2SubnetZone(c *check.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		c.Check(r.Form.Get("Action"), check.Equals, "DescribeSubnets")
+		c.Check(r.Form.Get("SubnetId.1"), check.Equals, "subnet-1")
+		w.Write([]byte(`<DescribeSubnetsResponse><subnetSet><item><subnetId>subnet-1</subnetId><availabilityZone>us-east-1d</availabilityZone></item></subnetSet></DescribeSubnetsResponse>`))
+	}))
+	defer srv.Close()
+	data := map[string]interface{}{
+		"AccessKey": "access-key",
+		"SecretKey": "secret-key",
+		"Region":    "us-east-1",
+		"Endpoint":  srv.URL,
+		"SubnetId":  "subnet-1",
+	}
+	zone, err := ec2SubnetZone(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(zone, check.Equals, "us-east-1d")
+	delete(data, "SubnetId")
+	zone, err = ec2SubnetZone(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(zone, check.Equals, "")
+}
+
+func (s *S) TestScaleMachine(c *check.C) {
+	instanceTypeFields["fakedriver"] = "InstanceType"
+	defer delete(instanceTypeFields, "fakedriver")
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "scale")
+	var resizedData map[string]interface{}
+	var resizedType string
+	instanceResizers["fakedriver"] = func(resizeCtx context.Context, data map[string]interface{}, instanceType string) error {
+		c.Check(resizeCtx.Value(ctxKey{}), check.Equals, "scale")
+		log.Info("resizing instance")
+		resizedData, resizedType = data, instanceType
+		return nil
+	}
+	defer delete(instanceResizers, "fakedriver")
+	fakeAPI := &fakeLibMachineAPI{}
+	outBuf := &bytes.Buffer{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{OutWriter: outBuf})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	m.Base.CreationParams = map[string]string{"driver": "fakedriver"}
+	err = dm.ScaleMachine(ctx, m.Base, ScaleMachineOpts{InstanceType: "t3.large"})
+	c.Assert(err, check.IsNil)
+	c.Assert(outBuf.String(), check.Matches, `(?s).*resizing instance\n$`)
+	c.Assert(resizedType, check.Equals, "t3.large")
+	c.Assert(resizedData["MockIP"], check.Equals, "192.168.10.3")
+	c.Assert(m.Base.CustomData["InstanceType"], check.Equals, "t3.large")
+	c.Assert(m.Base.CustomData["MockState"], check.Equals, float64(state.Running))
+	c.Assert(fakeAPI.Hosts, check.HasLen, 2)
+	c.Assert(fakeAPI.Hosts[1].Name, check.Equals, "my-machine")
+}
+
+func (s *S) TestScaleMachineResizeFailure(c *check.C) {
+	instanceTypeFields["fakedriver"] = "InstanceType"
+	defer delete(instanceTypeFields, "fakedriver")
+	instanceResizers["fakedriver"] = func(ctx context.Context, data map[string]interface{}, instanceType string) error {
+		return errors.New("unsupported instance type")
+	}
+	defer delete(instanceResizers, "fakedriver")
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	m.Base.CreationParams = map[string]string{"driver": "fakedriver"}
+	err = dm.ScaleMachine(context.Background(), m.Base, ScaleMachineOpts{InstanceType: "t3.large"})
+	c.Assert(err, check.ErrorMatches, "failed to resize host: unsupported instance type")
+	c.Assert(m.Base.CustomData["InstanceType"], check.IsNil)
+	c.Assert(fakeAPI.Hosts, check.HasLen, 1)
+}
+
+func (s *S) TestResizeEC2Instance(c *check.C) {
+	var mu sync.Mutex
+	var calls []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		calls = append(calls, r.Form)
+		mu.Unlock()
+		switch r.Form.Get("Action") {
+		case "StopInstances":
+			w.Write([]byte(`<StopInstancesResponse><instancesSet><item><instanceId>i-1234</instanceId></item></instancesSet></StopInstancesResponse>`))
+		case "DescribeInstances":
+			w.Write([]byte(`<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1234</instanceId><instanceState><code>80</code><name>stopped</name></instanceState></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`))
+		case "ModifyInstanceAttribute":
+			w.Write([]byte(`<ModifyInstanceAttributeResponse><return>true</return></ModifyInstanceAttributeResponse>`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	driverData := map[string]interface{}{
+		"AccessKey":  "access-key",
+		"SecretKey":  "secret-key",
+		"Region":     "us-east-1",
+		"Endpoint":   srv.URL,
+		"InstanceId": "i-1234",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := resizeEC2Instance(ctx, driverData, "t3.large")
+	c.Assert(err, check.ErrorMatches, `(?s)failed to stop instance i-1234: RequestCanceled: .*`)
+	err = resizeEC2Instance(context.Background(), driverData, "t3.large")
+	c.Assert(err, check.IsNil)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(calls, check.HasLen, 3)
+	c.Assert(calls[0].Get("Action"), check.Equals, "StopInstances")
+	c.Assert(calls[0].Get("InstanceId.1"), check.Equals, "i-1234")
+	c.Assert(calls[1].Get("Action"), check.Equals, "DescribeInstances")
+	c.Assert(calls[1].Get("InstanceId.1"), check.Equals, "i-1234")
+	c.Assert(calls[2].Get("Action"), check.Equals, "ModifyInstanceAttribute")
+	c.Assert(calls[2].Get("InstanceId"), check.Equals, "i-1234")
+	c.Assert(calls[2].Get("InstanceType.Value"), check.Equals, "t3.large")
+}
+
+func (s *S) TestScaleMachineUnsupportedDriver(c *check.C) {
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	m := &iaas.Machine{Id: "my-machine", CreationParams: map[string]string{"driver": "generic"}}
+	err = dmAPI.ScaleMachine(context.Background(), m, ScaleMachineOpts{InstanceType: "t3.large"})
+	c.Assert(err, check.ErrorMatches, `scale is not supported by driver "generic"`)
+}
+
+func (s *S) TestRefreshMachine(c *check.C) {
+	fakeAPI := &fakeLibMachineAPI{}
+	dmAPI, err := NewDockerMachine(DockerMachineConfig{})
+	c.Assert(err, check.IsNil)
+	defer dmAPI.Close()
+	dm := dmAPI.(*DockerMachine)
+	dm.client = fakeAPI
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
+		Name:       "my-machine",
+		DriverName: "fakedriver",
+		Params:     map[string]interface{}{},
+	})
+	c.Assert(err, check.IsNil)
+	err = m.Host.Driver.Stop()
+	c.Assert(err, check.IsNil)
+	refreshed, err := dm.RefreshMachine(m.Base)
+	c.Assert(err, check.IsNil)
+	c.Assert(refreshed.Base.Id, check.Equals, "my-machine")
+	c.Assert(refreshed.Base.Status, check.Equals, state.Stopped.String())
+	c.Assert(refreshed.Base.Address, check.Equals, "192.168.10.3")
+	c.Assert(refreshed.Base.CustomData["MockState"], check.Equals, float64(state.Stopped))
+	c.Assert(m.Base.Status, check.Equals, "")
+	m.Host.Driver.(*fakedriver.Driver).MockIP = "192.168.10.4"
+	err = m.Host.Driver.Start()
+	c.Assert(err, check.IsNil)
+	refreshed, err = dm.RefreshMachine(m.Base)
+	c.Assert(err, check.IsNil)
+	c.Assert(refreshed.Base.Status, check.Equals, state.Running.String())
+	c.Assert(refreshed.Base.Address, check.Equals, "192.168.10.4")
 }
 
 func (s *S) TestConfigureDriver(c *check.C) {
@@ -177,13 +1787,13 @@ func (s *S) TestDeleteAll(c *check.C) {
 	defer dmAPI.Close()
 	dm := dmAPI.(*DockerMachine)
 	dm.client = fakeAPI
-	_, err = dm.CreateMachine(CreateMachineOpts{
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
 		Name:       "my-machine",
 		DriverName: "fakedriver",
 		Params:     map[string]interface{}{},
 	})
 	c.Assert(err, check.IsNil)
-	_, err = dm.CreateMachine(CreateMachineOpts{
+	_, err = dm.CreateMachine(context.Background(), CreateMachineOpts{
 		Name:       "my-machine-2",
 		DriverName: "fakedriver",
 		Params:     map[string]interface{}{},
@@ -236,7 +1846,7 @@ func (s *S) TestList(c *check.C) {
 	defer dmAPI.Close()
 	dm := dmAPI.(*DockerMachine)
 	dm.client = fakeAPI
-	m, err := dm.CreateMachine(CreateMachineOpts{
+	m, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
 		Name:                   "my-machine-1",
 		DriverName:             "fakedriver",
 		InsecureRegistry:       "registry.com",
@@ -244,7 +1854,7 @@ func (s *S) TestList(c *check.C) {
 		RegistryMirror:         "http://registry-mirror.com",
 	})
 	c.Assert(err, check.IsNil)
-	m2, err := dm.CreateMachine(CreateMachineOpts{
+	m2, err := dm.CreateMachine(context.Background(), CreateMachineOpts{
 		Name:                   "my-machine-2",
 		DriverName:             "fakedriver",
 		InsecureRegistry:       "registry.com",
@@ -254,5 +1864,7 @@ func (s *S) TestList(c *check.C) {
 	c.Assert(err, check.IsNil)
 	machines, err := dm.List()
 	c.Assert(err, check.IsNil)
+	// the provision duration is only known by CreateMachine
+	m.ProvisionDuration, m2.ProvisionDuration = 0, 0
 	c.Assert(machines, check.DeepEquals, []*Machine{m, m2})
 }
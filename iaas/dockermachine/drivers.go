@@ -5,7 +5,15 @@
 package dockermachine
 
 import (
+	"context"
+	"os/exec"
+	"strings"
+
 	cloudstack "github.com/andrestc/docker-machine-driver-cloudstack"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/docker/machine/drivers/amazonec2"
 	"github.com/docker/machine/drivers/azure"
 	"github.com/docker/machine/drivers/digitalocean"
@@ -26,10 +34,284 @@ import (
 	"github.com/pkg/errors"
 )
 
+// instanceTypeFields maps the drivers supporting ScaleMachine to the name of
+// the driver field holding the instance type.
+var instanceTypeFields = map[string]string{
+	"amazonec2": "InstanceType",
+}
+
+// instanceResizers maps the drivers in instanceTypeFields to a function
+// stopping the machine described by the driver data and changing its
+// instance type with the provider. The machine is left stopped.
+var instanceResizers = map[string]func(ctx context.Context, driverData map[string]interface{}, instanceType string) error{
+	"amazonec2": resizeEC2Instance,
+}
+
+// userDataFileParams maps the drivers supporting user data to the name of the
+// driver option holding the path of the user data file.
+var userDataFileParams = map[string]string{
+	"amazonec2":    "amazonec2-userdata",
+	"cloudstack":   "cloudstack-userdata-file",
+	"digitalocean": "digitalocean-userdata",
+	"exoscale":     "exoscale-userdata",
+	"openstack":    "openstack-user-data-file",
+}
+
+// sshKeyPathParams maps the drivers supporting existing ssh keys to the name
+// of the driver option holding the private key path.
+var sshKeyPathParams = map[string]string{
+	"amazonec2":    "amazonec2-ssh-keypath",
+	"digitalocean": "digitalocean-ssh-key-path",
+	"exoscale":     "exoscale-ssh-key",
+	"generic":      "generic-ssh-key",
+	"openstack":    "openstack-private-key-file",
+}
+
+// sshKeyNameParams maps the drivers supporting existing key pairs to the name
+// of the driver option holding the key pair name.
+var sshKeyNameParams = map[string]string{
+	"amazonec2": "amazonec2-keypair-name",
+	"openstack": "openstack-keypair-name",
+}
+
+// iamInstanceProfileParams maps the drivers supporting IAM instance profiles
+// to the name of the driver option holding the profile name.
+var iamInstanceProfileParams = map[string]string{
+	"amazonec2": "amazonec2-iam-instance-profile",
+}
+
+// spotInstanceParams maps the drivers supporting spot instances to the name of
+// the driver option requesting them.
+var spotInstanceParams = map[string]string{
+	"amazonec2": "amazonec2-request-spot-instance",
+}
+
+// spotPriceParams maps the drivers supporting spot instances to the name of
+// the driver option holding the spot bid price.
+var spotPriceParams = map[string]string{
+	"amazonec2": "amazonec2-spot-price",
+}
+
+// rootVolumeSizeParams maps the drivers supporting custom root volumes to the
+// name of the driver option holding the volume size in GB.
+var rootVolumeSizeParams = map[string]string{
+	"amazonec2": "amazonec2-root-size",
+}
+
+// rootVolumeTypeParams maps the drivers supporting custom root volumes to the
+// name of the driver option holding the volume type.
+var rootVolumeTypeParams = map[string]string{
+	"amazonec2": "amazonec2-volume-type",
+}
+
+// securityGroupIDFields maps the drivers supporting existing security groups
+// referenced by ID to the name of the driver field holding the IDs. The
+// drivers have no option for the IDs, the field is set directly in the driver
+// configuration.
+var securityGroupIDFields = map[string]string{
+	"amazonec2": "SecurityGroupIds",
+}
+
+// securityGroupNameParams maps the drivers in securityGroupIDFields to the
+// name of the driver option holding security group names, which is cleared
+// when IDs are used so that no group is looked up or created by name.
+var securityGroupNameParams = map[string]string{
+	"amazonec2": "amazonec2-security-group",
+}
+
+// subnetParams maps the drivers supporting subnet selection to the name of
+// the driver option holding the subnet ID.
+var subnetParams = map[string]string{
+	"amazonec2": "amazonec2-subnet-id",
+}
+
+// regionParams maps the drivers supporting availability zones to the name of
+// the driver option holding the region.
+var regionParams = map[string]string{
+	"amazonec2": "amazonec2-region",
+}
+
+// zoneParams maps the drivers in regionParams to the name of the driver
+// option holding the zone letter within the region.
+var zoneParams = map[string]string{
+	"amazonec2": "amazonec2-zone",
+}
+
+// subnetZoneLookups maps the drivers in regionParams to a function
+// returning the availability zone of the subnet set in the driver data, or
+// an empty string if no subnet is set.
+var subnetZoneLookups = map[string]func(driverData map[string]interface{}) (string, error){
+	"amazonec2": ec2SubnetZone,
+}
+
+// privateIPFields maps the drivers exposing the machine private IP to the name
+// of the driver field holding it.
+var privateIPFields = map[string]string{
+	"amazonec2": "PrivateIPAddress",
+}
+
+// credentialsValidators maps the drivers supporting credentials validation to
+// a function performing a cheap authenticated call with the driver data.
+var credentialsValidators = map[string]func(driverData map[string]interface{}) error{
+	"amazonec2": validateEC2Credentials,
+}
+
+// volumeAttachers maps the drivers supporting extra volumes to a function
+// creating the volumes and attaching them to the created machine, described
+// by the driver data.
+var volumeAttachers = map[string]func(driverData map[string]interface{}, volumes []VolumeSpec) error{
+	"amazonec2": attachEC2Volumes,
+}
+
+func driverDataString(driverData map[string]interface{}, key string) string {
+	v, _ := driverData[key].(string)
+	return v
+}
+
+func ec2ClientFromDriverData(driverData map[string]interface{}) (*ec2.EC2, error) {
+	str := func(key string) string {
+		return driverDataString(driverData, key)
+	}
+	config := aws.NewConfig().WithRegion(str("Region"))
+	if accessKey := str("AccessKey"); accessKey != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(accessKey, str("SecretKey"), str("SessionToken")))
+	}
+	if endpoint := str("Endpoint"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return ec2.New(sess), nil
+}
+
+func validateEC2Credentials(driverData map[string]interface{}) error {
+	client, err := ec2ClientFromDriverData(driverData)
+	if err != nil {
+		return err
+	}
+	_, err = client.DescribeRegions(&ec2.DescribeRegionsInput{})
+	return err
+}
+
+func ec2SubnetZone(driverData map[string]interface{}) (string, error) {
+	subnetID := driverDataString(driverData, "SubnetId")
+	if subnetID == "" {
+		return "", nil
+	}
+	client, err := ec2ClientFromDriverData(driverData)
+	if err != nil {
+		return "", err
+	}
+	out, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{aws.String(subnetID)},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(out.Subnets) == 0 {
+		return "", errors.Errorf("subnet %q not found", subnetID)
+	}
+	return aws.StringValue(out.Subnets[0].AvailabilityZone), nil
+}
+
+// attachEC2Volumes creates EBS volumes in the availability zone of the
+// instance and attaches them to it, waiting for each volume to be available
+// before attaching it.
+func attachEC2Volumes(driverData map[string]interface{}, volumes []VolumeSpec) error {
+	client, err := ec2ClientFromDriverData(driverData)
+	if err != nil {
+		return err
+	}
+	instanceID := driverDataString(driverData, "InstanceId")
+	zone := driverDataString(driverData, "Region") + driverDataString(driverData, "Zone")
+	for _, volume := range volumes {
+		input := &ec2.CreateVolumeInput{
+			AvailabilityZone: aws.String(zone),
+			Size:             aws.Int64(int64(volume.SizeGB)),
+		}
+		if volume.Type != "" {
+			input.VolumeType = aws.String(volume.Type)
+		}
+		created, err := client.CreateVolume(input)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create volume for device %s", volume.DeviceName)
+		}
+		err = client.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{
+			VolumeIds: []*string{created.VolumeId},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed waiting for volume %s", aws.StringValue(created.VolumeId))
+		}
+		_, err = client.AttachVolume(&ec2.AttachVolumeInput{
+			Device:     aws.String(volume.DeviceName),
+			InstanceId: aws.String(instanceID),
+			VolumeId:   created.VolumeId,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to attach volume %s to %s", aws.StringValue(created.VolumeId), volume.DeviceName)
+		}
+	}
+	return nil
+}
+
+// resizeEC2Instance stops the instance, waiting for it to be stopped, and
+// changes its instance type, which EC2 only allows on stopped instances.
+func resizeEC2Instance(ctx context.Context, driverData map[string]interface{}, instanceType string) error {
+	client, err := ec2ClientFromDriverData(driverData)
+	if err != nil {
+		return err
+	}
+	instanceID := aws.String(driverDataString(driverData, "InstanceId"))
+	_, err = client.StopInstancesWithContext(ctx, &ec2.StopInstancesInput{
+		InstanceIds: []*string{instanceID},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to stop instance %s", aws.StringValue(instanceID))
+	}
+	err = client.WaitUntilInstanceStoppedWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{instanceID},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed waiting for instance %s to stop", aws.StringValue(instanceID))
+	}
+	_, err = client.ModifyInstanceAttributeWithContext(ctx, &ec2.ModifyInstanceAttributeInput{
+		InstanceId:   instanceID,
+		InstanceType: &ec2.AttributeValue{Value: aws.String(instanceType)},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to change type of instance %s", aws.StringValue(instanceID))
+	}
+	return nil
+}
+
 func init() {
 	localbinary.CoreDrivers = append(localbinary.CoreDrivers, "cloudstack")
 }
 
+// isDriverAvailable reports whether driverName is one of the core drivers or
+// an external driver plugin available on PATH.
+var isDriverAvailable = func(driverName string) bool {
+	for _, d := range localbinary.CoreDrivers {
+		if d == driverName {
+			return true
+		}
+	}
+	_, err := exec.LookPath("docker-machine-driver-" + driverName)
+	return err == nil
+}
+
+func validateDriver(driverName string) error {
+	if driverName == "" {
+		return errDriverNotSet
+	}
+	if !isDriverAvailable(driverName) {
+		return errors.Errorf("unknown driver %q: must be one of %s or have a docker-machine-driver-%s binary in PATH", driverName, strings.Join(localbinary.CoreDrivers, ", "), driverName)
+	}
+	return nil
+}
+
 func RunDriver(driverName string) error {
 	switch driverName {
 	case "amazonec2":
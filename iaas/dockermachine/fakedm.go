@@ -5,23 +5,32 @@
 package dockermachine
 
 import (
+	"context"
 	"errors"
 
 	"github.com/tsuru/tsuru/iaas"
 )
 
 type FakeDockerMachine struct {
-	deletedMachine *iaas.Machine
-	createdMachine *Machine
-	config         *DockerMachineConfig
-	hostOpts       *CreateMachineOpts
-	closed         bool
+	deletedMachine  *iaas.Machine
+	deletedMachines []*iaas.Machine
+	scaledMachine   *iaas.Machine
+	scaleOpts       *ScaleMachineOpts
+	machineStates   map[string]string
+	createdMachine  *Machine
+	config          *DockerMachineConfig
+	hostOpts        *CreateMachineOpts
+	closed          bool
 }
 
 var FakeDM = &FakeDockerMachine{}
 
 func NewFakeDockerMachine(c DockerMachineConfig) (DockerMachineAPI, error) {
 	FakeDM.deletedMachine = nil
+	FakeDM.deletedMachines = nil
+	FakeDM.scaledMachine = nil
+	FakeDM.scaleOpts = nil
+	FakeDM.machineStates = nil
 	FakeDM.createdMachine = nil
 	FakeDM.config = &c
 	FakeDM.closed = false
@@ -33,7 +42,10 @@ func (f *FakeDockerMachine) Close() error {
 	return nil
 }
 
-func (f *FakeDockerMachine) CreateMachine(opts CreateMachineOpts) (*Machine, error) {
+func (f *FakeDockerMachine) CreateMachine(ctx context.Context, opts CreateMachineOpts) (*Machine, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	f.createdMachine = &Machine{
 		Base: &iaas.Machine{
 			Id: opts.Name,
@@ -47,11 +59,45 @@ func (f *FakeDockerMachine) CreateMachine(opts CreateMachineOpts) (*Machine, err
 	return f.createdMachine, errCreate
 }
 
-func (f *FakeDockerMachine) DeleteMachine(m *iaas.Machine) error {
+func (f *FakeDockerMachine) DeleteMachine(ctx context.Context, m *iaas.Machine, opts DeleteMachineOpts) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if opts.DryRun {
+		if opts.DryRunCallback != nil {
+			opts.DryRunCallback(DeleteTarget{Name: m.Id, Driver: m.CreationParams["driver"], Stored: true})
+		}
+		return nil
+	}
 	f.deletedMachine = m
+	f.deletedMachines = append(f.deletedMachines, m)
 	return nil
 }
 
+func (f *FakeDockerMachine) DeleteMachines(ctx context.Context, ms []*iaas.Machine, opts DeleteMachineOpts) error {
+	for _, m := range ms {
+		err := f.DeleteMachine(ctx, m, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FakeDockerMachine) ScaleMachine(ctx context.Context, m *iaas.Machine, opts ScaleMachineOpts) error {
+	f.scaledMachine = m
+	f.scaleOpts = &opts
+	return nil
+}
+
+func (f *FakeDockerMachine) RefreshMachine(m *iaas.Machine) (*Machine, error) {
+	base := *m
+	if st, ok := f.machineStates[m.Id]; ok {
+		base.Status = st
+	}
+	return &Machine{Base: &base}, nil
+}
+
 func (f *FakeDockerMachine) DeleteAll() error {
 	return nil
 }
@@ -63,3 +109,10 @@ func (f *FakeDockerMachine) RegisterMachine(opts RegisterMachineOpts) (*Machine,
 func (f *FakeDockerMachine) List() ([]*Machine, error) {
 	return nil, nil
 }
+
+func (f *FakeDockerMachine) ValidateCredentials(driverName string, params map[string]interface{}) error {
+	if v, ok := params["error"]; ok {
+		return errors.New(v.(string))
+	}
+	return nil
+}
@@ -5,6 +5,7 @@
 package dockermachine
 
 import (
+	"context"
 	"errors"
 
 	"github.com/tsuru/tsuru/iaas"
@@ -19,15 +20,44 @@ func (s *S) TestCloseFake(c *check.C) {
 	c.Assert(dm.closed, check.Equals, true)
 }
 
+func (s *S) TestCreateMachineFakeContextCanceled(c *check.C) {
+	d, _ := NewFakeDockerMachine(DockerMachineConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m, err := d.CreateMachine(ctx, CreateMachineOpts{Name: "my-machine"})
+	c.Assert(err, check.Equals, context.Canceled)
+	c.Assert(m, check.IsNil)
+}
+
 func (s *S) TestDeleteMachineFake(c *check.C) {
 	d, _ := NewFakeDockerMachine(DockerMachineConfig{})
 	dm := d.(*FakeDockerMachine)
 	m := &iaas.Machine{Id: "my-machine"}
-	err := dm.DeleteMachine(m)
+	err := dm.DeleteMachine(context.Background(), m, DeleteMachineOpts{})
 	c.Assert(err, check.IsNil)
 	c.Assert(dm.deletedMachine, check.DeepEquals, m)
 }
 
+func (s *S) TestDeleteMachinesFake(c *check.C) {
+	d, _ := NewFakeDockerMachine(DockerMachineConfig{})
+	dm := d.(*FakeDockerMachine)
+	ms := []*iaas.Machine{{Id: "m1"}, {Id: "m2"}}
+	err := dm.DeleteMachines(context.Background(), ms, DeleteMachineOpts{})
+	c.Assert(err, check.IsNil)
+	c.Assert(dm.deletedMachines, check.DeepEquals, ms)
+}
+
+func (s *S) TestRefreshMachineFake(c *check.C) {
+	d, _ := NewFakeDockerMachine(DockerMachineConfig{})
+	dm := d.(*FakeDockerMachine)
+	dm.machineStates = map[string]string{"my-machine": "Stopped"}
+	m := &iaas.Machine{Id: "my-machine", Status: "Running"}
+	refreshed, err := dm.RefreshMachine(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(refreshed.Base.Status, check.Equals, "Stopped")
+	c.Assert(m.Status, check.Equals, "Running")
+}
+
 func (s *S) TestCreateMachineFake(c *check.C) {
 	d, _ := NewFakeDockerMachine(DockerMachineConfig{})
 	opts := CreateMachineOpts{
@@ -36,7 +66,7 @@ func (s *S) TestCreateMachineFake(c *check.C) {
 			"error": "failed",
 		},
 	}
-	m, err := d.CreateMachine(opts)
+	m, err := d.CreateMachine(context.Background(), opts)
 	c.Assert(err, check.DeepEquals, errors.New("failed"))
 	c.Assert(m.Base.Id, check.Equals, "my-machine")
 }
@@ -44,10 +74,18 @@ func (s *S) TestCreateMachineFake(c *check.C) {
 func (s *S) TestCreateMachineErrorFake(c *check.C) {
 	d, _ := NewFakeDockerMachine(DockerMachineConfig{})
 	opts := CreateMachineOpts{Name: "my-machine"}
-	m, err := d.CreateMachine(opts)
+	m, err := d.CreateMachine(context.Background(), opts)
 	c.Assert(err, check.IsNil)
 	c.Assert(m.Base.Id, check.Equals, "my-machine")
 	dm := d.(*FakeDockerMachine)
 	c.Assert(dm.createdMachine, check.DeepEquals, m)
 	c.Assert(dm.hostOpts, check.DeepEquals, &opts)
 }
+
+func (s *S) TestValidateCredentialsFake(c *check.C) {
+	d, _ := NewFakeDockerMachine(DockerMachineConfig{})
+	err := d.ValidateCredentials("amazonec2", map[string]interface{}{})
+	c.Assert(err, check.IsNil)
+	err = d.ValidateCredentials("amazonec2", map[string]interface{}{"error": "invalid credentials"})
+	c.Assert(err, check.ErrorMatches, "invalid credentials")
+}
@@ -6,6 +6,7 @@ package dockermachine
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base32"
 	"fmt"
@@ -123,7 +124,7 @@ func (i *dockerMachineIaaS) CreateMachine(params map[string]string) (*iaas.Machi
 		dockerMachine.Close()
 		log.Debug(buf.String())
 	}()
-	m, err := dockerMachine.CreateMachine(CreateMachineOpts{
+	m, err := dockerMachine.CreateMachine(context.Background(), CreateMachineOpts{
 		Name:                      machineName,
 		DriverName:                driverName,
 		Params:                    driverOpts,
@@ -134,7 +135,7 @@ func (i *dockerMachineIaaS) CreateMachine(params map[string]string) (*iaas.Machi
 	})
 	if err != nil {
 		if m != nil {
-			errRem := dockerMachine.DeleteMachine(m.Base)
+			errRem := dockerMachine.DeleteMachine(context.Background(), m.Base, DeleteMachineOpts{})
 			if errRem != nil {
 				err = tsuruErrors.NewMultiError(err, errors.WithMessage(errRem, "failed to remove machine after error"))
 			}
@@ -184,7 +185,7 @@ func (i *dockerMachineIaaS) DeleteMachine(m *iaas.Machine) error {
 		dockerMachine.Close()
 		log.Debug(buf.String())
 	}()
-	return dockerMachine.DeleteMachine(m)
+	return dockerMachine.DeleteMachine(context.Background(), m, DeleteMachineOpts{})
 }
 
 func generateMachineName(prefix string) (string, error) {
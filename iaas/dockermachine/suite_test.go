@@ -6,8 +6,10 @@ package dockermachine
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/docker/machine/drivers/amazonec2"
@@ -16,6 +18,7 @@ import (
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/engine"
 	"github.com/docker/machine/libmachine/host"
+	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/persist/persisttest"
 	"github.com/docker/machine/libmachine/state"
 	check "gopkg.in/check.v1"
@@ -27,15 +30,33 @@ type S struct{}
 
 var _ = check.Suite(&S{})
 
+func (s *S) SetUpSuite(c *check.C) {
+	isDriverAvailable = func(driverName string) bool {
+		return driverName == "amazonec2" || driverName == "fakedriver"
+	}
+}
+
 type fakeLibMachineAPI struct {
 	*persisttest.FakeStore
 	driverName string
 	ec2Driver  *amazonec2.Driver
+	userData   string
+	createWait chan struct{}
+	createCh   chan struct{}
+	privateIP  string
+	removed    []string
+	removeWait chan struct{}
+	removeErr  error
+	removeErrs map[string]error
+	stateErrs  map[string]error
+	mu         sync.Mutex
 	closed     bool
 	tempFiles  []*os.File
 }
 
 func (f *fakeLibMachineAPI) NewHost(driverName string, rawDriver []byte) (*host.Host, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.driverName = driverName
 	var driverOpts map[string]interface{}
 	json.Unmarshal(rawDriver, &driverOpts)
@@ -56,6 +77,14 @@ func (f *fakeLibMachineAPI) NewHost(driverName string, rawDriver []byte) (*host.
 	} else {
 		name = driverOpts["MockName"].(string)
 	}
+	if err, ok := f.removeErrs[name]; ok {
+		driver = &removeErrDriver{Driver: driver, err: err}
+	} else if f.removeErr != nil {
+		driver = &removeErrDriver{Driver: driver, err: f.removeErr}
+	}
+	if err, ok := f.stateErrs[name]; ok {
+		driver = &stateErrDriver{Driver: driver, err: err}
+	}
 	caFile, err := createTempFile("ca")
 	if err != nil {
 		return nil, err
@@ -75,10 +104,11 @@ func (f *fakeLibMachineAPI) NewHost(driverName string, rawDriver []byte) (*host.
 		}
 	}
 	return &host.Host{
-		Name:   name,
-		Driver: driver,
+		Name:       name,
+		DriverName: driverName,
+		Driver:     driver,
 		HostOptions: &host.Options{
-			EngineOptions: &engine.Options{},
+			EngineOptions: &engine.Options{InstallURL: drivers.DefaultEngineInstallURL},
 			AuthOptions: &auth.Options{
 				CaCertPath:     caFile.Name(),
 				ClientCertPath: certFile.Name(),
@@ -101,18 +131,82 @@ func createTempFile(content string) (*os.File, error) {
 }
 
 func (f *fakeLibMachineAPI) Create(h *host.Host) error {
+	if f.createCh != nil {
+		close(f.createCh)
+	}
+	if f.createWait != nil {
+		// creates may outlive the operation, avoid racing with the
+		// libmachine logger being restored
+		<-f.createWait
+	} else {
+		log.Infof("Creating machine %s...", h.Name)
+	}
+	if f.closed {
+		return errors.New("store closed")
+	}
 	if f.driverName == "amazonec2" {
 		f.ec2Driver = h.Driver.(*amazonec2.Driver)
+		if f.ec2Driver.UserDataFile != "" {
+			userData, err := ioutil.ReadFile(f.ec2Driver.UserDataFile)
+			if err != nil {
+				return err
+			}
+			f.userData = string(userData)
+		}
 	}
-	h.Driver = &fakedriver.Driver{
+	fakeDriver := &fakedriver.Driver{
 		MockName:  h.Name,
 		MockState: state.Running,
 		MockIP:    "192.168.10.3",
 	}
+	h.Driver = fakeDriver
+	if f.privateIP != "" {
+		h.Driver = &privateIPDriver{Driver: fakeDriver, PrivateIPAddress: f.privateIP}
+	}
 	f.Save(h)
 	return nil
 }
 
+type removeErrDriver struct {
+	drivers.Driver
+	err error
+}
+
+func (d *removeErrDriver) Remove() error {
+	return d.err
+}
+
+type stateErrDriver struct {
+	drivers.Driver
+	err error
+}
+
+func (d *stateErrDriver) GetState() (state.State, error) {
+	return state.None, d.err
+}
+
+type privateIPDriver struct {
+	*fakedriver.Driver
+	PrivateIPAddress string
+}
+
+func (f *fakeLibMachineAPI) Exists(name string) (bool, error) {
+	if f.FakeStore == nil {
+		return false, nil
+	}
+	return f.FakeStore.Exists(name)
+}
+
+func (f *fakeLibMachineAPI) Remove(name string) error {
+	if f.removeWait != nil {
+		<-f.removeWait
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = append(f.removed, name)
+	return f.FakeStore.Remove(name)
+}
+
 func (f *fakeLibMachineAPI) Close() error {
 	for _, f := range f.tempFiles {
 		os.Remove(f.Name())
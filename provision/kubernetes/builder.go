@@ -57,6 +57,7 @@ func (c *KubeClient) BuildPod(a provision.App, evt *event.Event, archiveFile io.
 		attachInput:       archiveFile,
 		attachOutput:      evt,
 		inputFile:         "/home/application/archive.tar.gz",
+		eventID:           evt.UniqueID.Hex(),
 	}
 	ctx, cancel := evt.CancelableContext(context.Background())
 	err = createBuildPod(ctx, params)
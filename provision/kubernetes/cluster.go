@@ -10,6 +10,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -29,29 +30,82 @@ import (
 )
 
 const (
-	namespaceClusterKey    = "namespace"
-	tokenClusterKey        = "token"
-	userClusterKey         = "username"
-	passwordClusterKey     = "password"
-	overcommitClusterKey   = "overcommit-factor"
-	namespaceLabelsKey     = "namespace-labels"
-	externalPolicyLocalKey = "external-policy-local"
-	routerAddressLocalKey  = "router-local"
+	namespaceClusterKey       = "namespace"
+	tokenClusterKey           = "token"
+	userClusterKey            = "username"
+	passwordClusterKey        = "password"
+	overcommitClusterKey      = "overcommit-factor"
+	namespaceLabelsKey        = "namespace-labels"
+	externalPolicyLocalKey    = "external-policy-local"
+	routerAddressLocalKey     = "router-local"
+	informerResyncKey         = "informer-resync-period"
+	informerAppPodsOnlyKey    = "informer-app-pods-only"
+	informerActivePodsOnlyKey = "informer-active-pods-only"
+	informerNamespacesKey     = "informer-namespaces"
+	informerQPSKey            = "informer-qps"
+	informerBurstKey          = "informer-burst"
+	informerSyncTimeoutKey    = "informer-sync-timeout"
+	nodePoolLabelClusterKey   = "node-pool-label"
+	monitoredPoolsKey         = "monitored-pools"
+	excludedNamespacesKey     = "excluded-namespaces"
+	deleteRebuildDelayKey     = "delete-rebuild-delay"
+	highPriorityPoolsKey      = "high-priority-pools"
+	deleteRebuildRoutersKey   = "delete-rebuild-router-types"
+	podCacheMaxAgeKey         = "pod-cache-max-age"
+	podCacheRelistKey         = "pod-cache-relist"
+	eventWorkersKey           = "event-workers"
+	eventErrorsLogLevelKey    = "event-errors-log-level"
+	configMapRebuildKey       = "configmap-rebuild"
+	informerCABundleKey       = "informer-ca-bundle"
+	impersonateUserKey        = "informer-impersonate-user"
+	impersonateGroupsKey      = "informer-impersonate-groups"
 
 	dialTimeout  = 30 * time.Second
 	tcpKeepAlive = 30 * time.Second
+
+	defaultInformerResync      = time.Minute
+	minInformerResync          = 5 * time.Second
+	defaultInformerQPS         = 50
+	defaultInformerBurst       = 100
+	defaultEventWorkers        = 1
+	defaultEventErrorsLogLevel = "error"
+	defaultInformerSyncTimeout = 10 * time.Second
+	defaultDeleteRebuildDelay  = 2 * time.Second
 )
 
 var (
+	defaultExcludedNamespaces = []string{metav1.NamespaceSystem, metav1.NamespacePublic}
+
 	clusterHelp = map[string]string{
-		namespaceClusterKey:    "Namespace used to create resources unless kubernetes:use-pool-namespaces config is enabled.",
-		tokenClusterKey:        "Token used to connect to the cluster,",
-		userClusterKey:         "User used to connect to the cluster.",
-		passwordClusterKey:     "Password used to connect to the cluster.",
-		overcommitClusterKey:   "Overcommit factor for memory resources. The requested value will be divided by this factor. This config may be prefixed with `<pool-name>:`.",
-		namespaceLabelsKey:     "Extra labels added to dynamically created namespaces in the format <label1>=<value1>,<label2>=<value2>... This config may be prefixed with `<pool-name>:`.",
-		externalPolicyLocalKey: "Use external policy local in created services. This is not recomended as depending on the used router it can cause downtimes during restarts. This config may be prefixed with `<pool-name>:`.",
-		routerAddressLocalKey:  "Only add node addresses that contains a pod from an app to the router. This config may be prefixed with `<pool-name>:`.",
+		namespaceClusterKey:       "Namespace used to create resources unless kubernetes:use-pool-namespaces config is enabled.",
+		tokenClusterKey:           "Token used to connect to the cluster,",
+		userClusterKey:            "User used to connect to the cluster.",
+		passwordClusterKey:        "Password used to connect to the cluster.",
+		overcommitClusterKey:      "Overcommit factor for memory resources. The requested value will be divided by this factor. This config may be prefixed with `<pool-name>:`.",
+		namespaceLabelsKey:        "Extra labels added to dynamically created namespaces in the format <label1>=<value1>,<label2>=<value2>... This config may be prefixed with `<pool-name>:`.",
+		externalPolicyLocalKey:    "Use external policy local in created services. This is not recomended as depending on the used router it can cause downtimes during restarts. This config may be prefixed with `<pool-name>:`.",
+		routerAddressLocalKey:     "Only add node addresses that contains a pod from an app to the router. This config may be prefixed with `<pool-name>:`. Pods annotated with tsuru.io/router-local override this setting.",
+		informerResyncKey:         "Resync period used by the informers watching the cluster, e.g. 30s or 5m. Must be at least 5s. Defaults to 1m.",
+		informerAppPodsOnlyKey:    "Only watch pods labeled as belonging to a tsuru app. Useful on clusters shared with workloads not managed by tsuru.",
+		informerActivePodsOnlyKey: "Do not watch pods in the Succeeded or Failed phases, such as the ones from finished deploys. Reduces memory usage on clusters with many finished pods.",
+		informerNamespacesKey:     "Comma separated list of namespaces watched for pods and services, instead of watching all namespaces. Useful when tsuru is restricted by RBAC to a set of namespaces.",
+		informerQPSKey:            "Maximum queries per second sent to the cluster API server by the informers. Defaults to 50.",
+		informerBurstKey:          "Maximum burst of queries sent to the cluster API server by the informers. Defaults to 100.",
+		informerSyncTimeoutKey:    "Maximum time to wait for the informers initial sync when starting to watch the cluster, e.g. 30s or 2m. Defaults to 10s.",
+		nodePoolLabelClusterKey:   "Node label used to group nodes by pool. Defaults to tsuru.io/pool.",
+		monitoredPoolsKey:         "Comma separated list of pools whose app pods trigger routes rebuilds on readiness changes, instead of all pools.",
+		excludedNamespacesKey:     "Comma separated list of namespaces whose pods are ignored by the router update controller. Defaults to kube-system,kube-public, an empty value ignores no namespace.",
+		deleteRebuildDelayKey:     "Time to wait before rebuilding the routes of an app after one of its ready pods is deleted, allowing the pod endpoints to settle, e.g. 500ms or 5s. Bounded by the pod termination grace period, 0 disables the delay. Defaults to 2s.",
+		deleteRebuildRoutersKey:   "Comma separated list of router types whose apps have their routes rebuilt when a ready pod is deleted, even when router-local is disabled. Useful for draining routers pointing to service addresses.",
+		highPriorityPoolsKey:      "Comma separated list of pools whose apps have their routes rebuilt before the apps from other pools. Pods annotated with tsuru.io/rebuild-priority, set to high or normal, override this setting.",
+		podCacheMaxAgeKey:         "Interval between checks of the cached pods against a fresh list from the cluster, logging stale and missing entries, e.g. 10m. Disabled by default.",
+		eventWorkersKey:           "Maximum number of informer events handled concurrently by the router update controller. The informers only wait for the events being handled when every worker is busy. Events handled concurrently may be handled out of order. Defaults to 1, handling events in order.",
+		podCacheRelistKey:         "Restart the informers when the check enabled by pod-cache-max-age finds stale or missing pods.",
+		configMapRebuildKey:       "Rebuild the routes of an app when a ConfigMap labeled with tsuru.io/app-name set to its name changes or is removed. Only the labeled ConfigMaps are watched, in the namespaces set in informer-namespaces.",
+		informerCABundleKey:       "PEM encoded CA certificates used by the informers to verify the cluster API server certificate, instead of the cluster CA certificate. Useful for clusters behind a proxy with a private CA.",
+		impersonateUserKey:        "User impersonated by the informers on the cluster API server, e.g. system:serviceaccount:tsuru:tsuru-informers. Impersonation is disabled unless set.",
+		impersonateGroupsKey:      "Comma separated list of groups impersonated by the informers on the cluster API server. Requires informer-impersonate-user.",
+		eventErrorsLogLevelKey:    "Log level, error or debug, of the errors handling informer events in the router update controller. Useful on clusters with frequent transient pod churn, the errors are still counted by the tsuru_kubernetes_event_errors_total metric. Defaults to error.",
 	}
 )
 
@@ -71,6 +125,13 @@ type ClusterClient struct {
 	kubernetes.Interface `json:"-" bson:"-"`
 	*provTypes.Cluster
 	restConfig *rest.Config
+	// CABundle, when set, replaces the CA used by informers to verify the
+	// cluster API server certificate. It's set from informer-ca-bundle.
+	CABundle []byte `json:"-" bson:"-"`
+	// Impersonate, when set, is the identity impersonated by the informers
+	// on the cluster API server. An empty user disables impersonation. It's
+	// set from informer-impersonate-user and informer-impersonate-groups.
+	Impersonate rest.ImpersonationConfig `json:"-" bson:"-"`
 }
 
 func getRestBaseConfig(c *provTypes.Cluster) (*rest.Config, error) {
@@ -153,11 +214,19 @@ func NewClusterClient(clust *provTypes.Cluster) (*ClusterClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &ClusterClient{
+	c := &ClusterClient{
 		Cluster:    clust,
 		Interface:  client,
 		restConfig: cfg,
-	}, nil
+	}
+	if caBundle := c.CustomData[informerCABundleKey]; caBundle != "" {
+		c.CABundle = []byte(caBundle)
+	}
+	c.Impersonate = rest.ImpersonationConfig{
+		UserName: c.CustomData[impersonateUserKey],
+		Groups:   c.customDataList(impersonateGroupsKey),
+	}
+	return c, nil
 }
 
 func (c *ClusterClient) SetTimeout(timeout time.Duration) error {
@@ -253,6 +322,189 @@ func (c *ClusterClient) OvercommitFactor(pool string) (int64, error) {
 	return int64(overcommit), err
 }
 
+func (c *ClusterClient) InformerResyncPeriod() (time.Duration, error) {
+	if c.CustomData == nil || c.CustomData[informerResyncKey] == "" {
+		return defaultInformerResync, nil
+	}
+	resync, err := time.ParseDuration(c.CustomData[informerResyncKey])
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", informerResyncKey)
+	}
+	if resync < minInformerResync {
+		return 0, errors.Errorf("%s must be at least %v, got %v", informerResyncKey, minInformerResync, resync)
+	}
+	return resync, nil
+}
+
+func (c *ClusterClient) InformerAppPodsOnly() (bool, error) {
+	if c.CustomData == nil || c.CustomData[informerAppPodsOnlyKey] == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(c.CustomData[informerAppPodsOnlyKey])
+}
+
+func (c *ClusterClient) InformerActivePodsOnly() (bool, error) {
+	if c.CustomData == nil || c.CustomData[informerActivePodsOnlyKey] == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(c.CustomData[informerActivePodsOnlyKey])
+}
+
+func (c *ClusterClient) InformerNamespaces() []string {
+	return c.customDataList(informerNamespacesKey)
+}
+
+func (c *ClusterClient) MonitoredPools() []string {
+	return c.customDataList(monitoredPoolsKey)
+}
+
+func (c *ClusterClient) HighPriorityPools() []string {
+	return c.customDataList(highPriorityPoolsKey)
+}
+
+func (c *ClusterClient) DeleteRebuildRouterTypes() []string {
+	return c.customDataList(deleteRebuildRoutersKey)
+}
+
+func (c *ClusterClient) ExcludedNamespaces() []string {
+	if _, ok := c.CustomData[excludedNamespacesKey]; !ok {
+		return defaultExcludedNamespaces
+	}
+	return c.customDataList(excludedNamespacesKey)
+}
+
+func (c *ClusterClient) customDataList(key string) []string {
+	if c.CustomData == nil || c.CustomData[key] == "" {
+		return nil
+	}
+	var values []string
+	for _, v := range strings.Split(c.CustomData[key], ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (c *ClusterClient) InformerSyncTimeout() (time.Duration, error) {
+	if c.CustomData == nil || c.CustomData[informerSyncTimeoutKey] == "" {
+		return defaultInformerSyncTimeout, nil
+	}
+	timeout, err := time.ParseDuration(c.CustomData[informerSyncTimeoutKey])
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", informerSyncTimeoutKey)
+	}
+	if timeout <= 0 {
+		return 0, errors.Errorf("%s must be greater than 0, got %v", informerSyncTimeoutKey, timeout)
+	}
+	return timeout, nil
+}
+
+func (c *ClusterClient) DeleteRebuildDelay() (time.Duration, error) {
+	if c.CustomData == nil || c.CustomData[deleteRebuildDelayKey] == "" {
+		return defaultDeleteRebuildDelay, nil
+	}
+	delay, err := time.ParseDuration(c.CustomData[deleteRebuildDelayKey])
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", deleteRebuildDelayKey)
+	}
+	if delay < 0 {
+		return 0, errors.Errorf("%s must not be negative, got %v", deleteRebuildDelayKey, delay)
+	}
+	return delay, nil
+}
+
+// PodCacheMaxAge returns the interval between checks of the pod informer
+// cache, 0 if the checks are disabled.
+func (c *ClusterClient) PodCacheMaxAge() (time.Duration, error) {
+	if c.CustomData == nil || c.CustomData[podCacheMaxAgeKey] == "" {
+		return 0, nil
+	}
+	maxAge, err := time.ParseDuration(c.CustomData[podCacheMaxAgeKey])
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", podCacheMaxAgeKey)
+	}
+	if maxAge < 0 {
+		return 0, errors.Errorf("%s must not be negative, got %v", podCacheMaxAgeKey, maxAge)
+	}
+	return maxAge, nil
+}
+
+func (c *ClusterClient) PodCacheRelist() (bool, error) {
+	if c.CustomData == nil || c.CustomData[podCacheRelistKey] == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(c.CustomData[podCacheRelistKey])
+}
+
+func (c *ClusterClient) ConfigMapRebuild() (bool, error) {
+	if c.CustomData == nil || c.CustomData[configMapRebuildKey] == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(c.CustomData[configMapRebuildKey])
+}
+
+func (c *ClusterClient) InformerQPS() (float32, error) {
+	if c.CustomData == nil || c.CustomData[informerQPSKey] == "" {
+		return defaultInformerQPS, nil
+	}
+	qps, err := strconv.ParseFloat(c.CustomData[informerQPSKey], 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", informerQPSKey)
+	}
+	if qps <= 0 {
+		return 0, errors.Errorf("%s must be greater than 0, got %v", informerQPSKey, qps)
+	}
+	return float32(qps), nil
+}
+
+func (c *ClusterClient) InformerBurst() (int, error) {
+	if c.CustomData == nil || c.CustomData[informerBurstKey] == "" {
+		return defaultInformerBurst, nil
+	}
+	burst, err := strconv.Atoi(c.CustomData[informerBurstKey])
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", informerBurstKey)
+	}
+	if burst <= 0 {
+		return 0, errors.Errorf("%s must be greater than 0, got %d", informerBurstKey, burst)
+	}
+	return burst, nil
+}
+
+func (c *ClusterClient) EventWorkers() (int, error) {
+	if c.CustomData == nil || c.CustomData[eventWorkersKey] == "" {
+		return defaultEventWorkers, nil
+	}
+	workers, err := strconv.Atoi(c.CustomData[eventWorkersKey])
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", eventWorkersKey)
+	}
+	if workers <= 0 {
+		return 0, errors.Errorf("%s must be greater than 0, got %d", eventWorkersKey, workers)
+	}
+	return workers, nil
+}
+
+func (c *ClusterClient) EventErrorsLogLevel() (string, error) {
+	if c.CustomData == nil || c.CustomData[eventErrorsLogLevelKey] == "" {
+		return defaultEventErrorsLogLevel, nil
+	}
+	level := strings.ToLower(c.CustomData[eventErrorsLogLevelKey])
+	if level != "error" && level != "debug" {
+		return "", errors.Errorf("%s must be error or debug, got %q", eventErrorsLogLevelKey, c.CustomData[eventErrorsLogLevelKey])
+	}
+	return level, nil
+}
+
+func (c *ClusterClient) NodePoolLabel() string {
+	if c.CustomData == nil || c.CustomData[nodePoolLabelClusterKey] == "" {
+		return tsuruLabelPrefix + provision.LabelNodePool
+	}
+	return c.CustomData[nodePoolLabelClusterKey]
+}
+
 func (c *ClusterClient) namespaceLabels(ns string) (map[string]string, error) {
 	if c.CustomData == nil {
 		return nil, nil
@@ -381,3 +633,44 @@ func forEachCluster(fn func(client *ClusterClient) error) error {
 	}
 	return nil
 }
+
+// forEachClusterConcurrent calls fn for every cluster, running at most
+// parallelism calls at the same time. Errors from all calls are aggregated.
+func forEachClusterConcurrent(parallelism int, fn func(client *ClusterClient) error) error {
+	clients, err := allClusters()
+	if err != nil {
+		return err
+	}
+	return runForClusters(clients, parallelism, fn)
+}
+
+func runForClusters(clients []*ClusterClient, parallelism int, fn func(client *ClusterClient) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		sem  = make(chan struct{}, parallelism)
+		errs = tsuruErrors.NewMultiError()
+	)
+	for _, c := range clients {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c *ClusterClient) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := fn(c)
+			if err != nil {
+				mu.Lock()
+				errs.Add(err)
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	if errs.Len() > 0 {
+		return errs
+	}
+	return nil
+}
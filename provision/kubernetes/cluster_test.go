@@ -5,10 +5,14 @@
 package kubernetes
 
 import (
+	"fmt"
 	"math/rand"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/provision"
 	"github.com/tsuru/tsuru/provision/provisiontest"
@@ -219,6 +223,287 @@ func (s *S) TestClusterOvercommitFactor(c *check.C) {
 	c.Assert(ovf, check.Equals, int64(0))
 }
 
+func (s *S) TestClusterInformerResyncPeriod(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	resync, err := client.InformerResyncPeriod()
+	c.Assert(err, check.IsNil)
+	c.Assert(resync, check.Equals, time.Minute)
+	client.CustomData = map[string]string{"informer-resync-period": "30s"}
+	resync, err = client.InformerResyncPeriod()
+	c.Assert(err, check.IsNil)
+	c.Assert(resync, check.Equals, 30*time.Second)
+	client.CustomData["informer-resync-period"] = "1s"
+	_, err = client.InformerResyncPeriod()
+	c.Assert(err, check.ErrorMatches, "informer-resync-period must be at least 5s, got 1s")
+	client.CustomData["informer-resync-period"] = "abc"
+	_, err = client.InformerResyncPeriod()
+	c.Assert(err, check.ErrorMatches, "invalid informer-resync-period: .*")
+}
+
+func (s *S) TestClusterInformerNamespaces(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.InformerNamespaces(), check.IsNil)
+	client.CustomData = map[string]string{"informer-namespaces": "ns1, ns2,,"}
+	c.Assert(client.InformerNamespaces(), check.DeepEquals, []string{"ns1", "ns2"})
+}
+
+func (s *S) TestClusterMonitoredPools(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.MonitoredPools(), check.IsNil)
+	client.CustomData = map[string]string{"monitored-pools": "p1, p2,,"}
+	c.Assert(client.MonitoredPools(), check.DeepEquals, []string{"p1", "p2"})
+}
+
+func (s *S) TestClusterHighPriorityPools(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.HighPriorityPools(), check.IsNil)
+	client.CustomData = map[string]string{"high-priority-pools": "p1, p2"}
+	c.Assert(client.HighPriorityPools(), check.DeepEquals, []string{"p1", "p2"})
+}
+
+func (s *S) TestClusterExcludedNamespaces(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.ExcludedNamespaces(), check.DeepEquals, []string{"kube-system", "kube-public"})
+	client.CustomData = map[string]string{"excluded-namespaces": "ns1, ns2"}
+	c.Assert(client.ExcludedNamespaces(), check.DeepEquals, []string{"ns1", "ns2"})
+	client.CustomData = map[string]string{"excluded-namespaces": ""}
+	c.Assert(client.ExcludedNamespaces(), check.IsNil)
+}
+
+func (s *S) TestClusterInformerSyncTimeout(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	timeout, err := client.InformerSyncTimeout()
+	c.Assert(err, check.IsNil)
+	c.Assert(timeout, check.Equals, 10*time.Second)
+	client.CustomData = map[string]string{"informer-sync-timeout": "2m"}
+	timeout, err = client.InformerSyncTimeout()
+	c.Assert(err, check.IsNil)
+	c.Assert(timeout, check.Equals, 2*time.Minute)
+	client.CustomData["informer-sync-timeout"] = "0s"
+	_, err = client.InformerSyncTimeout()
+	c.Assert(err, check.ErrorMatches, "informer-sync-timeout must be greater than 0, got 0s")
+}
+
+func (s *S) TestClusterDeleteRebuildDelay(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	delay, err := client.DeleteRebuildDelay()
+	c.Assert(err, check.IsNil)
+	c.Assert(delay, check.Equals, 2*time.Second)
+	client.CustomData = map[string]string{"delete-rebuild-delay": "500ms"}
+	delay, err = client.DeleteRebuildDelay()
+	c.Assert(err, check.IsNil)
+	c.Assert(delay, check.Equals, 500*time.Millisecond)
+	client.CustomData["delete-rebuild-delay"] = "0s"
+	delay, err = client.DeleteRebuildDelay()
+	c.Assert(err, check.IsNil)
+	c.Assert(delay, check.Equals, time.Duration(0))
+	client.CustomData["delete-rebuild-delay"] = "-1s"
+	_, err = client.DeleteRebuildDelay()
+	c.Assert(err, check.ErrorMatches, "delete-rebuild-delay must not be negative, got -1s")
+}
+
+func (s *S) TestClusterPodCacheMaxAgeAndRelist(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	maxAge, err := client.PodCacheMaxAge()
+	c.Assert(err, check.IsNil)
+	c.Assert(maxAge, check.Equals, time.Duration(0))
+	relist, err := client.PodCacheRelist()
+	c.Assert(err, check.IsNil)
+	c.Assert(relist, check.Equals, false)
+	client.CustomData = map[string]string{"pod-cache-max-age": "10m", "pod-cache-relist": "true"}
+	maxAge, err = client.PodCacheMaxAge()
+	c.Assert(err, check.IsNil)
+	c.Assert(maxAge, check.Equals, 10*time.Minute)
+	relist, err = client.PodCacheRelist()
+	c.Assert(err, check.IsNil)
+	c.Assert(relist, check.Equals, true)
+	client.CustomData["pod-cache-max-age"] = "-1m"
+	_, err = client.PodCacheMaxAge()
+	c.Assert(err, check.ErrorMatches, "pod-cache-max-age must not be negative, got -1m0s")
+}
+
+func (s *S) TestClusterInformerQPSAndBurst(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	qps, err := client.InformerQPS()
+	c.Assert(err, check.IsNil)
+	c.Assert(qps, check.Equals, float32(50))
+	burst, err := client.InformerBurst()
+	c.Assert(err, check.IsNil)
+	c.Assert(burst, check.Equals, 100)
+	client.CustomData = map[string]string{"informer-qps": "12.5", "informer-burst": "20"}
+	qps, err = client.InformerQPS()
+	c.Assert(err, check.IsNil)
+	c.Assert(qps, check.Equals, float32(12.5))
+	burst, err = client.InformerBurst()
+	c.Assert(err, check.IsNil)
+	c.Assert(burst, check.Equals, 20)
+	client.CustomData = map[string]string{"informer-qps": "0", "informer-burst": "abc"}
+	_, err = client.InformerQPS()
+	c.Assert(err, check.ErrorMatches, "informer-qps must be greater than 0, got 0")
+	_, err = client.InformerBurst()
+	c.Assert(err, check.ErrorMatches, "invalid informer-burst: .*")
+}
+
+func (s *S) TestClusterEventWorkers(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	workers, err := client.EventWorkers()
+	c.Assert(err, check.IsNil)
+	c.Assert(workers, check.Equals, 1)
+	client.CustomData = map[string]string{"event-workers": "3"}
+	workers, err = client.EventWorkers()
+	c.Assert(err, check.IsNil)
+	c.Assert(workers, check.Equals, 3)
+	client.CustomData = map[string]string{"event-workers": "0"}
+	_, err = client.EventWorkers()
+	c.Assert(err, check.ErrorMatches, "event-workers must be greater than 0, got 0")
+	client.CustomData = map[string]string{"event-workers": "abc"}
+	_, err = client.EventWorkers()
+	c.Assert(err, check.ErrorMatches, "invalid event-workers: .*")
+}
+
+func (s *S) TestClusterConfigMapRebuild(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	enabled, err := client.ConfigMapRebuild()
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, false)
+	client.CustomData = map[string]string{"configmap-rebuild": "true"}
+	enabled, err = client.ConfigMapRebuild()
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.Equals, true)
+	client.CustomData = map[string]string{"configmap-rebuild": "yes"}
+	_, err = client.ConfigMapRebuild()
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestNewClusterClientCABundle(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.CABundle, check.IsNil)
+	c1.CustomData = map[string]string{"informer-ca-bundle": "custom-ca"}
+	client, err = NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.CABundle, check.DeepEquals, []byte("custom-ca"))
+}
+
+func (s *S) TestNewClusterClientImpersonate(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.Impersonate, check.DeepEquals, rest.ImpersonationConfig{})
+	c1.CustomData = map[string]string{
+		"informer-impersonate-user":   "system:serviceaccount:tsuru:informers",
+		"informer-impersonate-groups": "tsuru-informers, auditors",
+	}
+	client, err = NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.Impersonate, check.DeepEquals, rest.ImpersonationConfig{
+		UserName: "system:serviceaccount:tsuru:informers",
+		Groups:   []string{"tsuru-informers", "auditors"},
+	})
+}
+
+func (s *S) TestClusterEventErrorsLogLevel(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	level, err := client.EventErrorsLogLevel()
+	c.Assert(err, check.IsNil)
+	c.Assert(level, check.Equals, "error")
+	client.CustomData = map[string]string{"event-errors-log-level": "Debug"}
+	level, err = client.EventErrorsLogLevel()
+	c.Assert(err, check.IsNil)
+	c.Assert(level, check.Equals, "debug")
+	client.CustomData = map[string]string{"event-errors-log-level": "warning"}
+	_, err = client.EventErrorsLogLevel()
+	c.Assert(err, check.ErrorMatches, `event-errors-log-level must be error or debug, got "warning"`)
+}
+
+func (s *S) TestClusterNodePoolLabel(c *check.C) {
+	c1 := provTypes.Cluster{Addresses: []string{"addr1"}}
+	client, err := NewClusterClient(&c1)
+	c.Assert(err, check.IsNil)
+	c.Assert(client.NodePoolLabel(), check.Equals, "tsuru.io/pool")
+	client.CustomData = map[string]string{"node-pool-label": "example.com/node-group"}
+	c.Assert(client.NodePoolLabel(), check.Equals, "example.com/node-group")
+}
+
+func (s *S) TestRunForClustersConcurrently(c *check.C) {
+	var clients []*ClusterClient
+	for _, name := range []string{"c1", "c2", "c3", "c4"} {
+		clients = append(clients, &ClusterClient{Cluster: &provTypes.Cluster{Name: name}})
+	}
+	delays := map[string]time.Duration{
+		"c1": 50 * time.Millisecond,
+		"c2": 300 * time.Millisecond,
+		"c3": 50 * time.Millisecond,
+		"c4": 50 * time.Millisecond,
+	}
+	var mu sync.Mutex
+	var called []string
+	t0 := time.Now()
+	err := runForClusters(clients, 10, func(client *ClusterClient) error {
+		time.Sleep(delays[client.Name])
+		mu.Lock()
+		called = append(called, client.Name)
+		mu.Unlock()
+		if client.Name == "c3" {
+			return errors.New("c3 failed")
+		}
+		return nil
+	})
+	elapsed := time.Since(t0)
+	c.Assert(err, check.ErrorMatches, "(?s).*c3 failed.*")
+	sort.Strings(called)
+	c.Assert(called, check.DeepEquals, []string{"c1", "c2", "c3", "c4"})
+	c.Assert(elapsed >= 300*time.Millisecond, check.Equals, true)
+	c.Assert(elapsed < 450*time.Millisecond, check.Equals, true)
+}
+
+func (s *S) TestRunForClustersBoundedParallelism(c *check.C) {
+	var clients []*ClusterClient
+	for i := 0; i < 6; i++ {
+		clients = append(clients, &ClusterClient{Cluster: &provTypes.Cluster{Name: fmt.Sprintf("c%d", i)}})
+	}
+	var running, maxRunning int32
+	err := runForClusters(clients, 2, func(client *ClusterClient) error {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(atomic.LoadInt32(&maxRunning), check.Equals, int32(2))
+}
+
 func (s *S) TestClustersForApps(c *check.C) {
 	c1 := provTypes.Cluster{
 		Name:        "c1",
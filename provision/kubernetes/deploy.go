@@ -171,6 +171,7 @@ type createPodParams struct {
 	attachOutput      io.Writer
 	pod               *apiv1.Pod
 	mainContainer     string
+	eventID           string
 }
 
 func createBuildPod(ctx context.Context, params createPodParams) error {
@@ -306,6 +307,12 @@ func createPod(ctx context.Context, params createPodParams) error {
 		}
 		params.pod = &pod
 	}
+	if params.eventID != "" {
+		if params.pod.Annotations == nil {
+			params.pod.Annotations = map[string]string{}
+		}
+		params.pod.Annotations[tsuruEventIDMeta] = params.eventID
+	}
 	ns, err := params.client.AppNamespace(params.app)
 	if err != nil {
 		return err
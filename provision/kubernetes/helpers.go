@@ -41,6 +41,9 @@ const (
 	tsuruNodeDisabledTaint    = tsuruLabelPrefix + "disabled"
 	tsuruExtraLabelsMeta      = tsuruLabelPrefix + "extra-labels"
 	tsuruExtraAnnotationsMeta = tsuruLabelPrefix + "extra-annotations"
+	tsuruRouterLocalMeta      = tsuruLabelPrefix + "router-local"
+	tsuruRebuildPriorityMeta  = tsuruLabelPrefix + "rebuild-priority"
+	tsuruEventIDMeta          = tsuruLabelPrefix + "event-id"
 	replicaDepRevision        = "deployment.kubernetes.io/revision"
 	kubeKindReplicaSet        = "ReplicaSet"
 	kubeLabelNameMaxLen       = 55
@@ -555,7 +555,7 @@ func (s *S) TestLabelSetFromMeta(c *check.C) {
 
 func (s *S) TestGetServicePort(c *check.C) {
 	ns := "default"
-	controller, err := getClusterController(s.p, s.clusterClient)
+	controller, err := getClusterController(context.Background(), s.p, s.clusterClient)
 	c.Assert(err, check.IsNil)
 	svcInformer, err := controller.getServiceInformer()
 	c.Assert(err, check.IsNil)
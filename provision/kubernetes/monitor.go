@@ -6,144 +6,1552 @@ package kubernetes
 
 import (
 	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tsuru/tsuru/event"
+	"github.com/tsuru/tsuru/healer"
 	"github.com/tsuru/tsuru/log"
+	"github.com/tsuru/tsuru/permission"
+	"github.com/tsuru/tsuru/provision"
 	"github.com/tsuru/tsuru/router/rebuild"
+	"github.com/tsuru/tsuru/servicemanager"
 	apiv1 "k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/informers"
 	v1informers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/informers/internalinterfaces"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	informerSyncTimeout = 10 * time.Second
+	controllerStopTimeout = 5 * time.Second
+
+	activePodsFieldSelector = "status.phase!=Succeeded,status.phase!=Failed"
+
+	// appNameIndex indexes the cached pods by the name of their app.
+	appNameIndex = "app-name"
+)
+
+var routesRebuildEnqueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsuru_kubernetes_routes_rebuild_enqueued_total",
+	Help: "The number of routes rebuild enqueued by the router update controller.",
+}, []string{"cluster", "app"})
+
+var pendingEventsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tsuru_kubernetes_informer_pending_events",
+	Help: "The number of informer events delivered to the router update controller and not yet processed.",
+}, []string{"cluster"})
+
+var informerSyncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "tsuru_kubernetes_informer_sync_duration_seconds",
+	Help:    "The time spent waiting for the initial sync of the cluster informers.",
+	Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+}, []string{"cluster", "informer"})
+
+var (
+	// ErrInformerSyncTimeout is returned when informers fail to sync within
+	// the allowed time.
+	ErrInformerSyncTimeout = errors.New("timeout waiting for informer sync")
+	// ErrControllerStopped is returned when the cluster controller is
+	// stopped while waiting for informers to sync.
+	ErrControllerStopped = errors.New("cluster controller stopped")
+)
+
+var (
+	informerWatchdogInterval = time.Minute
+	informerStallTimeout     = 10 * time.Minute
+
+	controllerFailureTTL = 30 * time.Second
+
+	// informerSyncBackoff is the time waitForSync sleeps between the
+	// attempts to sync an informer, doubled after each attempt.
+	informerSyncBackoff = time.Second
+	waitForCacheSync    = cache.WaitForCacheSync
+
+	drainEvictionRetryInterval = 5 * time.Second
+	drainEvictionTimeout       = 5 * time.Minute
+
+	removeNodeData = func(node provision.Node) error {
+		if healer.HealerInstance == nil {
+			return nil
+		}
+		return healer.HealerInstance.RemoveNode(node)
+	}
+
+	// informerResyncJitter is the maximum fraction of the resync period added
+	// to or removed from each cluster factory, so clusters configured with the
+	// same period do not relist at the same time.
+	informerResyncJitter = 0.1
+	resyncJitterRand     = rand.Float64
+
+	loadBalancerPendingThreshold = 10 * time.Minute
+	// onStuckLoadBalancer is called once for each LoadBalancer service still
+	// without an external address after loadBalancerPendingThreshold.
+	onStuckLoadBalancer = func(cluster string, svc *apiv1.Service, pending time.Duration) {
+		log.Errorf("[router-update-controller] LoadBalancer service %s/%s on cluster %q pending external address for %v", svc.Namespace, svc.Name, cluster, pending)
+	}
 )
 
+var podCacheDiscrepancies = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsuru_kubernetes_pod_cache_discrepancies_total",
+	Help: "The number of pods found stale or missing in the pod informer cache when compared to a fresh list.",
+}, []string{"cluster", "kind"})
+
+var unlabeledPodsSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsuru_kubernetes_unlabeled_pods_skipped_total",
+	Help: "The number of pod events ignored by the router update controller because the pod has no app name label.",
+}, []string{"cluster", "namespace"})
+
+var routesRebuildPending = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "tsuru_kubernetes_routes_rebuild_pending",
+	Help: "The number of distinct apps with enqueued routes rebuilds not yet started.",
+}, func() float64 {
+	return float64(rebuild.PendingRebuilds())
+})
+
+var eventErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsuru_kubernetes_event_errors_total",
+	Help: "The number of errors handling informer events in the router update controller by resource and event kind, regardless of the level they are logged at.",
+}, []string{"cluster", "resource", "kind"})
+
+func init() {
+	prometheus.MustRegister(routesRebuildEnqueued, informerSyncDuration, pendingEventsGauge, podCacheDiscrepancies, unlabeledPodsSkipped, routesRebuildPending, eventErrors)
+}
+
+// ClusterControllerStatus describes the state of the informers used by the
+// controller of a single cluster.
+type ClusterControllerStatus struct {
+	Cluster   string
+	Synced    bool
+	LastError error
+	LastSync  time.Time
+	Uptime    time.Duration
+}
+
 type clusterController struct {
-	mu              sync.Mutex
-	cluster         *ClusterClient
-	informerFactory informers.SharedInformerFactory
-	podInformer     v1informers.PodInformer
-	serviceInformer v1informers.ServiceInformer
-	nodeInformer    v1informers.NodeInformer
-	stopCh          chan struct{}
-}
-
-func initAllControllers(p *kubernetesProvisioner) error {
-	return forEachCluster(func(client *ClusterClient) error {
-		_, err := getClusterController(p, client)
-		return err
+	mu                sync.Mutex
+	cluster           *ClusterClient
+	informerFactory   informers.SharedInformerFactory
+	factoryStopCh     <-chan struct{}
+	stopFactory       context.CancelFunc
+	podInformer       v1informers.PodInformer
+	serviceInformer   v1informers.ServiceInformer
+	nodeInformer      v1informers.NodeInformer
+	configMapInformer v1informers.ConfigMapInformer
+	stopCh            chan struct{}
+	stopOnce          sync.Once
+	eventsMu          sync.Mutex
+	stopping          bool
+	paused            bool
+	pendingEvents     sync.WaitGroup
+	eventSlots        chan struct{}
+	debugEventErrors  bool
+	statusMu          sync.Mutex
+	podsSynced        cache.InformerSynced
+	podListWatch      listWatchHealth
+	lastSync          time.Time
+	lastErr           error
+	startedAt         time.Time
+	lbMu              sync.Mutex
+	pendingLBs        map[types.UID]*time.Timer
+	podWatchersMu     sync.Mutex
+	podWatchers       map[chan struct{}]struct{}
+	hooksMu           sync.RWMutex
+	rebuildDecider    RebuildDecider
+	desyncHandler     func(cluster string)
+	deployPodHandler  DeployPodHandler
+	restartHandler    ContainerRestartHandler
+}
+
+func initAllControllers(ctx context.Context, p *kubernetesProvisioner) error {
+	parallelism := getKubeConfig().ControllersStartParallelism
+	return forEachClusterConcurrent(parallelism, func(client *ClusterClient) error {
+		_, err := getClusterController(ctx, p, client)
+		switch err {
+		case ErrControllerStopped:
+			log.Debugf("[router-update-controller] controller for cluster %q stopped during initialization", client.Name)
+			return nil
+		case ErrInformerSyncTimeout:
+			log.Errorf("[router-update-controller] timeout waiting informers sync for cluster %q", client.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to start controller for cluster %q: %v", client.Name, err)
+		}
+		return nil
 	})
 }
 
-func getClusterController(p *kubernetesProvisioner, cluster *ClusterClient) (*clusterController, error) {
+// controllerFailure holds the error from the last failed attempt to start a
+// cluster controller, returned to callers until retryAfter to avoid having
+// every call wait for a failing cluster.
+type controllerFailure struct {
+	err        error
+	retryAfter time.Time
+}
+
+// clusterLock returns the lock serializing starts and stops of the controller
+// of a cluster, allowing controllers of different clusters to start
+// concurrently.
+func (p *kubernetesProvisioner) clusterLock(name string) *sync.Mutex {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if c, ok := p.clusterControllers[cluster.Name]; ok {
+	if p.clusterLocks == nil {
+		p.clusterLocks = map[string]*sync.Mutex{}
+	}
+	lock, ok := p.clusterLocks[name]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.clusterLocks[name] = lock
+	}
+	return lock
+}
+
+func getClusterController(ctx context.Context, p *kubernetesProvisioner, cluster *ClusterClient) (*clusterController, error) {
+	lock := p.clusterLock(cluster.Name)
+	lock.Lock()
+	defer lock.Unlock()
+	p.mu.Lock()
+	c, ok := p.clusterControllers[cluster.Name]
+	failure, failed := p.controllerFailures[cluster.Name]
+	decider := p.rebuildDecider
+	desyncHandler := p.desyncHandler
+	deployPodHandler := p.deployPodHandler
+	restartHandler := p.restartHandler
+	p.mu.Unlock()
+	if ok {
 		return c, nil
 	}
-	c := &clusterController{
-		cluster: cluster,
-		stopCh:  make(chan struct{}),
+	if failed && time.Now().Before(failure.retryAfter) {
+		return nil, failure.err
+	}
+	c = &clusterController{
+		cluster:          cluster,
+		stopCh:           make(chan struct{}),
+		rebuildDecider:   decider,
+		desyncHandler:    desyncHandler,
+		deployPodHandler: deployPodHandler,
+		restartHandler:   restartHandler,
 	}
-	err := c.start()
+	err := c.start(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if err != nil {
+		c.stop()
+		if err != ErrControllerStopped {
+			if errEvt := controllerStartFailureEvent(cluster.Name, err); errEvt != nil {
+				log.Errorf("[router-update-controller] unable to record start failure event for cluster %q: %v", cluster.Name, errEvt)
+			}
+			if p.controllerFailures == nil {
+				p.controllerFailures = map[string]controllerFailure{}
+			}
+			p.controllerFailures[cluster.Name] = controllerFailure{
+				err:        err,
+				retryAfter: time.Now().Add(controllerFailureTTL),
+			}
+		}
 		return nil, err
 	}
+	delete(p.controllerFailures, cluster.Name)
+	c.statusMu.Lock()
+	c.startedAt = time.Now()
+	c.statusMu.Unlock()
 	p.clusterControllers[cluster.Name] = c
 	return c, nil
 }
 
+// controllerStartFailureEvent records a failed event for the cluster with the
+// error starting its controller, so that it's visible in the events feed.
+func controllerStartFailureEvent(clusterName string, startErr error) error {
+	evt, err := event.NewInternal(&event.Opts{
+		Target:       event.Target{Type: event.TargetTypeCluster, Value: clusterName},
+		InternalKind: "cluster-controller-start",
+		Allowed:      event.Allowed(permission.PermClusterReadEvents),
+	})
+	if err != nil {
+		if _, ok := err.(event.ErrEventLocked); ok {
+			return nil
+		}
+		return err
+	}
+	return evt.Done(errors.Wrapf(startErr, "unable to start controller for cluster %q", clusterName))
+}
+
 func stopClusterController(p *kubernetesProvisioner, cluster *ClusterClient) {
+	lock := p.clusterLock(cluster.Name)
+	lock.Lock()
+	defer lock.Unlock()
+	p.mu.Lock()
+	c, ok := p.clusterControllers[cluster.Name]
+	delete(p.clusterControllers, cluster.Name)
+	delete(p.controllerFailures, cluster.Name)
+	p.mu.Unlock()
+	if ok {
+		c.stopWithTimeout(controllerStopTimeout)
+	}
+}
+
+// lookupClusterController returns the running controller of the cluster,
+// without creating one if it's absent.
+func (p *kubernetesProvisioner) lookupClusterController(clusterName string) (*clusterController, bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if c, ok := p.clusterControllers[cluster.Name]; ok {
-		c.stop()
+	c, ok := p.clusterControllers[clusterName]
+	return c, ok
+}
+
+// RestartClusterController replaces the controller of the cluster with a new
+// one, using the cluster configuration currently stored in tsuru. It's meant to
+// be used after the cluster credentials are rotated, controllers of other
+// clusters are not affected.
+func (p *kubernetesProvisioner) RestartClusterController(clusterName string) error {
+	clust, err := servicemanager.Cluster.FindByName(clusterName)
+	if err != nil {
+		return err
 	}
-	delete(p.clusterControllers, cluster.Name)
+	client, err := NewClusterClient(clust)
+	if err != nil {
+		return err
+	}
+	stopClusterController(p, client)
+	_, err = getClusterController(context.Background(), p, client)
+	return err
+}
+
+// RoutesRebuildBacklog returns the number of distinct apps with enqueued
+// routes rebuilds not yet started.
+func (p *kubernetesProvisioner) RoutesRebuildBacklog() int {
+	return rebuild.PendingRebuilds()
+}
+
+// ActiveClusterControllers returns the status of each running cluster
+// controller, including its sync state and how long it has been running,
+// sorted by cluster name. No controllers are started.
+func (p *kubernetesProvisioner) ActiveClusterControllers() []ClusterControllerStatus {
+	p.mu.Lock()
+	controllers := make([]*clusterController, 0, len(p.clusterControllers))
+	for _, c := range p.clusterControllers {
+		controllers = append(controllers, c)
+	}
+	p.mu.Unlock()
+	result := make([]ClusterControllerStatus, len(controllers))
+	for i, c := range controllers {
+		result[i] = c.status()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Cluster < result[j].Cluster
+	})
+	return result
+}
+
+// ResyncCluster re-runs the routes rebuild logic for every pod cached by the
+// running controller of the cluster, without waiting for the next resync
+// period.
+func (p *kubernetesProvisioner) ResyncCluster(clusterName string) error {
+	c, ok := p.lookupClusterController(clusterName)
+	if !ok {
+		return errors.Errorf("no controller running for cluster %q", clusterName)
+	}
+	return c.resync()
+}
+
+func (c *clusterController) resync() error {
+	podInformer, err := c.getPodInformer()
+	if err != nil {
+		return err
+	}
+	pods, err := podInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, pod := range pods {
+		c.addPod(pod, true, 0)
+	}
+	return nil
+}
+
+// ClusterAppPod is a summary of a tsuru app pod cached by a cluster
+// controller.
+type ClusterAppPod struct {
+	Name  string
+	App   string
+	Pool  string
+	Node  string
+	Ready bool
 }
 
+// ClusterAppPods returns the app pods cached by the running controller of the
+// cluster, sorted by app and pod name. Deploy and isolated run pods are not
+// included. No requests are made to the cluster API server.
+func (p *kubernetesProvisioner) ClusterAppPods(clusterName string) ([]ClusterAppPod, error) {
+	c, ok := p.lookupClusterController(clusterName)
+	if !ok {
+		return nil, errors.Errorf("no controller running for cluster %q", clusterName)
+	}
+	return c.appPods()
+}
+
+func (c *clusterController) appPods() ([]ClusterAppPod, error) {
+	podInformer, err := c.getPodInformer()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := podInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var result []ClusterAppPod
+	for _, pod := range pods {
+		labelSet := labelSetFromMeta(&pod.ObjectMeta)
+		appName := labelSet.AppName()
+		if appName == "" || labelSet.IsDeploy() || labelSet.IsIsolatedRun() {
+			continue
+		}
+		result = append(result, ClusterAppPod{
+			Name:  pod.Name,
+			App:   appName,
+			Pool:  labelSet.AppPool(),
+			Node:  pod.Spec.NodeName,
+			Ready: isPodReady(pod),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].App != result[j].App {
+			return result[i].App < result[j].App
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// ClusterAppRoutingTargets returns the IPs of the ready pods of each app cached
+// by the running controller of the cluster, sorted, allowing the routes seen
+// by the controller to be compared with the ones in the routers. Deploy and
+// isolated run pods are not included. No requests are made to the cluster API
+// server.
+func (p *kubernetesProvisioner) ClusterAppRoutingTargets(clusterName string) (map[string][]string, error) {
+	c, ok := p.lookupClusterController(clusterName)
+	if !ok {
+		return nil, errors.Errorf("no controller running for cluster %q", clusterName)
+	}
+	return c.appRoutingTargets()
+}
+
+func (c *clusterController) appRoutingTargets() (map[string][]string, error) {
+	podInformer, err := c.getPodInformer()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := podInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result := map[string][]string{}
+	for _, pod := range pods {
+		labelSet := labelSetFromMeta(&pod.ObjectMeta)
+		appName := labelSet.AppName()
+		if appName == "" || labelSet.IsDeploy() || labelSet.IsIsolatedRun() {
+			continue
+		}
+		if pod.Status.PodIP == "" || !isPodReady(pod) {
+			continue
+		}
+		result[appName] = append(result[appName], pod.Status.PodIP)
+	}
+	for _, ips := range result {
+		sort.Strings(ips)
+	}
+	return result, nil
+}
+
+// NamespaceForApp returns the namespace where the pods of the app are running,
+// as seen by the pod informer cache.
+func (c *clusterController) NamespaceForApp(appName string) (string, error) {
+	podInformer, err := c.getPodInformer()
+	if err != nil {
+		return "", err
+	}
+	selector := labels.SelectorFromSet(labels.Set{tsuruLabelPrefix + provision.LabelAppName: appName})
+	pods, err := podInformer.Lister().List(selector)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if len(pods) == 0 {
+		return "", errors.Errorf("no pods found for app %q", appName)
+	}
+	namespace := pods[0].Namespace
+	for _, pod := range pods[1:] {
+		if pod.Namespace != namespace {
+			return "", errors.Errorf("pods for app %q found in multiple namespaces: %q and %q", appName, namespace, pod.Namespace)
+		}
+	}
+	return namespace, nil
+}
+
+// stop stops the controller informers and pending timers. It's safe to call
+// stop more than once.
 func (c *clusterController) stop() {
-	close(c.stopCh)
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+		c.lbMu.Lock()
+		defer c.lbMu.Unlock()
+		for uid, timer := range c.pendingLBs {
+			timer.Stop()
+			delete(c.pendingLBs, uid)
+		}
+	})
 }
 
-func (c *clusterController) start() error {
-	informer, err := c.getPodInformerWait(false)
+// stopWithTimeout stops accepting new pod events and waits up to timeout for
+// the events already being handled to finish before stopping the informers.
+func (c *clusterController) stopWithTimeout(timeout time.Duration) {
+	c.eventsMu.Lock()
+	c.stopping = true
+	c.eventsMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		c.pendingEvents.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Errorf("[router-update-controller] timeout waiting for pending events on cluster %q", c.cluster.Name)
+	}
+	c.stop()
+}
+
+// handleEvent runs fn, handling an event of the given kind, e.g. update, for
+// the resource, e.g. pod, in one of the event workers of the controller, so
+// that slow events don't stall the informers. Without workers, the default, events
+// are handled synchronously and in order. With workers events may be handled
+// out of order, e.g. the delete of a pod before its last update.
+func (c *clusterController) handleEvent(resource, kind string, fn func() error) {
+	c.eventsMu.Lock()
+	if c.stopping || c.paused {
+		c.eventsMu.Unlock()
+		return
+	}
+	c.pendingEvents.Add(1)
+	c.eventsMu.Unlock()
+	pending := pendingEventsGauge.WithLabelValues(c.cluster.Name)
+	pending.Inc()
+	run := func() {
+		defer c.pendingEvents.Done()
+		defer pending.Dec()
+		err := fn()
+		if err != nil {
+			c.logEventError(resource, kind, err)
+		}
+	}
+	slots := c.eventSlots
+	if slots == nil {
+		run()
+		return
+	}
+	// Blocks the informer only when every worker is busy.
+	slots <- struct{}{}
+	go func() {
+		defer func() { <-slots }()
+		run()
+	}()
+}
+
+// logEventError logs the error returned by an event handler at the level
+// configured for the cluster, counting it regardless of the level.
+func (c *clusterController) logEventError(resource, kind string, err error) {
+	eventErrors.WithLabelValues(c.cluster.Name, resource, kind).Inc()
+	event := kind + " " + resource
+	if c.debugEventErrors {
+		log.Debugf("[router-update-controller] error on %s event: %v", event, err)
+		return
+	}
+	log.Errorf("[router-update-controller] error on %s event: %v", event, err)
+}
+
+// Pause stops handling informer events, e.g. during a planned maintenance of
+// the cluster API server, without stopping the informers. Events received
+// while paused are dropped and the informers are not restarted by the
+// watchdog.
+func (c *clusterController) Pause() {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	c.paused = true
+}
+
+// Resume handles informer events again after Pause, resyncing every cached
+// pod to rebuild the routes changed while paused.
+func (c *clusterController) Resume() error {
+	c.eventsMu.Lock()
+	wasPaused := c.paused
+	c.paused = false
+	c.eventsMu.Unlock()
+	if !wasPaused {
+		return nil
+	}
+	return c.resync()
+}
+
+func (c *clusterController) isPaused() bool {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	return c.paused
+}
+
+func (c *clusterController) start(ctx context.Context) error {
+	if c.eventSlots == nil {
+		workers, err := c.cluster.EventWorkers()
+		if err != nil {
+			return err
+		}
+		if workers > 1 {
+			c.eventSlots = make(chan struct{}, workers)
+		}
+	}
+	level, err := c.cluster.EventErrorsLogLevel()
+	if err != nil {
+		return err
+	}
+	c.debugEventErrors = level == "debug"
+	informer, err := c.startPodInformer()
 	if err != nil {
 		return err
 	}
+	_, err = c.getServiceInformerWait(false)
+	if err != nil {
+		return err
+	}
+	_, err = c.getNodeInformerWait(false)
+	if err != nil {
+		return err
+	}
+	err = c.startConfigMapInformer()
+	if err != nil {
+		return err
+	}
+	maxAge, err := c.cluster.PodCacheMaxAge()
+	if err != nil {
+		return err
+	}
+	go c.watchdog(informerWatchdogInterval, informerStallTimeout)
+	if maxAge > 0 {
+		go c.podCacheSweeper(maxAge)
+	}
+	err = c.waitForSync(ctx, "pods", informer.Informer())
+	c.setSyncStatus(err)
+	return err
+}
+
+func (c *clusterController) setSyncStatus(err error) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.lastErr = err
+	if err == nil {
+		c.lastSync = time.Now()
+	}
+}
+
+func (c *clusterController) status() ClusterControllerStatus {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	status := ClusterControllerStatus{
+		Cluster:   c.cluster.Name,
+		Synced:    c.podsSynced != nil && c.podsSynced(),
+		LastError: c.lastErr,
+		LastSync:  c.lastSync,
+	}
+	if !c.startedAt.IsZero() {
+		status.Uptime = time.Since(c.startedAt)
+	}
+	return status
+}
+
+func (c *clusterController) startPodInformer() (v1informers.PodInformer, error) {
+	informer, err := c.getPodInformerWait(false)
+	if err != nil {
+		return nil, err
+	}
 	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			err := c.onAdd(obj)
-			if err != nil {
-				log.Errorf("[router-update-controller] error on add pod event: %v", err)
-			}
+			c.handleEvent("pod", "add", func() error {
+				return c.onAdd(obj)
+			})
+			c.notifyPodWatchers()
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			err := c.onUpdate(oldObj, newObj)
-			if err != nil {
-				log.Errorf("[router-update-controller] error on update pod event: %v", err)
-			}
+			c.handleEvent("pod", "update", func() error {
+				return c.onUpdate(oldObj, newObj)
+			})
+			c.notifyPodWatchers()
 		},
 		DeleteFunc: func(obj interface{}) {
-			err := c.onDelete(obj)
-			if err != nil {
-				log.Errorf("[router-update-controller] error on delete pod event: %v", err)
-			}
+			c.handleEvent("pod", "delete", func() error {
+				return c.onDelete(obj)
+			})
+			c.notifyPodWatchers()
 		},
 	})
+	c.statusMu.Lock()
+	c.podsSynced = informer.Informer().HasSynced
+	c.statusMu.Unlock()
+	return informer, nil
+}
+
+// listWatchHealth tracks the list and watch calls of an informer, which are
+// retried by the informer on failures.
+type listWatchHealth struct {
+	mu           sync.Mutex
+	failingSince time.Time
+	lastErr      error
+}
+
+// record registers the result of a list or watch call.
+func (h *listWatchHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.failingSince = time.Time{}
+		h.lastErr = nil
+		return
+	}
+	if h.failingSince.IsZero() {
+		h.failingSince = time.Now()
+	}
+	h.lastErr = err
+}
+
+// failing returns the last error and when the calls started failing, or a nil
+// error if the last call succeeded.
+func (h *listWatchHealth) failing() (time.Time, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failingSince, h.lastErr
+}
+
+// watchdog periodically checks whether the pod informer is still able to list
+// and watch pods, recreating the informer factory if every call failed during
+// stallTimeout, which may happen after the connection with the API server is
+// lost. Informers not receiving events, e.g. on quiet clusters, are healthy.
+func (c *clusterController) watchdog(interval, stallTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var synced bool
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+		if c.isPaused() {
+			continue
+		}
+		informer, err := c.getPodInformerWait(false)
+		if err != nil {
+			log.Errorf("[router-update-controller] error getting pod informer for cluster %q: %v", c.cluster.Name, err)
+			continue
+		}
+		failingSince, failErr := c.podListWatch.failing()
+		if informer.Informer().HasSynced() {
+			synced = true
+			if failErr == nil {
+				c.setSyncStatus(nil)
+			}
+		} else if synced {
+			synced = false
+			c.setSyncStatus(errors.New("pod informer lost sync"))
+			c.informerDesynced()
+		}
+		if failErr == nil || time.Since(failingSince) < stallTimeout {
+			continue
+		}
+		log.Errorf("[router-update-controller] pod informer for cluster %q failing since %v, restarting informers: %v", c.cluster.Name, failingSince, failErr)
+		c.setSyncStatus(errors.Wrapf(failErr, "pod informer failing since %v", failingSince))
+		// The new informers start with a clean state, failing calls are
+		// recorded again if the restart doesn't help.
+		c.podListWatch.record(nil)
+		err = c.restartInformers()
+		if err != nil {
+			log.Errorf("[router-update-controller] error restarting informers for cluster %q: %v", c.cluster.Name, err)
+			c.setSyncStatus(err)
+		}
+		synced = false
+	}
+}
+
+func (c *clusterController) informerDesynced() {
+	c.hooksMu.RLock()
+	handler := c.desyncHandler
+	c.hooksMu.RUnlock()
+	if handler == nil {
+		log.Errorf("[router-update-controller] pod informer for cluster %q lost sync", c.cluster.Name)
+		return
+	}
+	handler(c.cluster.Name)
+}
+
+// SetInformerDesyncHandler sets a function called with the cluster name every
+// time the pod informer of a running cluster controller loses sync after
+// having been synced. A nil handler restores the default behavior of logging
+// the error.
+func (p *kubernetesProvisioner) SetInformerDesyncHandler(handler func(cluster string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.desyncHandler = handler
+	for _, c := range p.clusterControllers {
+		c.hooksMu.Lock()
+		c.desyncHandler = handler
+		c.hooksMu.Unlock()
+	}
+}
+
+// DeployPodHandler is called when a build or deploy pod of an app finishes,
+// with the ID of the deploy event that created the pod, if known, and a nil
+// error if the pod succeeded.
+type DeployPodHandler func(appName, eventID, podName string, err error)
+
+// SetDeployPodHandler sets a function called every time a build or deploy pod
+// watched by a running cluster controller reaches the Succeeded or Failed
+// phase. These pods are identified by the app build labels.
+func (p *kubernetesProvisioner) SetDeployPodHandler(handler DeployPodHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deployPodHandler = handler
+	for _, c := range p.clusterControllers {
+		c.hooksMu.Lock()
+		c.deployPodHandler = handler
+		c.hooksMu.Unlock()
+	}
+}
+
+// checkDeployFinished calls the deploy pod handler if newPod is a build or
+// deploy pod which has just finished. A nil oldPod means the previous state of
+// the pod is unknown.
+func (c *clusterController) checkDeployFinished(oldPod, newPod *apiv1.Pod) {
+	labelSet := labelSetFromMeta(&newPod.ObjectMeta)
+	appName := labelSet.AppName()
+	if appName == "" || !labelSet.IsBuild() {
+		return
+	}
+	if oldPod != nil {
+		if finished, _ := deployPodFinished(oldPod); finished {
+			return
+		}
+	}
+	finished, deployErr := deployPodFinished(newPod)
+	if !finished {
+		return
+	}
+	eventID := newPod.Annotations[tsuruEventIDMeta]
+	c.hooksMu.RLock()
+	handler := c.deployPodHandler
+	c.hooksMu.RUnlock()
+	if handler == nil {
+		log.Debugf("[router-update-controller] deploy pod %q for app %q, event %q, finished: %v", newPod.Name, appName, eventID, deployErr)
+		return
+	}
+	handler(appName, eventID, newPod.Name, deployErr)
+}
+
+// deployPodFinished returns whether the pod has either succeeded or failed,
+// returning an error with the failure reason in the latter case.
+func deployPodFinished(pod *apiv1.Pod) (bool, error) {
+	switch pod.Status.Phase {
+	case apiv1.PodSucceeded:
+		return true, nil
+	case apiv1.PodFailed:
+		return true, errors.Errorf("deploy pod %q failed: %s: %s", pod.Name, pod.Status.Reason, pod.Status.Message)
+	}
+	return false, nil
+}
+
+// onConfigMapChange enqueues a routes rebuild for the app of a ConfigMap
+// labeled with the tsuru app name, as the app routers may read their
+// configuration from it. Adds are ignored, otherwise every ConfigMap would
+// trigger a rebuild when the informers start.
+func (c *clusterController) onConfigMapChange(oldObj, newObj interface{}) error {
+	oldCM, ok := oldObj.(*apiv1.ConfigMap)
+	if !ok {
+		return errors.Errorf("object is not a configmap: %#v", oldObj)
+	}
+	newCM, ok := newObj.(*apiv1.ConfigMap)
+	if !ok {
+		return errors.Errorf("object is not a configmap: %#v", newObj)
+	}
+	if newCM.ResourceVersion == oldCM.ResourceVersion {
+		return nil
+	}
+	c.enqueueConfigMapRebuild(newCM)
 	return nil
 }
 
+func (c *clusterController) onConfigMapDelete(obj interface{}) error {
+	cm, ok := obj.(*apiv1.ConfigMap)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return errors.Errorf("couldn't get object from tombstone %#v", obj)
+		}
+		cm, ok = tombstone.Obj.(*apiv1.ConfigMap)
+		if !ok {
+			return errors.Errorf("tombstone contained object that is not a ConfigMap: %#v", obj)
+		}
+	}
+	c.enqueueConfigMapRebuild(cm)
+	return nil
+}
+
+func (c *clusterController) enqueueConfigMapRebuild(cm *apiv1.ConfigMap) {
+	if c.isNamespaceExcluded(cm.Namespace) {
+		return
+	}
+	labelSet := labelSetFromMeta(&cm.ObjectMeta)
+	if labelSet.AppName() == "" {
+		return
+	}
+	// Configuration changes must not be skipped as trailing events.
+	c.enqueueRebuild(labelSet, true, 0)
+}
+
+// ContainerRestartHandler is called when containers of an app pod restart,
+// with the number of restarts since the last pod update.
+type ContainerRestartHandler func(appName, podName, containerName string, restartDelta int32)
+
+// SetContainerRestartHandler sets a function called every time the restart
+// count of a container from an app pod watched by a running cluster
+// controller increases, allowing crash looping units to be detected.
+func (p *kubernetesProvisioner) SetContainerRestartHandler(handler ContainerRestartHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.restartHandler = handler
+	for _, c := range p.clusterControllers {
+		c.hooksMu.Lock()
+		c.restartHandler = handler
+		c.hooksMu.Unlock()
+	}
+}
+
+func (c *clusterController) checkContainerRestarts(oldPod, newPod *apiv1.Pod) {
+	c.hooksMu.RLock()
+	handler := c.restartHandler
+	c.hooksMu.RUnlock()
+	if handler == nil {
+		return
+	}
+	labelSet := labelSetFromMeta(&newPod.ObjectMeta)
+	appName := labelSet.AppName()
+	if appName == "" || labelSet.IsDeploy() || labelSet.IsIsolatedRun() {
+		return
+	}
+	oldRestarts := make(map[string]int32, len(oldPod.Status.ContainerStatuses))
+	for _, status := range oldPod.Status.ContainerStatuses {
+		oldRestarts[status.Name] = status.RestartCount
+	}
+	for _, status := range newPod.Status.ContainerStatuses {
+		delta := status.RestartCount - oldRestarts[status.Name]
+		if delta > 0 {
+			handler(appName, newPod.Name, status.Name, delta)
+		}
+	}
+}
+
+func (c *clusterController) podCacheSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+		err := c.sweepPodCache()
+		if err != nil {
+			log.Errorf("[router-update-controller] error checking pod cache for cluster %q: %v", c.cluster.Name, err)
+		}
+	}
+}
+
+// sweepPodCache compares the cached pods with a fresh list from the cluster,
+// guarding against ghost entries left by delete events missed during API
+// disruptions. Discrepancies are logged and counted and, if configured, the
+// informers are restarted to relist the pods.
+func (c *clusterController) sweepPodCache() error {
+	stale, missing, err := c.podCacheDiff()
+	if err != nil {
+		return err
+	}
+	if len(stale) == 0 && len(missing) == 0 {
+		return nil
+	}
+	podCacheDiscrepancies.WithLabelValues(c.cluster.Name, "stale").Add(float64(len(stale)))
+	podCacheDiscrepancies.WithLabelValues(c.cluster.Name, "missing").Add(float64(len(missing)))
+	log.Errorf("[router-update-controller] pod cache for cluster %q has stale pods %v and missing pods %v", c.cluster.Name, stale, missing)
+	relist, err := c.cluster.PodCacheRelist()
+	if err != nil || !relist {
+		return err
+	}
+	return c.restartInformers()
+}
+
+// podCacheDiff returns the keys of the cached pods not found in a fresh list
+// from the cluster and of the listed pods not found in the cache. Pods are
+// checked again in the cache after listing, so that pods added or removed
+// while listing are not reported.
+func (c *clusterController) podCacheDiff() (stale, missing []string, err error) {
+	informer, err := c.getPodInformerWait(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	cached, err := informer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	listed, err := c.listPods()
+	if err != nil {
+		return nil, nil, err
+	}
+	listedUIDs := make(map[types.UID]struct{}, len(listed))
+	for _, pod := range listed {
+		listedUIDs[pod.UID] = struct{}{}
+	}
+	for _, pod := range cached {
+		if _, ok := listedUIDs[pod.UID]; ok {
+			continue
+		}
+		current, errGet := informer.Lister().Pods(pod.Namespace).Get(pod.Name)
+		if errGet == nil && current.UID == pod.UID {
+			stale = append(stale, pod.Namespace+"/"+pod.Name)
+		}
+	}
+	for _, pod := range listed {
+		current, errGet := informer.Lister().Pods(pod.Namespace).Get(pod.Name)
+		if errGet != nil || current.UID != pod.UID {
+			missing = append(missing, pod.Namespace+"/"+pod.Name)
+		}
+	}
+	sort.Strings(stale)
+	sort.Strings(missing)
+	return stale, missing, nil
+}
+
+// listPods lists the pods from the cluster using the same namespaces and
+// selectors used by the pod informer.
+func (c *clusterController) listPods() ([]apiv1.Pod, error) {
+	appPodsOnly, err := c.cluster.InformerAppPodsOnly()
+	if err != nil {
+		return nil, err
+	}
+	activePodsOnly, err := c.cluster.InformerActivePodsOnly()
+	if err != nil {
+		return nil, err
+	}
+	var opts metav1.ListOptions
+	if appPodsOnly {
+		opts.LabelSelector = tsuruLabelPrefix + provision.LabelAppName
+	}
+	if activePodsOnly {
+		opts.FieldSelector = activePodsFieldSelector
+	}
+	namespaces := c.cluster.InformerNamespaces()
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	var pods []apiv1.Pod
+	for _, ns := range namespaces {
+		list, err := c.cluster.CoreV1().Pods(ns).List(opts)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pods = append(pods, list.Items...)
+	}
+	return pods, nil
+}
+
+func (c *clusterController) restartInformers() error {
+	c.mu.Lock()
+	if c.stopFactory != nil {
+		c.stopFactory()
+	}
+	c.informerFactory = nil
+	c.podInformer = nil
+	c.serviceInformer = nil
+	c.nodeInformer = nil
+	c.configMapInformer = nil
+	c.mu.Unlock()
+	_, err := c.startPodInformer()
+	if err != nil {
+		return err
+	}
+	_, err = c.getServiceInformerWait(false)
+	if err != nil {
+		return err
+	}
+	_, err = c.getNodeInformerWait(false)
+	if err != nil {
+		return err
+	}
+	return c.startConfigMapInformer()
+}
+
 func (c *clusterController) onAdd(obj interface{}) error {
-	// Pods are never ready on add, ignore and do nothing
+	pod, err := podFromObj(obj)
+	if err != nil {
+		return err
+	}
+	// New pods are never ready on add, but pods already running when the
+	// informers start, or relist after a restart, are delivered as adds. The
+	// phase is checked as pods without any status are considered ready.
+	if pod.Status.Phase != apiv1.PodRunning || !isPodReady(pod) {
+		return nil
+	}
+	c.addPod(pod, false, 0)
 	return nil
 }
 
 func (c *clusterController) onUpdate(oldObj, newObj interface{}) error {
-	newPod := oldObj.(*apiv1.Pod)
-	oldPod := newObj.(*apiv1.Pod)
+	oldPod, err := podFromObj(oldObj)
+	if err != nil {
+		return err
+	}
+	newPod, err := podFromObj(newObj)
+	if err != nil {
+		return err
+	}
 	if newPod.ResourceVersion == oldPod.ResourceVersion {
 		return nil
 	}
-	c.addPod(newPod)
+	c.checkContainerRestarts(oldPod, newPod)
+	c.checkDeployFinished(oldPod, newPod)
+	// Pods moved to another node may have a new address even if they remain
+	// ready, their routes must be rebuilt as when readiness changes.
+	readinessChanged := isPodReady(oldPod) != isPodReady(newPod)
+	nodeChanged := oldPod.Spec.NodeName != newPod.Spec.NodeName
+	if !readinessChanged && !nodeChanged {
+		return nil
+	}
+	c.addPod(newPod, true, 0)
 	return nil
 }
 
 func (c *clusterController) onDelete(obj interface{}) error {
-	if pod, ok := obj.(*apiv1.Pod); ok {
-		c.addPod(pod)
+	pod, err := podFromObj(obj)
+	if err != nil {
+		return err
+	}
+	// Informers watching only active pods get finished pods as deletes.
+	if activeOnly, _ := c.cluster.InformerActivePodsOnly(); activeOnly {
+		c.checkDeployFinished(nil, pod)
+	}
+	// Only ready pods are in the app routes, removing a pod that was not
+	// ready doesn't change them, so the rebuild is not forced and is skipped
+	// if the app routes were recently rebuilt.
+	if !isPodReady(pod) {
+		c.addPod(pod, false, 0)
+		return nil
+	}
+	// The endpoints of a deleted pod may linger until it terminates, the
+	// rebuild is delayed so that routes don't point to a dying pod.
+	delay, err := c.cluster.DeleteRebuildDelay()
+	if err != nil {
+		return err
+	}
+	if grace := pod.Spec.TerminationGracePeriodSeconds; grace != nil {
+		if maxDelay := time.Duration(*grace) * time.Second; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	c.deletePod(pod, true, delay)
+	return nil
+}
+
+// onNodeDelete removes the tsuru data of nodes deleted from the cluster.
+func (c *clusterController) onNodeDelete(obj interface{}) error {
+	node, ok := obj.(*apiv1.Node)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return errors.Errorf("couldn't get object from tombstone %#v", obj)
+		}
+		node, ok = tombstone.Obj.(*apiv1.Node)
+		if !ok {
+			return errors.Errorf("tombstone contained object that is not a Node: %#v", obj)
+		}
+	}
+	nodeWrapper := &kubernetesNodeWrapper{node: node, cluster: c.cluster}
+	if nodeWrapper.Pool() == "" {
 		return nil
 	}
+	err := removeNodeData(nodeWrapper)
+	if err != nil {
+		return errors.Wrapf(err, "unable to remove data for deleted node %q", node.Name)
+	}
+	return nil
+}
+
+func podFromObj(obj interface{}) (*apiv1.Pod, error) {
+	if pod, ok := obj.(*apiv1.Pod); ok {
+		return pod, nil
+	}
 	tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
 	if !ok {
-		return errors.Errorf("couldn't get object from tombstone %#v", obj)
+		return nil, errors.Errorf("couldn't get object from tombstone %#v", obj)
 	}
 	pod, ok := tombstone.Obj.(*apiv1.Pod)
 	if !ok {
-		return errors.Errorf("tombstone contained object that is not a Pod: %#v", obj)
+		return nil, errors.Errorf("tombstone contained object that is not a Pod: %#v", obj)
+	}
+	return pod, nil
+}
+
+// addPod enqueues a routes rebuild for the app of the pod, to run after the
+// delay. Unless the pod readiness changed, the rebuild is skipped if the app
+// routes were recently rebuilt. Pods from high priority apps have their
+// rebuilds processed first.
+func (c *clusterController) addPod(pod *apiv1.Pod, readinessChanged bool, delay time.Duration) {
+	labelSet := c.rebuildLabelSet(pod)
+	if labelSet != nil && c.shouldRebuild(labelSet) {
+		c.enqueueRebuild(labelSet, readinessChanged, delay)
+	}
+}
+
+// deletePod is like addPod for deleted ready pods. Apps using one of the
+// router types configured in delete-rebuild-router-types have their routes
+// rebuilt even when the rebuild decider, e.g. with router-local disabled,
+// says no.
+func (c *clusterController) deletePod(pod *apiv1.Pod, readinessChanged bool, delay time.Duration) {
+	labelSet := c.rebuildLabelSet(pod)
+	if labelSet != nil && (c.rebuildsOnDelete(labelSet) || c.shouldRebuild(labelSet)) {
+		c.enqueueRebuild(labelSet, readinessChanged, delay)
+	}
+}
+
+// rebuildLabelSet returns the labels of the pod if its app may have routes
+// rebuilt, or nil for pods that must be ignored.
+func (c *clusterController) rebuildLabelSet(pod *apiv1.Pod) *provision.LabelSet {
+	if c.isNamespaceExcluded(pod.Namespace) {
+		return nil
+	}
+	labelSet := labelSetFromMeta(&pod.ObjectMeta)
+	appName := labelSet.AppName()
+	if appName == "" {
+		// Pods from tsuru apps having their labels removed, e.g. by mutating
+		// webhooks, would never have their routes rebuilt.
+		unlabeledPodsSkipped.WithLabelValues(c.cluster.Name, pod.Namespace).Inc()
+		log.Debugf("[router-update-controller] skipping routes rebuild for pod %q in namespace %q: no app name label", pod.Name, pod.Namespace)
+		return nil
+	}
+	if labelSet.IsDeploy() || labelSet.IsIsolatedRun() {
+		reason := "deploy"
+		if labelSet.IsIsolatedRun() {
+			reason = "isolated run"
+		}
+		log.Debugf("[router-update-controller] skipping routes rebuild for app %q: pod %q is a %s pod", appName, pod.Name, reason)
+		return nil
+	}
+	if err := validateAppLabels(&pod.ObjectMeta); err != nil {
+		log.Debugf("[router-update-controller] skipping routes rebuild for pod %q in namespace %q: %v", pod.Name, pod.Namespace, err)
+		return nil
+	}
+	if !c.isPoolMonitored(labelSet.AppPool()) {
+		return nil
+	}
+	return labelSet
+}
+
+func (c *clusterController) enqueueRebuild(labelSet *provision.LabelSet, readinessChanged bool, delay time.Duration) {
+	appName := labelSet.AppName()
+	routesRebuildEnqueued.WithLabelValues(c.cluster.Name, appName).Inc()
+	rebuild.EnqueueRoutesRebuildOpts(appName, rebuild.EnqueueOpts{
+		Delay:        delay,
+		Debounce:     true,
+		UnlessRecent: !readinessChanged,
+		Priority:     c.rebuildPriority(labelSet),
+	})
+}
+
+// validateAppLabels checks that the tsuru labels of a pod don't collide with
+// its annotations. Sidecars injected by service meshes may add annotations
+// colliding with the tsuru labels, which must not trigger routes rebuilds.
+func validateAppLabels(meta *metav1.ObjectMeta) error {
+	for k, v := range meta.Annotations {
+		if !strings.HasPrefix(k, tsuruLabelPrefix) {
+			continue
+		}
+		if labelValue, ok := meta.Labels[k]; ok && labelValue != v {
+			return errors.Errorf("conflicting values for %s in labels and annotations: %q and %q", k, labelValue, v)
+		}
+	}
+	return nil
+}
+
+// rebuildsOnDelete returns whether the pod uses a router type whose routes
+// must be rebuilt on pod deletion.
+func (c *clusterController) rebuildsOnDelete(labelSet *provision.LabelSet) bool {
+	types := c.cluster.DeleteRebuildRouterTypes()
+	if len(types) == 0 {
+		return false
+	}
+	for _, routerType := range labelSet.RouterTypes() {
+		for _, t := range types {
+			if routerType == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shouldRebuild asks the rebuild decider whether the routes of the app must
+// be rebuilt after a change in one of its pods. Apps being moved between
+// pools may have pods in more than one pool and their routes include all of
+// them, so the pools of the other cached pods of the app are considered as
+// well.
+func (c *clusterController) shouldRebuild(labelSet *provision.LabelSet) bool {
+	decider := c.getRebuildDecider()
+	if decider.ShouldRebuild(labelSet, c.cluster) {
+		return true
+	}
+	for _, poolLabelSet := range c.otherPoolsLabelSets(labelSet) {
+		if decider.ShouldRebuild(poolLabelSet, c.cluster) {
+			return true
+		}
+	}
+	return false
+}
+
+// otherPoolsLabelSets returns the labels of a cached pod from each pool, other
+// than the one in labelSet, with pods from the same app.
+func (c *clusterController) otherPoolsLabelSets(labelSet *provision.LabelSet) []*provision.LabelSet {
+	c.mu.Lock()
+	informer := c.podInformer
+	c.mu.Unlock()
+	if informer == nil {
+		return nil
+	}
+	pods, err := cachedAppPods(informer, labelSet.AppName())
+	if err != nil {
+		log.Errorf("[router-update-controller] error listing pods for app %q: %v", labelSet.AppName(), err)
+		return nil
+	}
+	pools := map[string]struct{}{labelSet.AppPool(): {}}
+	var result []*provision.LabelSet
+	for _, pod := range pods {
+		podLabelSet := labelSetFromMeta(&pod.ObjectMeta)
+		if podLabelSet.IsDeploy() || podLabelSet.IsIsolatedRun() {
+			continue
+		}
+		if _, ok := pools[podLabelSet.AppPool()]; ok {
+			continue
+		}
+		pools[podLabelSet.AppPool()] = struct{}{}
+		result = append(result, podLabelSet)
+	}
+	return result
+}
+
+// cachedAppPods returns the cached pods of the app, using the app name index
+// when the informer has it.
+func cachedAppPods(informer v1informers.PodInformer, appName string) ([]*apiv1.Pod, error) {
+	indexer := informer.Informer().GetIndexer()
+	if _, ok := indexer.GetIndexers()[appNameIndex]; !ok {
+		selector := labels.SelectorFromSet(labels.Set{
+			tsuruLabelPrefix + provision.LabelAppName: appName,
+		})
+		return informer.Lister().List(selector)
+	}
+	objs, err := indexer.ByIndex(appNameIndex, appName)
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]*apiv1.Pod, 0, len(objs))
+	for _, obj := range objs {
+		if pod, ok := obj.(*apiv1.Pod); ok {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// appNameIndexFunc indexes pods by the app name label, pods without it are
+// not indexed.
+func appNameIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*apiv1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	appName := pod.Labels[tsuruLabelPrefix+provision.LabelAppName]
+	if appName == "" {
+		return nil, nil
+	}
+	return []string{appName}, nil
+}
+
+// rebuildPriority returns the priority of the routes rebuild of the app, set
+// by the tsuru.io/rebuild-priority annotation or by the high priority pools of
+// the cluster.
+func (c *clusterController) rebuildPriority(labelSet *provision.LabelSet) rebuild.Priority {
+	if value, ok := labelSet.Labels[tsuruRebuildPriorityMeta]; ok {
+		switch value {
+		case "high":
+			return rebuild.PriorityHigh
+		case "normal":
+			return rebuild.PriorityNormal
+		}
+		log.Errorf("[router-update-controller] invalid %s annotation on pod from app %s: %q", tsuruRebuildPriorityMeta, labelSet.AppName(), value)
+	}
+	pool := labelSet.AppPool()
+	for _, p := range c.cluster.HighPriorityPools() {
+		if p == pool {
+			return rebuild.PriorityHigh
+		}
+	}
+	return rebuild.PriorityNormal
+}
+
+func (c *clusterController) isNamespaceExcluded(namespace string) bool {
+	for _, ns := range c.cluster.ExcludedNamespaces() {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// isPoolMonitored reports whether pods from apps in the pool may trigger
+// routes rebuilds, according to the monitored pools of the cluster.
+func (c *clusterController) isPoolMonitored(pool string) bool {
+	pools := c.cluster.MonitoredPools()
+	if len(pools) == 0 {
+		return true
+	}
+	for _, p := range pools {
+		if p == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// RebuildDecider decides whether the routes of an app must be rebuilt when
+// the readiness of one of its pods changes. The labelSet contains both the
+// labels and the annotations of the pod.
+type RebuildDecider interface {
+	ShouldRebuild(labelSet *provision.LabelSet, cluster *ClusterClient) bool
+}
+
+// routerLocalDecider is the default RebuildDecider, rebuilding routes only
+// when router-local is enabled for the app pool, unless overridden by the
+// tsuru.io/router-local pod annotation.
+type routerLocalDecider struct{}
+
+func (routerLocalDecider) ShouldRebuild(labelSet *provision.LabelSet, cluster *ClusterClient) bool {
+	routerLocal, _ := cluster.RouterAddressLocal(labelSet.AppPool())
+	if override, ok := labelSet.Labels[tsuruRouterLocalMeta]; ok {
+		value, err := strconv.ParseBool(override)
+		if err != nil {
+			log.Errorf("[router-update-controller] invalid %s annotation on pod from app %s: %v", tsuruRouterLocalMeta, labelSet.AppName(), err)
+		} else {
+			routerLocal = value
+		}
+	}
+	return routerLocal
+}
+
+func (c *clusterController) getRebuildDecider() RebuildDecider {
+	c.hooksMu.RLock()
+	defer c.hooksMu.RUnlock()
+	if c.rebuildDecider == nil {
+		return routerLocalDecider{}
+	}
+	return c.rebuildDecider
+}
+
+func (c *clusterController) setRebuildDecider(decider RebuildDecider) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.rebuildDecider = decider
+}
+
+// SetRebuildDecider replaces the logic used by the cluster controllers to
+// decide whether app routes must be rebuilt on pod changes. A nil decider
+// restores the default behavior.
+func (p *kubernetesProvisioner) SetRebuildDecider(decider RebuildDecider) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rebuildDecider = decider
+	for _, c := range p.clusterControllers {
+		c.setRebuildDecider(decider)
+	}
+}
+
+// waitForReadyPods blocks until at least count pods from the app in the
+// namespace are ready, using the pod informer cache instead of polling the API
+// server. The cache is checked again every time a pod event is received.
+func (c *clusterController) waitForReadyPods(ctx context.Context, namespace, appName string, count int) error {
+	informer, err := c.getPodInformer()
+	if err != nil {
+		return err
+	}
+	notifyCh := make(chan struct{}, 1)
+	c.podWatchersMu.Lock()
+	if c.podWatchers == nil {
+		c.podWatchers = map[chan struct{}]struct{}{}
+	}
+	c.podWatchers[notifyCh] = struct{}{}
+	c.podWatchersMu.Unlock()
+	defer func() {
+		c.podWatchersMu.Lock()
+		delete(c.podWatchers, notifyCh)
+		c.podWatchersMu.Unlock()
+	}()
+	selector := labels.SelectorFromSet(labels.Set{tsuruLabelPrefix + provision.LabelAppName: appName})
+	for {
+		pods, err := informer.Lister().Pods(namespace).List(selector)
+		if err != nil {
+			return err
+		}
+		var ready int
+		for _, pod := range pods {
+			if pod.DeletionTimestamp == nil && isPodReady(pod) {
+				ready++
+			}
+		}
+		if ready >= count {
+			return nil
+		}
+		select {
+		case <-notifyCh:
+		case <-c.stopCh:
+			return ErrControllerStopped
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "error waiting for %d ready pods for app %q, %d ready", count, appName, ready)
+		}
 	}
-	c.addPod(pod)
-	return nil
 }
 
-func (c *clusterController) addPod(pod *apiv1.Pod) {
-	labelSet := labelSetFromMeta(&pod.ObjectMeta)
-	appName := labelSet.AppName()
-	if appName == "" {
-		return
-	}
-	if labelSet.IsDeploy() || labelSet.IsIsolatedRun() {
-		return
-	}
-	routerLocal, _ := c.cluster.RouterAddressLocal(labelSet.AppPool())
-	if routerLocal {
-		rebuild.EnqueueRoutesRebuild(appName)
+func (c *clusterController) notifyPodWatchers() {
+	c.podWatchersMu.Lock()
+	defer c.podWatchersMu.Unlock()
+	for ch := range c.podWatchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
 	}
 }
 
@@ -152,37 +1560,119 @@ func (c *clusterController) getPodInformer() (v1informers.PodInformer, error) {
 }
 
 func (c *clusterController) getServiceInformer() (v1informers.ServiceInformer, error) {
+	return c.getServiceInformerWait(true)
+}
+
+func (c *clusterController) getServiceInformerWait(wait bool) (v1informers.ServiceInformer, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.serviceInformer == nil {
 		err := c.withInformerFactory(func(factory informers.SharedInformerFactory) {
 			c.serviceInformer = factory.Core().V1().Services()
-			c.serviceInformer.Informer()
+			c.serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc: func(obj interface{}) {
+					c.handleEvent("service", "add", func() error {
+						c.onServiceChange(obj)
+						return nil
+					})
+				},
+				UpdateFunc: func(oldObj, newObj interface{}) {
+					c.handleEvent("service", "update", func() error {
+						c.onServiceChange(newObj)
+						return nil
+					})
+				},
+				DeleteFunc: func(obj interface{}) {
+					c.handleEvent("service", "delete", func() error {
+						c.onServiceDelete(obj)
+						return nil
+					})
+				},
+			})
 		})
 		if err != nil {
 			return nil, err
 		}
 	}
-	err := c.waitForSync(c.serviceInformer.Informer())
+	var err error
+	if wait {
+		err = c.waitForSync(context.Background(), "services", c.serviceInformer.Informer())
+	}
 	return c.serviceInformer, err
 }
 
 func (c *clusterController) getNodeInformer() (v1informers.NodeInformer, error) {
+	return c.getNodeInformerWait(true)
+}
+
+func (c *clusterController) getNodeInformerWait(wait bool) (v1informers.NodeInformer, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.nodeInformer == nil {
 		err := c.withInformerFactory(func(factory informers.SharedInformerFactory) {
 			c.nodeInformer = factory.Core().V1().Nodes()
-			c.nodeInformer.Informer()
+			c.nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+				DeleteFunc: func(obj interface{}) {
+					c.handleEvent("node", "delete", func() error {
+						return c.onNodeDelete(obj)
+					})
+				},
+			})
 		})
 		if err != nil {
 			return nil, err
 		}
 	}
-	err := c.waitForSync(c.nodeInformer.Informer())
+	var err error
+	if wait {
+		err = c.waitForSync(context.Background(), "nodes", c.nodeInformer.Informer())
+	}
 	return c.nodeInformer, err
 }
 
+func (c *clusterController) startConfigMapInformer() error {
+	enabled, err := c.cluster.ConfigMapRebuild()
+	if err != nil || !enabled {
+		return err
+	}
+	_, err = c.getConfigMapInformerWait(false)
+	return err
+}
+
+func (c *clusterController) getConfigMapInformer() (v1informers.ConfigMapInformer, error) {
+	return c.getConfigMapInformerWait(true)
+}
+
+func (c *clusterController) getConfigMapInformerWait(wait bool) (v1informers.ConfigMapInformer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.configMapInformer == nil {
+		err := c.withInformerFactory(func(factory informers.SharedInformerFactory) {
+			c.configMapInformer = factory.Core().V1().ConfigMaps()
+			c.configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+				UpdateFunc: func(oldObj, newObj interface{}) {
+					c.handleEvent("configmap", "update", func() error {
+						return c.onConfigMapChange(oldObj, newObj)
+					})
+				},
+				DeleteFunc: func(obj interface{}) {
+					c.handleEvent("configmap", "delete", func() error {
+						return c.onConfigMapDelete(obj)
+					})
+				},
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if wait {
+		err = c.waitForSync(context.Background(), "configmaps", c.configMapInformer.Informer())
+	}
+	return c.configMapInformer, err
+}
+
 func (c *clusterController) getPodInformerWait(wait bool) (v1informers.PodInformer, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -197,7 +1687,7 @@ func (c *clusterController) getPodInformerWait(wait bool) (v1informers.PodInform
 	}
 	var err error
 	if wait {
-		err = c.waitForSync(c.podInformer.Informer())
+		err = c.waitForSync(context.Background(), "pods", c.podInformer.Informer())
 	}
 	return c.podInformer, err
 }
@@ -208,7 +1698,7 @@ func (c *clusterController) withInformerFactory(fn func(factory informers.Shared
 		return err
 	}
 	fn(factory)
-	factory.Start(c.stopCh)
+	factory.Start(c.factoryStopCh)
 	return nil
 }
 
@@ -216,9 +1706,22 @@ func (c *clusterController) getFactory() (informers.SharedInformerFactory, error
 	if c.informerFactory != nil {
 		return c.informerFactory, nil
 	}
-	var err error
-	c.informerFactory, err = InformerFactory(c.cluster)
-	return c.informerFactory, err
+	factory, err := InformerFactory(c.cluster, WithPodListWatchReporter(c.podListWatch.record))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	c.informerFactory = factory
+	c.factoryStopCh = ctx.Done()
+	c.stopFactory = cancel
+	return factory, nil
 }
 
 func contextWithCancelByChannel(ctx context.Context, ch chan struct{}, timeout time.Duration) (context.Context, func()) {
@@ -234,21 +1737,384 @@ func contextWithCancelByChannel(ctx context.Context, ch chan struct{}, timeout t
 	return ctx, cancel
 }
 
-func (c *clusterController) waitForSync(informer cache.SharedInformer) error {
+// waitForSync waits for the initial sync of the informer, recording the time
+// spent in the informerSyncDuration metric labeled by the informer kind. Each
+// attempt waits up to the cluster informer sync timeout, attempts timing out
+// are retried with an exponential backoff, up to the configured
+// kubernetes:informer-sync-attempts.
+func (c *clusterController) waitForSync(ctx context.Context, kind string, informer cache.SharedInformer) error {
 	if informer.HasSynced() {
 		return nil
 	}
-	ctx, cancel := contextWithCancelByChannel(context.Background(), c.stopCh, informerSyncTimeout)
+	timeout, err := c.cluster.InformerSyncTimeout()
+	if err != nil {
+		return err
+	}
+	attempts := getKubeConfig().InformerSyncAttempts
+	backoff := informerSyncBackoff
+	for attempt := 1; ; attempt++ {
+		err = c.waitForSyncOnce(ctx, kind, informer, timeout)
+		if err != ErrInformerSyncTimeout || ctx.Err() != nil || attempt >= attempts {
+			return err
+		}
+		log.Errorf("[router-update-controller] %s informer for cluster %q not synced after attempt %d/%d, retrying in %v", kind, c.cluster.Name, attempt, attempts, backoff)
+		select {
+		case <-c.stopCh:
+			return ErrControllerStopped
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return ErrInformerSyncTimeout
+			}
+			return errors.Wrap(ctx.Err(), "error waiting for informer sync")
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *clusterController) waitForSyncOnce(ctx context.Context, kind string, informer cache.SharedInformer, timeout time.Duration) error {
+	ctx, cancel := contextWithCancelByChannel(ctx, c.stopCh, timeout)
 	defer cancel()
-	cache.WaitForCacheSync(ctx.Done(), informer.HasSynced)
-	return errors.Wrap(ctx.Err(), "error waiting for informer sync")
+	t0 := time.Now()
+	synced := waitForCacheSync(ctx.Done(), informer.HasSynced)
+	informerSyncDuration.WithLabelValues(c.cluster.Name, kind).Observe(time.Since(t0).Seconds())
+	if synced {
+		return nil
+	}
+	select {
+	case <-c.stopCh:
+		return ErrControllerStopped
+	default:
+	}
+	if ctx.Err() == context.Canceled {
+		return errors.Wrap(ctx.Err(), "error waiting for informer sync")
+	}
+	return ErrInformerSyncTimeout
+}
+
+// onServiceChange tracks LoadBalancer services without an external address,
+// calling onStuckLoadBalancer if they remain pending for longer than
+// loadBalancerPendingThreshold.
+func (c *clusterController) onServiceChange(obj interface{}) {
+	svc, ok := obj.(*apiv1.Service)
+	if !ok {
+		return
+	}
+	if !isLoadBalancerPending(svc) {
+		c.untrackLoadBalancer(svc.UID)
+		return
+	}
+	c.lbMu.Lock()
+	defer c.lbMu.Unlock()
+	if _, ok := c.pendingLBs[svc.UID]; ok {
+		return
+	}
+	if c.pendingLBs == nil {
+		c.pendingLBs = map[types.UID]*time.Timer{}
+	}
+	remaining := loadBalancerPendingThreshold - time.Since(svc.CreationTimestamp.Time)
+	namespace, name, uid := svc.Namespace, svc.Name, svc.UID
+	c.pendingLBs[uid] = time.AfterFunc(remaining, func() {
+		c.checkStuckLoadBalancer(namespace, name, uid)
+	})
+}
+
+func (c *clusterController) onServiceDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if svc, ok := obj.(*apiv1.Service); ok {
+		c.untrackLoadBalancer(svc.UID)
+	}
+}
+
+func (c *clusterController) untrackLoadBalancer(uid types.UID) {
+	c.lbMu.Lock()
+	defer c.lbMu.Unlock()
+	if timer, ok := c.pendingLBs[uid]; ok {
+		timer.Stop()
+		delete(c.pendingLBs, uid)
+	}
+}
+
+func (c *clusterController) checkStuckLoadBalancer(namespace, name string, uid types.UID) {
+	select {
+	case <-c.stopCh:
+		return
+	default:
+	}
+	c.mu.Lock()
+	informer := c.serviceInformer
+	c.mu.Unlock()
+	if informer == nil {
+		return
+	}
+	svc, err := informer.Lister().Services(namespace).Get(name)
+	if err != nil || svc.UID != uid || !isLoadBalancerPending(svc) {
+		return
+	}
+	onStuckLoadBalancer(c.cluster.Name, svc, time.Since(svc.CreationTimestamp.Time))
+}
+
+func isLoadBalancerPending(svc *apiv1.Service) bool {
+	return svc.Spec.Type == apiv1.ServiceTypeLoadBalancer && len(svc.Status.LoadBalancer.Ingress) == 0
+}
+
+// nodesByPool groups the cached nodes by the value of the cluster node pool
+// label. Nodes without the label are ignored.
+func (c *clusterController) nodesByPool() (map[string][]*apiv1.Node, error) {
+	nodeInformer, err := c.getNodeInformer()
+	if err != nil {
+		return nil, err
+	}
+	labelKey := c.cluster.NodePoolLabel()
+	selector, err := labels.Parse(labelKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", nodePoolLabelClusterKey)
+	}
+	nodes, err := nodeInformer.Lister().List(selector)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result := map[string][]*apiv1.Node{}
+	for _, node := range nodes {
+		pool := node.Labels[labelKey]
+		result[pool] = append(result[pool], node)
+	}
+	return result, nil
+}
+
+// NodesHealth holds the number of nodes of a cluster by their Ready
+// condition. Nodes with an unknown or missing Ready condition are counted as
+// not ready.
+type NodesHealth struct {
+	Cluster  string
+	Ready    int
+	NotReady int
+}
+
+// ClusterNodesHealth returns the number of ready and not ready nodes cached
+// by the running controller of the cluster. No requests are made to the
+// cluster API server.
+func (p *kubernetesProvisioner) ClusterNodesHealth(clusterName string) (NodesHealth, error) {
+	c, ok := p.lookupClusterController(clusterName)
+	if !ok {
+		return NodesHealth{}, errors.Errorf("no controller running for cluster %q", clusterName)
+	}
+	return c.nodesHealth()
+}
+
+func (c *clusterController) nodesHealth() (NodesHealth, error) {
+	health := NodesHealth{Cluster: c.cluster.Name}
+	nodeInformer, err := c.getNodeInformer()
+	if err != nil {
+		return health, err
+	}
+	nodes, err := nodeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return health, errors.WithStack(err)
+	}
+	for _, node := range nodes {
+		if isNodeReady(node) {
+			health.Ready++
+		} else {
+			health.NotReady++
+		}
+	}
+	return health, nil
+}
+
+func isNodeReady(node *apiv1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == apiv1.NodeReady {
+			return cond.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// drainNode cordons the node and evicts the tsuru pods running on it, reading
+// both from the informers caches. Evictions blocked by a PodDisruptionBudget
+// are retried until drainEvictionTimeout.
+func (c *clusterController) drainNode(nodeName string) error {
+	nodeInformer, err := c.getNodeInformer()
+	if err != nil {
+		return err
+	}
+	node, err := nodeInformer.Lister().Get(nodeName)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !node.Spec.Unschedulable {
+		_, err = c.cluster.CoreV1().Nodes().Patch(nodeName, types.StrategicMergePatchType, []byte(`{"spec":{"unschedulable":true}}`))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	podInformer, err := c.getPodInformer()
+	if err != nil {
+		return err
+	}
+	selector, err := labels.Parse(tsuruLabelPrefix + provision.LabelAppPool)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	pods, err := podInformer.Lister().List(selector)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName != nodeName {
+			continue
+		}
+		err = c.evictPod(pod)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *clusterController) evictPod(pod *apiv1.Pod) error {
+	deadline := time.Now().Add(drainEvictionTimeout)
+	for {
+		err := c.cluster.CoreV1().Pods(pod.Namespace).Evict(&policy.Eviction{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+			},
+		})
+		if err == nil || k8sErrors.IsNotFound(err) {
+			return nil
+		}
+		if !k8sErrors.IsTooManyRequests(err) || time.Now().After(deadline) {
+			return errors.Wrapf(err, "unable to evict pod %s", pod.Name)
+		}
+		select {
+		case <-c.stopCh:
+			return ErrControllerStopped
+		case <-time.After(drainEvictionRetryInterval):
+		}
+	}
+}
+
+// jitterResync randomly changes resync by up to informerResyncJitter of its
+// value, in either direction, never going below minInformerResync.
+func jitterResync(resync time.Duration) time.Duration {
+	factor := (2*resyncJitterRand() - 1) * informerResyncJitter
+	resync += time.Duration(factor * float64(resync))
+	if resync < minInformerResync {
+		return minInformerResync
+	}
+	return resync
+}
+
+type informerFactoryOptions struct {
+	resync           time.Duration
+	tweakListOptions internalinterfaces.TweakListOptionsFunc
+	namespace        string
+	clientForConfig  func(*rest.Config) (kubernetes.Interface, error)
+	podListWatchFunc func(error)
+}
+
+// InformerFactoryOption changes how InformerFactory builds the informer
+// factory for a cluster.
+type InformerFactoryOption func(*informerFactoryOptions)
+
+// WithResync sets the resync period of the informers, overriding the
+// informer-resync cluster setting. No jitter is applied to the period.
+func WithResync(resync time.Duration) InformerFactoryOption {
+	return func(opts *informerFactoryOptions) {
+		opts.resync = resync
+	}
+}
+
+// WithTweakListOptions adds a function called on the list options of every
+// informer, after the options set by tsuru.
+func WithTweakListOptions(fn internalinterfaces.TweakListOptionsFunc) InformerFactoryOption {
+	return func(opts *informerFactoryOptions) {
+		opts.tweakListOptions = fn
+	}
+}
+
+// WithNamespace restricts the informers to a single namespace, overriding the
+// informer-namespaces cluster setting.
+func WithNamespace(namespace string) InformerFactoryOption {
+	return func(opts *informerFactoryOptions) {
+		opts.namespace = namespace
+	}
+}
+
+// WithClientForConfig sets the function used to build the client of the
+// informers, instead of ClientForConfig. Mostly useful in tests, to use a
+// fake clientset seeded with objects.
+func WithClientForConfig(fn func(*rest.Config) (kubernetes.Interface, error)) InformerFactoryOption {
+	return func(opts *informerFactoryOptions) {
+		opts.clientForConfig = fn
+	}
 }
 
-var InformerFactory = func(client *ClusterClient) (informers.SharedInformerFactory, error) {
+// WithPodListWatchReporter sets a function called with the result of every
+// list and watch call made by the pod informer, nil on success, allowing
+// failures to be detected even while the informer retries them.
+func WithPodListWatchReporter(fn func(err error)) InformerFactoryOption {
+	return func(opts *informerFactoryOptions) {
+		opts.podListWatchFunc = fn
+	}
+}
+
+var InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+	if client.restConfig == nil {
+		return nil, errors.Errorf("cluster %q has no rest config, unable to create informers", client.Name)
+	}
+	var factoryOpts informerFactoryOptions
+	for _, opt := range opts {
+		opt(&factoryOpts)
+	}
+	resync := factoryOpts.resync
+	if resync == 0 {
+		var err error
+		resync, err = client.InformerResyncPeriod()
+		if err != nil {
+			return nil, err
+		}
+		resync = jitterResync(resync)
+	}
+	appPodsOnly, err := client.InformerAppPodsOnly()
+	if err != nil {
+		return nil, err
+	}
+	activePodsOnly, err := client.InformerActivePodsOnly()
+	if err != nil {
+		return nil, err
+	}
+	qps, err := client.InformerQPS()
+	if err != nil {
+		return nil, err
+	}
+	burst, err := client.InformerBurst()
+	if err != nil {
+		return nil, err
+	}
 	timeout := client.restConfig.Timeout
 	restConfig := *client.restConfig
 	restConfig.Timeout = 0
-	cli, err := ClientForConfig(&restConfig)
+	restConfig.QPS = qps
+	restConfig.Burst = burst
+	if len(client.CABundle) > 0 {
+		restConfig.TLSClientConfig.CAFile = ""
+		restConfig.TLSClientConfig.CAData = client.CABundle
+	}
+	if impersonate := client.Impersonate; impersonate.UserName != "" {
+		restConfig.Impersonate = impersonate
+	} else if len(impersonate.Groups) > 0 {
+		return nil, errors.Errorf("cluster %q impersonates groups without a user", client.Name)
+	}
+	clientForConfig := ClientForConfig
+	if factoryOpts.clientForConfig != nil {
+		clientForConfig = factoryOpts.clientForConfig
+	}
+	cli, err := clientForConfig(&restConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -257,6 +2123,247 @@ var InformerFactory = func(client *ClusterClient) (informers.SharedInformerFacto
 			timeoutSec := int64(timeout.Seconds())
 			opts.TimeoutSeconds = &timeoutSec
 		}
+		if factoryOpts.tweakListOptions != nil {
+			factoryOpts.tweakListOptions(opts)
+		}
+	})
+	// ConfigMaps are only watched to rebuild the routes of the apps they are
+	// labeled with, unlabeled ones must never be cached.
+	configMapsTweakFunc := internalinterfaces.TweakListOptionsFunc(func(opts *metav1.ListOptions) {
+		tweakFunc(opts)
+		opts.LabelSelector = tsuruLabelPrefix + provision.LabelAppName
+	})
+	// Other informers share the factory, nodes have no app labels and no
+	// phase so the selectors are only applied to the pod informer.
+	podsTweakFunc := internalinterfaces.TweakListOptionsFunc(func(opts *metav1.ListOptions) {
+		tweakFunc(opts)
+		if appPodsOnly {
+			opts.LabelSelector = tsuruLabelPrefix + provision.LabelAppName
+		}
+		if activePodsOnly {
+			opts.FieldSelector = activePodsFieldSelector
+		}
+	})
+	namespace := metav1.NamespaceAll
+	namespaces := client.InformerNamespaces()
+	if factoryOpts.namespace != "" {
+		namespace = factoryOpts.namespace
+		namespaces = nil
+	}
+	factory := informers.NewFilteredSharedInformerFactory(cli, resync, namespace, tweakFunc)
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	podIndexers := cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		appNameIndex:         appNameIndexFunc,
+	}
+	if len(namespaces) > 0 {
+		factory.InformerFor(&apiv1.Pod{}, func(cli kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			lw := newMultiNamespaceListWatch(namespaces, func(ns string) cache.ListerWatcher {
+				return &cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						podsTweakFunc(&opts)
+						return cli.CoreV1().Pods(ns).List(opts)
+					},
+					WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+						podsTweakFunc(&opts)
+						return cli.CoreV1().Pods(ns).Watch(opts)
+					},
+				}
+			})
+			return cache.NewSharedIndexInformer(withListWatchReporter(lw, factoryOpts.podListWatchFunc), &apiv1.Pod{}, resync, podIndexers)
+		})
+		factory.InformerFor(&apiv1.Service{}, func(cli kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			lw := newMultiNamespaceListWatch(namespaces, func(ns string) cache.ListerWatcher {
+				return &cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						tweakFunc(&opts)
+						return cli.CoreV1().Services(ns).List(opts)
+					},
+					WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+						tweakFunc(&opts)
+						return cli.CoreV1().Services(ns).Watch(opts)
+					},
+				}
+			})
+			return cache.NewSharedIndexInformer(lw, &apiv1.Service{}, resync, indexers)
+		})
+		factory.InformerFor(&apiv1.ConfigMap{}, func(cli kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			lw := newMultiNamespaceListWatch(namespaces, func(ns string) cache.ListerWatcher {
+				return &cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						configMapsTweakFunc(&opts)
+						return cli.CoreV1().ConfigMaps(ns).List(opts)
+					},
+					WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+						configMapsTweakFunc(&opts)
+						return cli.CoreV1().ConfigMaps(ns).Watch(opts)
+					},
+				}
+			})
+			return cache.NewSharedIndexInformer(lw, &apiv1.ConfigMap{}, resync, indexers)
+		})
+	} else {
+		factory.InformerFor(&apiv1.Pod{}, func(cli kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			lw := &cache.ListWatch{
+				ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+					podsTweakFunc(&opts)
+					return cli.CoreV1().Pods(namespace).List(opts)
+				},
+				WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+					podsTweakFunc(&opts)
+					return cli.CoreV1().Pods(namespace).Watch(opts)
+				},
+			}
+			return cache.NewSharedIndexInformer(withListWatchReporter(lw, factoryOpts.podListWatchFunc), &apiv1.Pod{}, resync, podIndexers)
+		})
+		factory.InformerFor(&apiv1.ConfigMap{}, func(cli kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return v1informers.NewFilteredConfigMapInformer(cli, namespace, resync, indexers, configMapsTweakFunc)
+		})
+	}
+	return factory, nil
+}
+
+// reportingListWatch calls report with the result of every list and watch
+// call of the wrapped ListerWatcher.
+type reportingListWatch struct {
+	cache.ListerWatcher
+	report func(error)
+}
+
+func withListWatchReporter(lw cache.ListerWatcher, report func(error)) cache.ListerWatcher {
+	if report == nil {
+		return lw
+	}
+	return &reportingListWatch{ListerWatcher: lw, report: report}
+}
+
+func (lw *reportingListWatch) List(opts metav1.ListOptions) (runtime.Object, error) {
+	obj, err := lw.ListerWatcher.List(opts)
+	lw.report(err)
+	return obj, err
+}
+
+func (lw *reportingListWatch) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	w, err := lw.ListerWatcher.Watch(opts)
+	lw.report(err)
+	return w, err
+}
+
+// multiNamespaceListWatch lists and watches a resource on each one of a set
+// of namespaces, merging the results as if they came from a single list and
+// watch. Resource versions are shared by all namespaces, so the version of
+// the merged list is valid to start watches on every namespace.
+type multiNamespaceListWatch map[string]cache.ListerWatcher
+
+func newMultiNamespaceListWatch(namespaces []string, fn func(ns string) cache.ListerWatcher) multiNamespaceListWatch {
+	lw := make(multiNamespaceListWatch, len(namespaces))
+	for _, ns := range namespaces {
+		lw[ns] = fn(ns)
+	}
+	return lw
+}
+
+func (lw multiNamespaceListWatch) List(opts metav1.ListOptions) (runtime.Object, error) {
+	var (
+		result     runtime.Object
+		items      []runtime.Object
+		minVersion uint64
+	)
+	for ns, nsLW := range lw {
+		list, err := nsLW.List(opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list namespace %q", ns)
+		}
+		nsItems, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		items = append(items, nsItems...)
+		listMeta, err := meta.ListAccessor(list)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		version, _ := strconv.ParseUint(listMeta.GetResourceVersion(), 10, 64)
+		if result == nil || version < minVersion {
+			result = list
+			minVersion = version
+		}
+	}
+	if result == nil {
+		return nil, errors.New("no namespaces to list")
+	}
+	err := meta.SetList(result, items)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+func (lw multiNamespaceListWatch) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	mw := &multiWatch{
+		result: make(chan watch.Event),
+		stopCh: make(chan struct{}),
+	}
+	for ns, nsLW := range lw {
+		w, err := nsLW.Watch(opts)
+		if err != nil {
+			mw.Stop()
+			return nil, errors.Wrapf(err, "unable to watch namespace %q", ns)
+		}
+		mw.watchers = append(mw.watchers, w)
+	}
+	mw.start()
+	return mw, nil
+}
+
+// multiWatch merges the events of several watches, stopping all of them as
+// soon as one is closed so that the caller restarts the watch.
+type multiWatch struct {
+	watchers []watch.Interface
+	result   chan watch.Event
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func (w *multiWatch) start() {
+	var wg sync.WaitGroup
+	for _, watcher := range w.watchers {
+		wg.Add(1)
+		go func(watcher watch.Interface) {
+			defer wg.Done()
+			defer w.Stop()
+			for {
+				select {
+				case ev, ok := <-watcher.ResultChan():
+					if !ok {
+						return
+					}
+					select {
+					case w.result <- ev:
+					case <-w.stopCh:
+						return
+					}
+				case <-w.stopCh:
+					return
+				}
+			}
+		}(watcher)
+	}
+	go func() {
+		wg.Wait()
+		close(w.result)
+	}()
+}
+
+func (w *multiWatch) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+		for _, watcher := range w.watchers {
+			watcher.Stop()
+		}
 	})
-	return informers.NewFilteredSharedInformerFactory(cli, time.Minute, metav1.NamespaceAll, tweakFunc), nil
+}
+
+func (w *multiWatch) ResultChan() <-chan watch.Event {
+	return w.result
 }
@@ -6,18 +6,47 @@ package kubernetes
 
 import (
 	"context"
+	"reflect"
+	stdRuntime "runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/router/rebuild"
 
 	"github.com/tsuru/tsuru/app"
+	tsuruErrors "github.com/tsuru/tsuru/errors"
+	"github.com/tsuru/tsuru/event"
+	"github.com/tsuru/tsuru/event/eventtest"
+	"github.com/tsuru/tsuru/log"
 	"github.com/tsuru/tsuru/provision"
+	"github.com/tsuru/tsuru/provision/provisiontest"
+	"github.com/tsuru/tsuru/safe"
+	appTypes "github.com/tsuru/tsuru/types/app"
+	provTypes "github.com/tsuru/tsuru/types/provision"
 	check "gopkg.in/check.v1"
 	apiv1 "k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	v1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 	ktesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 )
 
 func (s *S) TestNewClusterController(c *check.C) {
@@ -46,7 +75,7 @@ func (s *S) TestNewClusterController(c *check.C) {
 	})
 	c.Assert(err, check.IsNil)
 	defer rebuild.Shutdown(context.Background())
-	_, err = getClusterController(s.p, s.clusterClient)
+	_, err = getClusterController(context.Background(), s.p, s.clusterClient)
 	c.Assert(err, check.IsNil)
 	basePod := &apiv1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -54,10 +83,12 @@ func (s *S) TestNewClusterController(c *check.C) {
 			Labels:          labels.ToLabels(),
 			ResourceVersion: "0",
 		},
+		Status: podStatusReady(false),
 	}
 	watchFake.Add(basePod)
 	basePod = basePod.DeepCopy()
 	basePod.ResourceVersion = "1"
+	basePod.Status = podStatusReady(true)
 	watchFake.Modify(basePod)
 	select {
 	case <-rebuildCalled:
@@ -67,9 +98,2590 @@ func (s *S) TestNewClusterController(c *check.C) {
 }
 
 func (s *S) TestNewRouterControllerSameInstance(c *check.C) {
-	c1, err := getClusterController(s.p, s.clusterClient)
+	c1, err := getClusterController(context.Background(), s.p, s.clusterClient)
 	c.Assert(err, check.IsNil)
-	c2, err := getClusterController(s.p, s.clusterClient)
+	c2, err := getClusterController(context.Background(), s.p, s.clusterClient)
 	c.Assert(err, check.IsNil)
 	c.Assert(c1, check.Equals, c2)
 }
+
+func (s *S) TestClusterControllerOnAddReadyPod(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	rebuildCh := s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	_, err := s.client.CoreV1().Pods("default").Create(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "myapp-pod",
+			Namespace: "default",
+			Labels:    s.appPodLabels(c, a),
+		},
+		Status: podStatusReady(true),
+	})
+	c.Assert(err, check.IsNil)
+	a2 := provisiontest.NewFakeApp("otherapp", "python", 0)
+	_, err = s.client.CoreV1().Pods("default").Create(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "otherapp-pod",
+			Namespace: "default",
+			Labels:    s.appPodLabels(c, a2),
+		},
+		Status: podStatusReady(false),
+	})
+	c.Assert(err, check.IsNil)
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	_, err = getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	select {
+	case appName := <-rebuildCh:
+		c.Assert(appName, check.Equals, "myapp")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for rebuild call")
+	}
+	select {
+	case appName := <-rebuildCh:
+		c.Fatalf("unexpected rebuild call for %q", appName)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func (s *S) TestClusterControllerOnUpdateUsesNewPod(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	rebuildCh := s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	newPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod1",
+			Labels:          s.appPodLabels(c, a),
+			ResourceVersion: "2",
+		},
+		Status: podStatusReady(true),
+	}
+	oldPod := newPod.DeepCopy()
+	oldPod.Labels = nil
+	oldPod.ResourceVersion = "1"
+	oldPod.Status = podStatusReady(false)
+	ctr := &clusterController{cluster: s.clusterClient}
+	err := ctr.onUpdate(oldPod, newPod)
+	c.Assert(err, check.IsNil)
+	select {
+	case appName := <-rebuildCh:
+		c.Assert(appName, check.Equals, "myapp")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for rebuild call")
+	}
+}
+
+func (s *S) TestClusterControllerOnUpdateReadinessUnchanged(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	rebuildCh := s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	oldPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod1",
+			Labels:          s.appPodLabels(c, a),
+			ResourceVersion: "1",
+		},
+		Status: podStatusReady(true),
+	}
+	newPod := oldPod.DeepCopy()
+	newPod.ResourceVersion = "2"
+	newPod.Annotations = map[string]string{"unrelated": "changed"}
+	ctr := &clusterController{cluster: s.clusterClient}
+	err := ctr.onUpdate(oldPod, newPod)
+	c.Assert(err, check.IsNil)
+	select {
+	case appName := <-rebuildCh:
+		c.Fatalf("unexpected rebuild call for %q", appName)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func (s *S) TestClusterControllerOnUpdateNodeChanged(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	rebuildCh := s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	oldPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod1",
+			Labels:          s.appPodLabels(c, a),
+			ResourceVersion: "1",
+		},
+		Spec:   apiv1.PodSpec{NodeName: "n1"},
+		Status: podStatusReady(true),
+	}
+	newPod := oldPod.DeepCopy()
+	newPod.ResourceVersion = "2"
+	newPod.Spec.NodeName = "n2"
+	ctr := &clusterController{cluster: s.clusterClient}
+	err := ctr.onUpdate(oldPod, newPod)
+	c.Assert(err, check.IsNil)
+	select {
+	case appName := <-rebuildCh:
+		c.Assert(appName, check.Equals, "myapp")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for rebuild call")
+	}
+}
+
+type rebuiltApp struct {
+	rebuild.RebuildApp
+	name string
+}
+
+func (a *rebuiltApp) GetName() string                   { return a.name }
+func (a *rebuiltApp) GetRouters() []appTypes.AppRouter  { return nil }
+func (a *rebuiltApp) InternalLock(string) (bool, error) { return true, nil }
+func (a *rebuiltApp) Unlock()                           {}
+
+func (s *S) TestClusterControllerOnUpdateNodeChangedIgnoresCooldown(c *check.C) {
+	config.Set("routes-rebuild-debounce", 0)
+	defer config.Unset("routes-rebuild-debounce")
+	config.Set("routes-rebuild-cooldown", 60)
+	defer config.Unset("routes-rebuild-cooldown")
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	var calls int32
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		atomic.AddInt32(&calls, 1)
+		return &rebuiltApp{name: appName}, nil
+	})
+	c.Assert(err, check.IsNil)
+	defer rebuild.Shutdown(context.Background())
+	rebuild.RoutesRebuildOrEnqueue("myapp")
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	oldPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod1",
+			Labels:          s.appPodLabels(c, a),
+			ResourceVersion: "1",
+		},
+		Spec:   apiv1.PodSpec{NodeName: "n1"},
+		Status: podStatusReady(true),
+	}
+	newPod := oldPod.DeepCopy()
+	newPod.ResourceVersion = "2"
+	newPod.Spec.NodeName = "n2"
+	ctr := &clusterController{cluster: s.clusterClient}
+	err = ctr.onUpdate(oldPod, newPod)
+	c.Assert(err, check.IsNil)
+	timeout := time.After(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 2 {
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for rebuild call")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *S) TestClusterControllerOnDeleteDelaysRebuild(c *check.C) {
+	config.Set("routes-rebuild-debounce", 0)
+	defer config.Unset("routes-rebuild-debounce")
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.clusterClient.CustomData[deleteRebuildDelayKey] = "1s"
+	rebuildCh := s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	ctr := &clusterController{cluster: s.clusterClient}
+	expectRebuild := func(appName string, min, max time.Duration) {
+		start := time.Now()
+		select {
+		case rebuilt := <-rebuildCh:
+			c.Assert(rebuilt, check.Equals, appName)
+			c.Assert(time.Since(start) >= min, check.Equals, true, check.Commentf("rebuild after %v", time.Since(start)))
+		case <-time.After(max):
+			c.Fatalf("timeout waiting for rebuild call for %q", appName)
+		}
+	}
+	grace, noGrace := int64(30), int64(0)
+	a1 := provisiontest.NewFakeApp("myapp", "python", 0)
+	oldPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod", Labels: s.appPodLabels(c, a1), ResourceVersion: "1"},
+		Spec:       apiv1.PodSpec{TerminationGracePeriodSeconds: &grace},
+		Status:     podStatusReady(false),
+	}
+	newPod := oldPod.DeepCopy()
+	newPod.ResourceVersion = "2"
+	newPod.Status = podStatusReady(true)
+	err := ctr.onUpdate(oldPod, newPod)
+	c.Assert(err, check.IsNil)
+	expectRebuild("myapp", 0, 500*time.Millisecond)
+	err = ctr.onDelete(newPod)
+	c.Assert(err, check.IsNil)
+	expectRebuild("myapp", 900*time.Millisecond, 5*time.Second)
+	a2 := provisiontest.NewFakeApp("otherapp", "python", 0)
+	noGracePod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "otherapp-pod", Labels: s.appPodLabels(c, a2)},
+		Spec:       apiv1.PodSpec{TerminationGracePeriodSeconds: &noGrace},
+		Status:     podStatusReady(true),
+	}
+	err = ctr.onDelete(noGracePod)
+	c.Assert(err, check.IsNil)
+	expectRebuild("otherapp", 0, 500*time.Millisecond)
+}
+
+func (s *S) TestClusterControllerRoutesRebuildEnqueuedMetric(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	oldPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod1",
+			Labels:          s.appPodLabels(c, a),
+			ResourceVersion: "1",
+		},
+		Status: podStatusReady(false),
+	}
+	newPod := oldPod.DeepCopy()
+	newPod.ResourceVersion = "2"
+	newPod.Status = podStatusReady(true)
+	counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "myapp")
+	initial := counterValue(counter)
+	ctr := &clusterController{cluster: s.clusterClient}
+	err := ctr.onUpdate(oldPod, newPod)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	unchangedPod := newPod.DeepCopy()
+	unchangedPod.ResourceVersion = "3"
+	err = ctr.onUpdate(newPod, unchangedPod)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	err = ctr.onDelete(unchangedPod)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+2)
+}
+
+func (s *S) TestClusterControllerOnDeleteRebuildRouterTypes(c *check.C) {
+	s.clusterClient.CustomData[deleteRebuildDelayKey] = "0s"
+	s.clusterClient.CustomData[deleteRebuildRoutersKey] = "nginx,hipache"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	ctr := &clusterController{cluster: s.clusterClient}
+	tests := []struct {
+		app         string
+		routerTypes string
+		ready       bool
+		rebuilt     bool
+	}{
+		{app: "hipacheapp", routerTypes: "hipache", ready: true, rebuilt: true},
+		{app: "multiapp", routerTypes: "vulcand,nginx", ready: true, rebuilt: true},
+		{app: "vulcandapp", routerTypes: "vulcand", ready: true, rebuilt: false},
+		{app: "norouterapp", ready: true, rebuilt: false},
+		{app: "notreadyapp", routerTypes: "hipache", ready: false, rebuilt: false},
+	}
+	for _, tt := range tests {
+		a := provisiontest.NewFakeApp(tt.app, "python", 0)
+		// Router types are set in the pod annotations, not in its labels.
+		labels := s.appPodLabels(c, a)
+		delete(labels, tsuruLabelPrefix+"router-type")
+		pod := &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        tt.app + "-pod",
+				Labels:      labels,
+				Annotations: map[string]string{},
+			},
+			Status: podStatusReady(tt.ready),
+		}
+		if tt.routerTypes != "" {
+			pod.Annotations[tsuruLabelPrefix+"router-type"] = tt.routerTypes
+		}
+		counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, tt.app)
+		initial := counterValue(counter)
+		err := ctr.onDelete(pod)
+		c.Assert(err, check.IsNil)
+		expected := initial
+		if tt.rebuilt {
+			expected++
+		}
+		c.Assert(counterValue(counter), check.Equals, expected, check.Commentf("app %q", tt.app))
+	}
+}
+
+func (s *S) TestRoutesRebuildBacklog(c *check.C) {
+	config.Set("routes-rebuild-debounce", 60)
+	defer config.Unset("routes-rebuild-debounce")
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		return nil, nil
+	})
+	c.Assert(err, check.IsNil)
+	defer rebuild.Shutdown(context.Background())
+	gaugeValue := func() float64 {
+		var metric dto.Metric
+		routesRebuildPending.Write(&metric)
+		return metric.Gauge.GetValue()
+	}
+	c.Assert(s.p.RoutesRebuildBacklog(), check.Equals, 0)
+	c.Assert(gaugeValue(), check.Equals, float64(0))
+	for _, appName := range []string{"myapp", "otherapp", "myapp"} {
+		rebuild.EnqueueRoutesRebuildOpts(appName, rebuild.EnqueueOpts{Debounce: true})
+	}
+	rebuild.EnqueueRoutesRebuildOpts("otherapp", rebuild.EnqueueOpts{Debounce: true, Priority: rebuild.PriorityHigh})
+	c.Assert(s.p.RoutesRebuildBacklog(), check.Equals, 2)
+	c.Assert(gaugeValue(), check.Equals, float64(2))
+}
+
+func (s *S) TestClusterControllerAddPodIncoherentLabels(c *check.C) {
+	logBuf := safe.NewBuffer(nil)
+	log.SetLogger(log.NewWriterLogger(logBuf, true))
+	defer log.SetLogger(nil)
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	ctr := &clusterController{cluster: s.clusterClient}
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		logRe       string
+	}{
+		{
+			name:        "sidecar-app-name",
+			annotations: map[string]string{"tsuru.io/app-name": "mesh-proxy"},
+			logRe:       `(?s).*conflicting values for tsuru.io/app-name in labels and annotations: "myapp" and "mesh-proxy".*`,
+		},
+		{
+			name:        "sidecar-process",
+			annotations: map[string]string{"tsuru.io/app-process": "envoy"},
+			logRe:       `(?s).*conflicting values for tsuru.io/app-process in labels and annotations: "p1" and "envoy".*`,
+		},
+	}
+	counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "myapp")
+	initial := counterValue(counter)
+	for _, tt := range tests {
+		pod := &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        tt.name,
+				Namespace:   "default",
+				Labels:      s.appPodLabels(c, a),
+				Annotations: tt.annotations,
+			},
+			Status: podStatusReady(true),
+		}
+		ctr.addPod(pod, true, 0)
+		c.Assert(logBuf.String(), check.Matches, tt.logRe, check.Commentf("pod %q", tt.name))
+	}
+	c.Assert(counterValue(counter), check.Equals, initial)
+	counter = routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "mesh-proxy")
+	c.Assert(counterValue(counter), check.Equals, float64(0))
+}
+
+func (s *S) TestClusterControllerOnUpdateInvalidObject(c *check.C) {
+	ctr := &clusterController{cluster: s.clusterClient}
+	pod := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", ResourceVersion: "1"}}
+	err := ctr.onUpdate(&apiv1.Node{}, pod)
+	c.Assert(err, check.ErrorMatches, "couldn't get object from tombstone .*")
+	err = ctr.onUpdate(pod, cache.DeletedFinalStateUnknown{Key: "default/node", Obj: &apiv1.Node{}})
+	c.Assert(err, check.ErrorMatches, "tombstone contained object that is not a Pod: .*")
+	newPod := pod.DeepCopy()
+	newPod.ResourceVersion = "2"
+	err = ctr.onUpdate(cache.DeletedFinalStateUnknown{Key: "default/pod1", Obj: pod}, newPod)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestClusterControllerRouterLocalAnnotationOverride(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	ctr := &clusterController{cluster: s.clusterClient}
+	for _, appName := range []string{"app-pool", "app-annotated"} {
+		a := provisiontest.NewFakeApp(appName, "python", 0)
+		pod := &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   appName + "-pod",
+				Labels: s.appPodLabels(c, a),
+			},
+		}
+		if appName == "app-annotated" {
+			pod.Annotations = map[string]string{tsuruRouterLocalMeta: "false"}
+		}
+		counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, appName)
+		initial := counterValue(counter)
+		err := ctr.onDelete(pod)
+		c.Assert(err, check.IsNil)
+		if appName == "app-annotated" {
+			c.Assert(counterValue(counter), check.Equals, initial)
+		} else {
+			c.Assert(counterValue(counter), check.Equals, initial+1)
+		}
+	}
+}
+
+type invertedDecider struct{}
+
+func (invertedDecider) ShouldRebuild(labelSet *provision.LabelSet, cluster *ClusterClient) bool {
+	return !(routerLocalDecider{}).ShouldRebuild(labelSet, cluster)
+}
+
+func (s *S) TestClusterControllerCustomRebuildDecider(c *check.C) {
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	s.p.SetRebuildDecider(invertedDecider{})
+	defer s.p.SetRebuildDecider(nil)
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "myapp-pod",
+			Labels: s.appPodLabels(c, a),
+		},
+	}
+	ctr := &clusterController{cluster: s.clusterClient, rebuildDecider: s.p.rebuildDecider}
+	counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "myapp")
+	initial := counterValue(counter)
+	err := ctr.onDelete(pod)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	err = ctr.onDelete(pod)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	ctr.setRebuildDecider(nil)
+	err = ctr.onDelete(pod)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+2)
+}
+
+func (s *S) TestClusterControllerMonitoredPools(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.clusterClient.CustomData[monitoredPoolsKey] = "p1,p2"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	ctr := &clusterController{cluster: s.clusterClient}
+	expected := map[string]float64{"app-p1": 1, "app-p2": 1, "app-p3": 0}
+	for _, pool := range []string{"p1", "p2", "p3"} {
+		appName := "app-" + pool
+		a := provisiontest.NewFakeAppWithPool(appName, "python", pool, 0)
+		counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, appName)
+		initial := counterValue(counter)
+		err := ctr.onDelete(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: appName + "-pod", Labels: s.appPodLabels(c, a)},
+		})
+		c.Assert(err, check.IsNil)
+		c.Assert(counterValue(counter), check.Equals, initial+expected[appName])
+	}
+}
+
+func (s *S) TestClusterControllerRebuildPriority(c *check.C) {
+	s.clusterClient.CustomData[highPriorityPoolsKey] = "p1"
+	ctr := &clusterController{cluster: s.clusterClient}
+	tests := []struct {
+		pool       string
+		annotation string
+		expected   rebuild.Priority
+	}{
+		{pool: "p1", expected: rebuild.PriorityHigh},
+		{pool: "p2", expected: rebuild.PriorityNormal},
+		{pool: "p1", annotation: "normal", expected: rebuild.PriorityNormal},
+		{pool: "p2", annotation: "high", expected: rebuild.PriorityHigh},
+		{pool: "p2", annotation: "invalid", expected: rebuild.PriorityNormal},
+	}
+	for i, tt := range tests {
+		a := provisiontest.NewFakeAppWithPool("myapp", "python", tt.pool, 0)
+		meta := metav1.ObjectMeta{Labels: s.appPodLabels(c, a)}
+		if tt.annotation != "" {
+			meta.Annotations = map[string]string{tsuruRebuildPriorityMeta: tt.annotation}
+		}
+		c.Assert(ctr.rebuildPriority(labelSetFromMeta(&meta)), check.Equals, tt.expected, check.Commentf("test %d", i))
+	}
+}
+
+func (s *S) TestClusterControllerAddPodAppInMultiplePools(c *check.C) {
+	s.clusterClient.CustomData["oldpool:"+routerAddressLocalKey] = "true"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	oldApp := provisiontest.NewFakeAppWithPool("myapp", "python", "oldpool", 0)
+	newApp := provisiontest.NewFakeAppWithPool("myapp", "python", "newpool", 0)
+	oldPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-old", Namespace: "default", Labels: s.appPodLabels(c, oldApp)},
+		Status:     podStatusReady(true),
+	}
+	newPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-new", Namespace: "default", Labels: s.appPodLabels(c, newApp)},
+		Status:     podStatusReady(true),
+	}
+	for _, pod := range []*apiv1.Pod{oldPod, newPod} {
+		_, err := s.client.CoreV1().Pods("default").Create(pod)
+		c.Assert(err, check.IsNil)
+	}
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	informer, err := ctr.getPodInformer()
+	c.Assert(err, check.IsNil)
+	counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "myapp")
+	initial := counterValue(counter)
+	ctr.addPod(newPod, true, 0)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	err = s.client.CoreV1().Pods("default").Delete(oldPod.Name, nil)
+	c.Assert(err, check.IsNil)
+	timeout := time.After(5 * time.Second)
+	for {
+		_, err = informer.Lister().Pods("default").Get(oldPod.Name)
+		if k8sErrors.IsNotFound(err) {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for pod removal from cache")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	initial = counterValue(counter)
+	ctr.addPod(newPod, true, 0)
+	c.Assert(counterValue(counter), check.Equals, initial)
+}
+
+func (s *S) TestClusterControllerExcludedNamespaces(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	ctr := &clusterController{cluster: s.clusterClient}
+	counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "myapp")
+	initial := counterValue(counter)
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod", Namespace: "kube-system", Labels: s.appPodLabels(c, a)},
+	}
+	err := ctr.onDelete(pod)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial)
+	s.clusterClient.CustomData[excludedNamespacesKey] = "other"
+	err = ctr.onDelete(pod)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+}
+
+func (s *S) TestResyncCluster(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	a1 := provisiontest.NewFakeApp("myapp", "python", 0)
+	a2 := provisiontest.NewFakeApp("otherapp", "python", 0)
+	deployLabels := s.appPodLabels(c, a2)
+	deployLabels[tsuruLabelPrefix+"is-deploy"] = "true"
+	pods := []*apiv1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-1", Namespace: "default", Labels: s.appPodLabels(c, a1)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-2", Namespace: "default", Labels: s.appPodLabels(c, a1)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-deploy", Namespace: "default", Labels: deployLabels}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "not-tsuru", Namespace: "default"}},
+	}
+	for _, pod := range pods {
+		_, err := s.client.CoreV1().Pods(pod.Namespace).Create(pod)
+		c.Assert(err, check.IsNil)
+	}
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	defer stopClusterController(s.p, s.clusterClient)
+	myappCounter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "myapp")
+	otherCounter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "otherapp")
+	myappInitial := counterValue(myappCounter)
+	otherInitial := counterValue(otherCounter)
+	err = s.p.ResyncCluster(s.clusterClient.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(myappCounter), check.Equals, myappInitial+2)
+	c.Assert(counterValue(otherCounter), check.Equals, otherInitial)
+	err = s.p.ResyncCluster("unknown")
+	c.Assert(err, check.ErrorMatches, `no controller running for cluster "unknown"`)
+}
+
+func (s *S) TestClusterAppPods(c *check.C) {
+	a1 := provisiontest.NewFakeApp("myapp", "python", 0)
+	a2 := provisiontest.NewFakeApp("otherapp", "python", 0)
+	deployLabels := s.appPodLabels(c, a2)
+	deployLabels[tsuruLabelPrefix+"is-deploy"] = "true"
+	isolatedLabels := s.appPodLabels(c, a2)
+	isolatedLabels[tsuruLabelPrefix+"is-isolated-run"] = "true"
+	notReady := apiv1.PodStatus{
+		Conditions: []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionFalse}},
+	}
+	pods := []*apiv1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-2", Namespace: "default", Labels: s.appPodLabels(c, a1)}, Spec: apiv1.PodSpec{NodeName: "n2"}, Status: notReady},
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-1", Namespace: "default", Labels: s.appPodLabels(c, a1)}, Spec: apiv1.PodSpec{NodeName: "n1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-pod-1", Namespace: "default", Labels: s.appPodLabels(c, a2)}, Spec: apiv1.PodSpec{NodeName: "n1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-deploy", Namespace: "default", Labels: deployLabels}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-isolated", Namespace: "default", Labels: isolatedLabels}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "not-tsuru", Namespace: "default"}},
+	}
+	for _, pod := range pods {
+		_, err := s.client.CoreV1().Pods(pod.Namespace).Create(pod)
+		c.Assert(err, check.IsNil)
+	}
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	defer stopClusterController(s.p, s.clusterClient)
+	appPods, err := s.p.ClusterAppPods(s.clusterClient.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(appPods, check.DeepEquals, []ClusterAppPod{
+		{Name: "myapp-pod-1", App: "myapp", Pool: "test-default", Node: "n1", Ready: true},
+		{Name: "myapp-pod-2", App: "myapp", Pool: "test-default", Node: "n2", Ready: false},
+		{Name: "otherapp-pod-1", App: "otherapp", Pool: "test-default", Node: "n1", Ready: true},
+	})
+	_, err = s.p.ClusterAppPods("unknown")
+	c.Assert(err, check.ErrorMatches, `no controller running for cluster "unknown"`)
+}
+
+func (s *S) TestClusterAppRoutingTargets(c *check.C) {
+	a1 := provisiontest.NewFakeApp("myapp", "python", 0)
+	a2 := provisiontest.NewFakeApp("otherapp", "python", 0)
+	a3 := provisiontest.NewFakeApp("stoppedapp", "python", 0)
+	deployLabels := s.appPodLabels(c, a2)
+	deployLabels[tsuruLabelPrefix+"is-deploy"] = "true"
+	isolatedLabels := s.appPodLabels(c, a2)
+	isolatedLabels[tsuruLabelPrefix+"is-isolated-run"] = "true"
+	withIP := func(status apiv1.PodStatus, ip string) apiv1.PodStatus {
+		status.PodIP = ip
+		return status
+	}
+	pods := []*apiv1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-1", Namespace: "default", Labels: s.appPodLabels(c, a1)}, Status: withIP(podStatusReady(true), "10.0.0.2")},
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-2", Namespace: "default", Labels: s.appPodLabels(c, a1)}, Status: withIP(podStatusReady(true), "10.0.0.1")},
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-3", Namespace: "default", Labels: s.appPodLabels(c, a1)}, Status: withIP(podStatusReady(false), "10.0.0.3")},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-pod-1", Namespace: "default", Labels: s.appPodLabels(c, a2)}, Status: withIP(podStatusReady(true), "10.0.1.1")},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-pod-2", Namespace: "default", Labels: s.appPodLabels(c, a2)}, Status: podStatusReady(true)},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-deploy", Namespace: "default", Labels: deployLabels}, Status: withIP(podStatusReady(true), "10.0.1.2")},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-isolated", Namespace: "default", Labels: isolatedLabels}, Status: withIP(podStatusReady(true), "10.0.1.3")},
+		{ObjectMeta: metav1.ObjectMeta{Name: "stoppedapp-pod-1", Namespace: "default", Labels: s.appPodLabels(c, a3)}, Status: withIP(podStatusReady(false), "10.0.2.1")},
+		{ObjectMeta: metav1.ObjectMeta{Name: "not-tsuru", Namespace: "default"}, Status: withIP(podStatusReady(true), "10.0.3.1")},
+	}
+	for _, pod := range pods {
+		_, err := s.client.CoreV1().Pods(pod.Namespace).Create(pod)
+		c.Assert(err, check.IsNil)
+	}
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	defer stopClusterController(s.p, s.clusterClient)
+	targets, err := s.p.ClusterAppRoutingTargets(s.clusterClient.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(targets, check.DeepEquals, map[string][]string{
+		"myapp":    {"10.0.0.1", "10.0.0.2"},
+		"otherapp": {"10.0.1.1"},
+	})
+	_, err = s.p.ClusterAppRoutingTargets("unknown")
+	c.Assert(err, check.ErrorMatches, `no controller running for cluster "unknown"`)
+}
+
+func (s *S) TestClusterControllerNamespaceForApp(c *check.C) {
+	a1 := provisiontest.NewFakeApp("myapp", "python", 0)
+	a2 := provisiontest.NewFakeApp("otherapp", "python", 0)
+	pods := []*apiv1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-1", Namespace: "tsuru-pool1", Labels: s.appPodLabels(c, a1)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod-2", Namespace: "tsuru-pool1", Labels: s.appPodLabels(c, a1)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-pod-1", Namespace: "default", Labels: s.appPodLabels(c, a2)}},
+	}
+	for _, pod := range pods {
+		_, err := s.client.CoreV1().Pods(pod.Namespace).Create(pod)
+		c.Assert(err, check.IsNil)
+	}
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	defer stopClusterController(s.p, s.clusterClient)
+	ns, err := ctr.NamespaceForApp("myapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(ns, check.Equals, "tsuru-pool1")
+	ns, err = ctr.NamespaceForApp("otherapp")
+	c.Assert(err, check.IsNil)
+	c.Assert(ns, check.Equals, "default")
+	_, err = ctr.NamespaceForApp("unknown")
+	c.Assert(err, check.ErrorMatches, `no pods found for app "unknown"`)
+}
+
+func (s *S) TestClusterControllerAddPodSkipLog(c *check.C) {
+	logBuf := safe.NewBuffer(nil)
+	log.SetLogger(log.NewWriterLogger(logBuf, true))
+	defer log.SetLogger(nil)
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	ctr := &clusterController{cluster: s.clusterClient}
+	deployLabels := s.appPodLabels(c, a)
+	deployLabels[tsuruLabelPrefix+"is-deploy"] = "true"
+	ctr.addPod(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-deploy", Labels: deployLabels},
+	}, true, 0)
+	c.Assert(logBuf.String(), check.Matches, `(?s).*skipping routes rebuild for app "myapp": pod "myapp-deploy" is a deploy pod.*`)
+	logBuf.Reset()
+	isolatedLabels, err := provision.ServiceLabels(provision.ServiceLabelsOpts{
+		App: a,
+		ServiceLabelExtendedOpts: provision.ServiceLabelExtendedOpts{
+			Prefix:        tsuruLabelPrefix,
+			Provisioner:   provisionerName,
+			IsIsolatedRun: true,
+		},
+	})
+	c.Assert(err, check.IsNil)
+	ctr.addPod(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-isolated-run", Labels: isolatedLabels.ToLabels()},
+	}, true, 0)
+	c.Assert(logBuf.String(), check.Matches, `(?s).*skipping routes rebuild for app "myapp": pod "myapp-isolated-run" is a isolated run pod.*`)
+	logBuf.Reset()
+	ctr.addPod(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-web", Labels: s.appPodLabels(c, a)},
+	}, true, 0)
+	c.Assert(logBuf.String(), check.Not(check.Matches), `(?s).*skipping routes rebuild.*`)
+}
+
+func (s *S) TestClusterControllerAddPodUnlabeled(c *check.C) {
+	logBuf := safe.NewBuffer(nil)
+	log.SetLogger(log.NewWriterLogger(logBuf, true))
+	defer log.SetLogger(nil)
+	ctr := &clusterController{cluster: s.clusterClient}
+	counter := unlabeledPodsSkipped.WithLabelValues(s.clusterClient.Name, "custom-ns")
+	initial := counterValue(counter)
+	ctr.addPod(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "unlabeled", Namespace: "custom-ns", Labels: map[string]string{"app": "other"}},
+	}, true, 0)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	c.Assert(logBuf.String(), check.Matches, `(?s).*skipping routes rebuild for pod "unlabeled" in namespace "custom-ns": no app name label.*`)
+	ctr.addPod(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "ignored", Namespace: "kube-system"},
+	}, true, 0)
+	c.Assert(counterValue(unlabeledPodsSkipped.WithLabelValues(s.clusterClient.Name, "kube-system")), check.Equals, float64(0))
+}
+
+func (s *S) TestClusterControllerStartContextCanceled(c *check.C) {
+	block := make(chan struct{})
+	defer close(block)
+	s.client.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		<-block
+		return false, nil, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	t0 := time.Now()
+	err := ctr.start(ctx)
+	c.Assert(err, check.ErrorMatches, "error waiting for informer sync: context canceled")
+	c.Assert(time.Since(t0) < defaultInformerSyncTimeout, check.Equals, true)
+}
+
+func (s *S) TestClusterControllerWaitForSyncTimeout(c *check.C) {
+	block := make(chan struct{})
+	defer close(block)
+	s.client.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		<-block
+		return false, nil, nil
+	})
+	histogram := informerSyncDuration.WithLabelValues(s.clusterClient.Name, "pods").(prometheus.Histogram)
+	initial := histogramCount(histogram)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	err := ctr.start(ctx)
+	c.Assert(err, check.Equals, ErrInformerSyncTimeout)
+	c.Assert(histogramCount(histogram), check.Equals, initial+1)
+}
+
+func (s *S) TestClusterControllerWaitForSyncDurationMetric(c *check.C) {
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	histogram := informerSyncDuration.WithLabelValues(s.clusterClient.Name, "pods").(prometheus.Histogram)
+	initial := histogramCount(histogram)
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	err := ctr.start(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(histogramCount(histogram), check.Equals, initial+1)
+}
+
+func (s *S) TestClusterControllerWaitForSyncClusterTimeout(c *check.C) {
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	listDelay := 300 * time.Millisecond
+	s.client.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(listDelay)
+		return false, nil, nil
+	})
+	s.clusterClient.CustomData[informerSyncTimeoutKey] = "100ms"
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	err := ctr.start(context.Background())
+	c.Assert(err, check.Equals, ErrInformerSyncTimeout)
+	ctr.stop()
+	s.clusterClient.CustomData[informerSyncTimeoutKey] = "5s"
+	ctr = &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	err = ctr.start(context.Background())
+	c.Assert(err, check.IsNil)
+	s.clusterClient.CustomData[informerSyncTimeoutKey] = "abc"
+	invalidCtr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer invalidCtr.stop()
+	err = invalidCtr.start(context.Background())
+	c.Assert(err, check.ErrorMatches, "invalid informer-sync-timeout: .*")
+}
+
+func (s *S) TestClusterControllerWaitForSyncRetry(c *check.C) {
+	config.Set("kubernetes:informer-sync-attempts", 3)
+	defer config.Unset("kubernetes:informer-sync-attempts")
+	oldBackoff := informerSyncBackoff
+	informerSyncBackoff = 10 * time.Millisecond
+	defer func() {
+		informerSyncBackoff = oldBackoff
+		waitForCacheSync = cache.WaitForCacheSync
+	}()
+	var attempts int32
+	waitForCacheSync = func(stopCh <-chan struct{}, cacheSyncs ...cache.InformerSynced) bool {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return false
+		}
+		return cache.WaitForCacheSync(stopCh, cacheSyncs...)
+	}
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	err := ctr.start(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(atomic.LoadInt32(&attempts), check.Equals, int32(2))
+	c.Assert(ctr.status().LastError, check.IsNil)
+}
+
+func (s *S) TestClusterControllerWaitForSyncRetryExhausted(c *check.C) {
+	oldBackoff := informerSyncBackoff
+	informerSyncBackoff = 10 * time.Millisecond
+	defer func() {
+		informerSyncBackoff = oldBackoff
+		waitForCacheSync = cache.WaitForCacheSync
+	}()
+	var attempts int32
+	waitForCacheSync = func(stopCh <-chan struct{}, cacheSyncs ...cache.InformerSynced) bool {
+		atomic.AddInt32(&attempts, 1)
+		return false
+	}
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	err := ctr.start(context.Background())
+	c.Assert(err, check.Equals, ErrInformerSyncTimeout)
+	c.Assert(atomic.LoadInt32(&attempts), check.Equals, int32(1))
+	ctr.stop()
+	config.Set("kubernetes:informer-sync-attempts", 3)
+	defer config.Unset("kubernetes:informer-sync-attempts")
+	atomic.StoreInt32(&attempts, 0)
+	ctr = &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	err = ctr.start(context.Background())
+	c.Assert(err, check.Equals, ErrInformerSyncTimeout)
+	c.Assert(atomic.LoadInt32(&attempts), check.Equals, int32(3))
+}
+
+func (s *S) TestClusterControllerWaitForSyncStopped(c *check.C) {
+	block := make(chan struct{})
+	defer close(block)
+	s.client.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		<-block
+		return false, nil, nil
+	})
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	time.AfterFunc(100*time.Millisecond, ctr.stop)
+	err := ctr.start(context.Background())
+	c.Assert(err, check.Equals, ErrControllerStopped)
+}
+
+func (s *S) TestInitAllControllersAggregatesClusterErrors(c *check.C) {
+	s.mockService.Cluster.OnFindByProvisioner = func(provName string) ([]provTypes.Cluster, error) {
+		var clusters []provTypes.Cluster
+		for _, name := range []string{"c1", "c2", "c3"} {
+			clusters = append(clusters, provTypes.Cluster{
+				Name:        name,
+				Addresses:   []string{"https://clusteraddr"},
+				Provisioner: provisionerName,
+				CustomData:  map[string]string{},
+			})
+		}
+		return clusters, nil
+	}
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		if client.Name != "c1" {
+			return nil, errors.Errorf("invalid config for %s", client.Name)
+		}
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	err := initAllControllers(context.Background(), s.p)
+	c.Assert(err, check.NotNil)
+	multiErr, ok := err.(*tsuruErrors.MultiError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(multiErr.Len(), check.Equals, 2)
+	c.Assert(err, check.ErrorMatches, `(?s).*unable to start controller for cluster "c2": invalid config for c2.*`)
+	c.Assert(err, check.ErrorMatches, `(?s).*unable to start controller for cluster "c3": invalid config for c3.*`)
+	_, ok = s.p.clusterControllers["c1"]
+	c.Assert(ok, check.Equals, true)
+	_, ok = s.p.clusterControllers["c2"]
+	c.Assert(ok, check.Equals, false)
+	for _, name := range []string{"c1", "c2", "c3"} {
+		stopClusterController(s.p, &ClusterClient{Cluster: &provTypes.Cluster{Name: name}})
+	}
+}
+
+func (s *S) TestGetClusterControllerCachesStartFailure(c *check.C) {
+	var calls int32
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("invalid config")
+	}
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.ErrorMatches, "invalid config")
+	_, err = getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.ErrorMatches, "invalid config")
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+	stopClusterController(s.p, s.clusterClient)
+	_, err = getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.ErrorMatches, "invalid config")
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(2))
+}
+
+func (s *S) TestGetClusterControllerStartFailureEvent(c *check.C) {
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		return nil, errors.New("invalid config")
+	}
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.ErrorMatches, "invalid config")
+	c.Assert(eventtest.EventDesc{
+		Target:       event.Target{Type: event.TargetTypeCluster, Value: s.clusterClient.Name},
+		Kind:         "cluster-controller-start",
+		ErrorMatches: `unable to start controller for cluster "c1": invalid config`,
+	}, eventtest.HasEvent)
+}
+
+func (s *S) TestGetClusterControllerFailingClusterDoesNotBlock(c *check.C) {
+	block := make(chan struct{})
+	defer close(block)
+	s.client.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		<-block
+		return false, nil, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := getClusterController(ctx, s.p, s.clusterClient)
+	c.Assert(err, check.Equals, ErrInformerSyncTimeout)
+	t0 := time.Now()
+	_, err = getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.Equals, ErrInformerSyncTimeout)
+	c.Assert(time.Since(t0) < 50*time.Millisecond, check.Equals, true)
+	oldTTL := controllerFailureTTL
+	controllerFailureTTL = 0
+	defer func() { controllerFailureTTL = oldTTL }()
+	s.p.mu.Lock()
+	delete(s.p.controllerFailures, s.clusterClient.Name)
+	s.p.mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t0 = time.Now()
+	_, err = getClusterController(ctx, s.p, s.clusterClient)
+	c.Assert(err, check.Equals, ErrInformerSyncTimeout)
+	c.Assert(time.Since(t0) >= 100*time.Millisecond, check.Equals, true)
+}
+
+func (s *S) TestClusterControllerStopWithTimeoutWaitsPendingEvents(c *check.C) {
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	started := make(chan struct{})
+	var stoppedBeforeDone bool
+	go ctr.handleEvent("pod", "update", func() error {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-ctr.stopCh:
+			stoppedBeforeDone = true
+		default:
+		}
+		return nil
+	})
+	<-started
+	ctr.stopWithTimeout(5 * time.Second)
+	c.Assert(stoppedBeforeDone, check.Equals, false)
+	select {
+	case <-ctr.stopCh:
+	default:
+		c.Fatal("stop channel should be closed")
+	}
+	var called bool
+	ctr.handleEvent("pod", "update", func() error {
+		called = true
+		return nil
+	})
+	c.Assert(called, check.Equals, false)
+}
+
+func (s *S) TestClusterControllerEventErrorsLogLevel(c *check.C) {
+	logBuf := safe.NewBuffer(nil)
+	log.SetLogger(log.NewWriterLogger(logBuf, true))
+	defer log.SetLogger(nil)
+	counter := eventErrors.WithLabelValues(s.clusterClient.Name, "pod", "update")
+	initial := counterValue(counter)
+	s.clusterClient.CustomData[eventErrorsLogLevelKey] = "debug"
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	ctr.handleEvent("pod", "update", func() error {
+		return errors.New("pod is gone")
+	})
+	ctr.pendingEvents.Wait()
+	c.Assert(logBuf.String(), check.Matches, `(?s).*DEBUG: \[router-update-controller\] error on update pod event: pod is gone\n.*`)
+	c.Assert(logBuf.String(), check.Not(check.Matches), `(?s).*ERROR: .*`)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	stopClusterController(s.p, s.clusterClient)
+	logBuf = safe.NewBuffer(nil)
+	log.SetLogger(log.NewWriterLogger(logBuf, true))
+	delete(s.clusterClient.CustomData, eventErrorsLogLevelKey)
+	ctr, err = getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	ctr.handleEvent("pod", "update", func() error {
+		return errors.New("pod is gone")
+	})
+	ctr.pendingEvents.Wait()
+	c.Assert(logBuf.String(), check.Matches, `(?s).*ERROR: \[router-update-controller\] error on update pod event: pod is gone\n.*`)
+	c.Assert(counterValue(counter), check.Equals, initial+2)
+	nodeCounter := eventErrors.WithLabelValues(s.clusterClient.Name, "node", "delete")
+	nodeInitial := counterValue(nodeCounter)
+	ctr.handleEvent("node", "delete", func() error {
+		return errors.New("node data not found")
+	})
+	ctr.pendingEvents.Wait()
+	c.Assert(logBuf.String(), check.Matches, `(?s).*ERROR: \[router-update-controller\] error on delete node event: node data not found\n.*`)
+	c.Assert(counterValue(nodeCounter), check.Equals, nodeInitial+1)
+	c.Assert(counterValue(counter), check.Equals, initial+2)
+}
+
+func (s *S) TestClusterControllerEventWorkersOptIn(c *check.C) {
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(ctr.eventSlots, check.IsNil)
+	var handled bool
+	ctr.handleEvent("pod", "update", func() error {
+		handled = true
+		return nil
+	})
+	c.Assert(handled, check.Equals, true)
+	stopClusterController(s.p, s.clusterClient)
+	s.clusterClient.CustomData[eventWorkersKey] = "3"
+	ctr, err = getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(cap(ctr.eventSlots), check.Equals, 3)
+}
+
+func (s *S) TestClusterControllerHandleEventConcurrencyLimit(c *check.C) {
+	ctr := &clusterController{
+		cluster:    s.clusterClient,
+		stopCh:     make(chan struct{}),
+		eventSlots: make(chan struct{}, 2),
+	}
+	var running, maxRunning int32
+	block := make(chan struct{})
+	handled := make(chan struct{}, 4)
+	fn := func() error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-block
+		atomic.AddInt32(&running, -1)
+		handled <- struct{}{}
+		return nil
+	}
+	// The informer delivers events sequentially, the first two are handled
+	// concurrently and the third waits for a free worker.
+	ctr.handleEvent("pod", "update", fn)
+	ctr.handleEvent("pod", "update", fn)
+	dispatched := make(chan struct{})
+	go func() {
+		ctr.handleEvent("pod", "update", fn)
+		ctr.handleEvent("pod", "update", fn)
+		close(dispatched)
+	}()
+	timeout := time.After(5 * time.Second)
+	for atomic.LoadInt32(&running) != 2 {
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for concurrent events, got %d", atomic.LoadInt32(&running))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	select {
+	case <-dispatched:
+		c.Fatal("events should wait for a free worker")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(block)
+	for i := 0; i < 4; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timeout waiting for event %d", i)
+		}
+	}
+	<-dispatched
+	c.Assert(atomic.LoadInt32(&maxRunning), check.Equals, int32(2))
+}
+
+func (s *S) TestClusterControllerPendingEventsGauge(c *check.C) {
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	gauge := pendingEventsGauge.WithLabelValues(s.clusterClient.Name)
+	initial := gaugeValue(gauge)
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctr.handleEvent("pod", "update", func() error {
+				<-block
+				return nil
+			})
+		}()
+	}
+	timeout := time.After(5 * time.Second)
+	for gaugeValue(gauge) != initial+2 {
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for pending events, got %v", gaugeValue(gauge)-initial)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(block)
+	wg.Wait()
+	c.Assert(gaugeValue(gauge), check.Equals, initial)
+}
+
+func (s *S) TestClusterControllerStartStopNoGoroutineLeak(c *check.C) {
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	_, err := s.client.CoreV1().Services("default").Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "lb1", Namespace: "default", UID: "lb1-uid", CreationTimestamp: metav1.Now()},
+		Spec:       apiv1.ServiceSpec{Type: apiv1.ServiceTypeLoadBalancer},
+	})
+	c.Assert(err, check.IsNil)
+	cycle := func() {
+		ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+		c.Assert(err, check.IsNil)
+		_, err = ctr.getServiceInformer()
+		c.Assert(err, check.IsNil)
+		_, err = ctr.getNodeInformer()
+		c.Assert(err, check.IsNil)
+		stopClusterController(s.p, s.clusterClient)
+		ctr.lbMu.Lock()
+		c.Assert(ctr.pendingLBs, check.HasLen, 0)
+		ctr.lbMu.Unlock()
+		ctr.stop()
+	}
+	// the first cycle may start goroutines living for the whole process
+	cycle()
+	initial := stdRuntime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		cycle()
+	}
+	timeout := time.After(5 * time.Second)
+	for stdRuntime.NumGoroutine() > initial {
+		select {
+		case <-timeout:
+			buf := make([]byte, 1<<20)
+			c.Fatalf("leaked goroutines, before: %d, after: %d\n%s", initial, stdRuntime.NumGoroutine(), buf[:stdRuntime.Stack(buf, true)])
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *S) TestRestartClusterController(c *check.C) {
+	var factoryClients []*ClusterClient
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		factoryClients = append(factoryClients, client)
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	oldCtr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c2Client := *s.clusterClient
+	c2Client.Cluster = &provTypes.Cluster{Name: "c2", Provisioner: provisionerName}
+	c2Ctr, err := getClusterController(context.Background(), s.p, &c2Client)
+	c.Assert(err, check.IsNil)
+	defer stopClusterController(s.p, &c2Client)
+	rotated := *s.clusterClient.Cluster
+	rotated.ClientKey = []byte("new-key")
+	s.mockService.Cluster.OnFindByName = func(name string) (*provTypes.Cluster, error) {
+		c.Assert(name, check.Equals, "c1")
+		return &rotated, nil
+	}
+	err = s.p.RestartClusterController("c1")
+	c.Assert(err, check.IsNil)
+	select {
+	case <-oldCtr.stopCh:
+	default:
+		c.Fatal("old controller not stopped")
+	}
+	s.p.mu.Lock()
+	newCtr := s.p.clusterControllers["c1"]
+	c.Assert(s.p.clusterControllers["c2"], check.Equals, c2Ctr)
+	s.p.mu.Unlock()
+	c.Assert(newCtr, check.NotNil)
+	c.Assert(newCtr, check.Not(check.Equals), oldCtr)
+	c.Assert(newCtr.status().Synced, check.Equals, true)
+	c.Assert(newCtr.cluster.ClientKey, check.DeepEquals, []byte("new-key"))
+	c.Assert(factoryClients, check.HasLen, 3)
+	c.Assert(factoryClients[2], check.Equals, newCtr.cluster)
+	select {
+	case <-c2Ctr.stopCh:
+		c.Fatal("controller of another cluster stopped")
+	default:
+	}
+}
+
+func (s *S) TestRestartClusterControllerNotFound(c *check.C) {
+	s.mockService.Cluster.OnFindByName = func(name string) (*provTypes.Cluster, error) {
+		return nil, provTypes.ErrClusterNotFound
+	}
+	err := s.p.RestartClusterController("unknown")
+	c.Assert(err, check.Equals, provTypes.ErrClusterNotFound)
+}
+
+func (s *S) TestLookupClusterController(c *check.C) {
+	ctr, ok := s.p.lookupClusterController("unknown")
+	c.Assert(ok, check.Equals, false)
+	c.Assert(ctr, check.IsNil)
+	c.Assert(s.p.clusterControllers, check.HasLen, 0)
+	started, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	ctr, ok = s.p.lookupClusterController(s.clusterClient.Name)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(ctr, check.Equals, started)
+}
+
+func (s *S) TestClusterControllerPauseResume(c *check.C) {
+	s.clusterClient.CustomData[routerAddressLocalKey] = "true"
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	informer, err := ctr.getPodInformer()
+	c.Assert(err, check.IsNil)
+	counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "myapp")
+	initial := counterValue(counter)
+	ctr.Pause()
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-pod", Namespace: "default", Labels: s.appPodLabels(c, a)},
+		Status:     podStatusReady(false),
+	}
+	pod, err = s.client.CoreV1().Pods("default").Create(pod)
+	c.Assert(err, check.IsNil)
+	pod.ResourceVersion = "2"
+	pod.Status = podStatusReady(true)
+	_, err = s.client.CoreV1().Pods("default").Update(pod)
+	c.Assert(err, check.IsNil)
+	timeout := time.After(5 * time.Second)
+	for {
+		cached, errGet := informer.Lister().Pods("default").Get(pod.Name)
+		if errGet == nil && isPodReady(cached) {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for pod update in cache")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(counterValue(counter), check.Equals, initial)
+	err = ctr.Resume()
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	err = ctr.Resume()
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+}
+
+func (s *S) TestClusterControllerStopTwice(c *check.C) {
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	ctr.stop()
+	ctr.stop()
+	select {
+	case <-ctr.stopCh:
+	default:
+		c.Fatal("stop channel should be closed")
+	}
+	s.p.mu.Lock()
+	s.p.clusterControllers[s.clusterClient.Name] = ctr
+	s.p.mu.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stopClusterController(s.p, s.clusterClient)
+		}()
+	}
+	wg.Wait()
+	_, ok := s.p.lookupClusterController(s.clusterClient.Name)
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestClusterControllerStopWithTimeoutExpired(c *check.C) {
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	started := make(chan struct{})
+	block := make(chan struct{})
+	defer close(block)
+	go ctr.handleEvent("pod", "update", func() error {
+		close(started)
+		<-block
+		return nil
+	})
+	<-started
+	t0 := time.Now()
+	ctr.stopWithTimeout(100 * time.Millisecond)
+	c.Assert(time.Since(t0) < 5*time.Second, check.Equals, true)
+	select {
+	case <-ctr.stopCh:
+	default:
+		c.Fatal("stop channel should be closed")
+	}
+}
+
+func (s *S) TestClusterControllerWatchdogRestartsStalledInformers(c *check.C) {
+	oldInterval, oldTimeout := informerWatchdogInterval, informerStallTimeout
+	defer func() {
+		informerWatchdogInterval, informerStallTimeout = oldInterval, oldTimeout
+	}()
+	informerWatchdogInterval = 10 * time.Millisecond
+	informerStallTimeout = 50 * time.Millisecond
+	var factories int32
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		if atomic.AddInt32(&factories, 1) == 1 {
+			factoryOpts := &informerFactoryOptions{}
+			for _, opt := range opts {
+				opt(factoryOpts)
+			}
+			c.Assert(factoryOpts.podListWatchFunc, check.NotNil)
+			factoryOpts.podListWatchFunc(errors.New("connection refused"))
+		}
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	timeout := time.After(5 * time.Second)
+	for atomic.LoadInt32(&factories) < 2 {
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for informer factory to be recreated")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	informer, err := ctr.getPodInformer()
+	c.Assert(err, check.IsNil)
+	c.Assert(informer.Informer().HasSynced(), check.Equals, true)
+}
+
+func (s *S) TestClusterControllerWatchdogKeepsQuietInformers(c *check.C) {
+	oldInterval, oldTimeout := informerWatchdogInterval, informerStallTimeout
+	defer func() {
+		informerWatchdogInterval, informerStallTimeout = oldInterval, oldTimeout
+	}()
+	informerWatchdogInterval = 10 * time.Millisecond
+	informerStallTimeout = 50 * time.Millisecond
+	var factories int32
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		atomic.AddInt32(&factories, 1)
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	time.Sleep(200 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&factories), check.Equals, int32(1))
+	c.Assert(ctr.status().LastError, check.IsNil)
+}
+
+func (s *S) TestListWatchHealth(c *check.C) {
+	var h listWatchHealth
+	since, err := h.failing()
+	c.Assert(err, check.IsNil)
+	c.Assert(since.IsZero(), check.Equals, true)
+	h.record(errors.New("err1"))
+	since, err = h.failing()
+	c.Assert(err, check.ErrorMatches, "err1")
+	h.record(errors.New("err2"))
+	since2, err := h.failing()
+	c.Assert(err, check.ErrorMatches, "err2")
+	c.Assert(since2, check.Equals, since)
+	h.record(nil)
+	since, err = h.failing()
+	c.Assert(err, check.IsNil)
+	c.Assert(since.IsZero(), check.Equals, true)
+}
+
+func (s *S) TestClusterControllerSweepPodCache(c *check.C) {
+	logBuf := safe.NewBuffer(nil)
+	log.SetLogger(log.NewWriterLogger(logBuf, true))
+	defer log.SetLogger(nil)
+	for _, name := range []string{"p1", "p2"} {
+		_, err := s.client.CoreV1().Pods("default").Create(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name)},
+		})
+		c.Assert(err, check.IsNil)
+	}
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	informer, err := ctr.getPodInformer()
+	c.Assert(err, check.IsNil)
+	err = ctr.sweepPodCache()
+	c.Assert(err, check.IsNil)
+	c.Assert(logBuf.String(), check.Equals, "")
+	indexer := informer.Informer().GetIndexer()
+	err = indexer.Add(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "ghost", Namespace: "default", UID: "ghost"},
+	})
+	c.Assert(err, check.IsNil)
+	p2, err := informer.Lister().Pods("default").Get("p2")
+	c.Assert(err, check.IsNil)
+	err = indexer.Delete(p2)
+	c.Assert(err, check.IsNil)
+	stale := podCacheDiscrepancies.WithLabelValues(s.clusterClient.Name, "stale")
+	missing := podCacheDiscrepancies.WithLabelValues(s.clusterClient.Name, "missing")
+	staleBefore, missingBefore := counterValue(stale), counterValue(missing)
+	err = ctr.sweepPodCache()
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(stale)-staleBefore, check.Equals, float64(1))
+	c.Assert(counterValue(missing)-missingBefore, check.Equals, float64(1))
+	c.Assert(logBuf.String(), check.Matches, `(?s).*stale pods \[default/ghost\] and missing pods \[default/p2\].*`)
+	_, err = informer.Lister().Pods("default").Get("ghost")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestClusterControllerSweepPodCacheRelist(c *check.C) {
+	s.clusterClient.CustomData[podCacheRelistKey] = "true"
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	informer, err := ctr.getPodInformer()
+	c.Assert(err, check.IsNil)
+	err = informer.Informer().GetIndexer().Add(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "ghost", Namespace: "default", UID: "ghost"},
+	})
+	c.Assert(err, check.IsNil)
+	err = ctr.sweepPodCache()
+	c.Assert(err, check.IsNil)
+	informer, err = ctr.getPodInformer()
+	c.Assert(err, check.IsNil)
+	_, err = informer.Lister().Pods("default").Get("ghost")
+	c.Assert(k8sErrors.IsNotFound(err), check.Equals, true)
+}
+
+// buildPodMeta returns the metadata of a build pod of the app created by the
+// deploy event, labeled as in deploy.go.
+func buildPodMeta(c *check.C, a provision.App, name, eventID string) metav1.ObjectMeta {
+	ls, err := provision.ServiceLabels(provision.ServiceLabelsOpts{
+		App: a,
+		ServiceLabelExtendedOpts: provision.ServiceLabelExtendedOpts{
+			IsBuild:     true,
+			Prefix:      tsuruLabelPrefix,
+			Provisioner: provisionerName,
+		},
+	})
+	c.Assert(err, check.IsNil)
+	labels, annotations := provision.SplitServiceLabelsAnnotations(ls)
+	meta := metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   "default",
+		Labels:      labels.ToLabels(),
+		Annotations: annotations.ToLabels(),
+	}
+	meta.Annotations[tsuruEventIDMeta] = eventID
+	return meta
+}
+
+func (s *S) TestClusterControllerDeployPodHandler(c *check.C) {
+	type result struct {
+		app, eventID, pod string
+		err               error
+	}
+	resultCh := make(chan result, 10)
+	s.p.SetDeployPodHandler(func(appName, eventID, podName string, err error) {
+		resultCh <- result{app: appName, eventID: eventID, pod: podName, err: err}
+	})
+	defer s.p.SetDeployPodHandler(nil)
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	pod := &apiv1.Pod{
+		ObjectMeta: buildPodMeta(c, a, "myapp-v1-deploy", "evt1"),
+		Status:     apiv1.PodStatus{Phase: apiv1.PodPending},
+	}
+	pod.ResourceVersion = "1"
+	pod, err = s.client.CoreV1().Pods("default").Create(pod)
+	c.Assert(err, check.IsNil)
+	pod.ResourceVersion = "2"
+	pod.Status.Phase = apiv1.PodRunning
+	pod, err = s.client.CoreV1().Pods("default").Update(pod)
+	c.Assert(err, check.IsNil)
+	pod.ResourceVersion = "3"
+	pod.Status.Phase = apiv1.PodSucceeded
+	_, err = s.client.CoreV1().Pods("default").Update(pod)
+	c.Assert(err, check.IsNil)
+	select {
+	case r := <-resultCh:
+		c.Assert(r, check.DeepEquals, result{app: "myapp", eventID: "evt1", pod: "myapp-v1-deploy"})
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for deploy pod handler")
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(resultCh, check.HasLen, 0)
+}
+
+func (s *S) TestClusterControllerConfigMapChange(c *check.C) {
+	rebuildCh := s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	cm, err := s.client.CoreV1().ConfigMaps("default").Create(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "myapp-router",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{"tsuru.io/app-name": "myapp"},
+		},
+		Data: map[string]string{"timeout": "10s"},
+	})
+	c.Assert(err, check.IsNil)
+	other, err := s.client.CoreV1().ConfigMaps("default").Create(&apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default", ResourceVersion: "1"},
+		Data:       map[string]string{"timeout": "10s"},
+	})
+	c.Assert(err, check.IsNil)
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(ctr.configMapInformer, check.IsNil)
+	stopClusterController(s.p, s.clusterClient)
+	s.clusterClient.CustomData[configMapRebuildKey] = "true"
+	ctr, err = getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(ctr.configMapInformer, check.NotNil)
+	_, err = ctr.getConfigMapInformer()
+	c.Assert(err, check.IsNil)
+	other.ResourceVersion = "2"
+	other.Data["timeout"] = "20s"
+	_, err = s.client.CoreV1().ConfigMaps("default").Update(other)
+	c.Assert(err, check.IsNil)
+	cm.ResourceVersion = "2"
+	cm.Data["timeout"] = "20s"
+	_, err = s.client.CoreV1().ConfigMaps("default").Update(cm)
+	c.Assert(err, check.IsNil)
+	select {
+	case appName := <-rebuildCh:
+		c.Assert(appName, check.Equals, "myapp")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for rebuild call")
+	}
+	select {
+	case appName := <-rebuildCh:
+		c.Fatalf("unexpected rebuild call for %q", appName)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func (s *S) TestClusterControllerConfigMapDelete(c *check.C) {
+	s.watchRebuilds(c)
+	defer rebuild.Shutdown(context.Background())
+	ctr := &clusterController{cluster: s.clusterClient}
+	counter := routesRebuildEnqueued.WithLabelValues(s.clusterClient.Name, "myapp")
+	initial := counterValue(counter)
+	cm := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "myapp-router",
+			Namespace: "default",
+			Labels:    map[string]string{"tsuru.io/app-name": "myapp"},
+		},
+	}
+	err := ctr.onConfigMapDelete(cache.DeletedFinalStateUnknown{Key: "default/myapp-router", Obj: cm})
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+	cm.Namespace = "kube-system"
+	err = ctr.onConfigMapDelete(cm)
+	c.Assert(err, check.IsNil)
+	c.Assert(counterValue(counter), check.Equals, initial+1)
+}
+
+func (s *S) TestClusterControllerContainerRestartHandler(c *check.C) {
+	type restart struct {
+		app, pod, container string
+		delta               int32
+	}
+	restartCh := make(chan restart, 10)
+	s.p.SetContainerRestartHandler(func(appName, podName, containerName string, restartDelta int32) {
+		restartCh <- restart{app: appName, pod: podName, container: containerName, delta: restartDelta}
+	})
+	defer s.p.SetContainerRestartHandler(nil)
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-web-1", Namespace: "default", Labels: s.appPodLabels(c, a)},
+		Status: apiv1.PodStatus{
+			ContainerStatuses: []apiv1.ContainerStatus{
+				{Name: "myapp-web", RestartCount: 1},
+				{Name: "sidecar", RestartCount: 0},
+			},
+		},
+	}
+	pod, err = s.client.CoreV1().Pods("default").Create(pod)
+	c.Assert(err, check.IsNil)
+	pod.ResourceVersion = "2"
+	pod.Status.ContainerStatuses[0].RestartCount = 4
+	_, err = s.client.CoreV1().Pods("default").Update(pod)
+	c.Assert(err, check.IsNil)
+	select {
+	case r := <-restartCh:
+		c.Assert(r, check.DeepEquals, restart{app: "myapp", pod: "myapp-web-1", container: "myapp-web", delta: 3})
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for container restart handler")
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(restartCh, check.HasLen, 0)
+}
+
+func (s *S) TestClusterControllerCheckDeployFinished(c *check.C) {
+	var results []error
+	ctr := &clusterController{
+		cluster: s.clusterClient,
+		deployPodHandler: func(appName, eventID, podName string, err error) {
+			c.Assert(appName, check.Equals, "myapp")
+			c.Assert(eventID, check.Equals, "evt1")
+			c.Assert(podName, check.Equals, "myapp-v1-deploy")
+			results = append(results, err)
+		},
+	}
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	oldPod := &apiv1.Pod{
+		ObjectMeta: buildPodMeta(c, a, "myapp-v1-deploy", "evt1"),
+		Status:     apiv1.PodStatus{Phase: apiv1.PodRunning},
+	}
+	newPod := oldPod.DeepCopy()
+	newPod.Status = apiv1.PodStatus{Phase: apiv1.PodFailed, Reason: "Evicted", Message: "The node was low on resource: memory."}
+	ctr.checkDeployFinished(oldPod, newPod)
+	ctr.checkDeployFinished(newPod, newPod)
+	c.Assert(results, check.HasLen, 1)
+	c.Assert(results[0], check.ErrorMatches, `deploy pod "myapp-v1-deploy" failed: Evicted: The node was low on resource: memory.`)
+	otherPod := newPod.DeepCopy()
+	otherPod.Labels["tsuru.io/is-build"] = "false"
+	ctr.checkDeployFinished(oldPod, otherPod)
+	c.Assert(results, check.HasLen, 1)
+	err := ctr.onDelete(newPod)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 1)
+	s.clusterClient.CustomData[informerActivePodsOnlyKey] = "true"
+	err = ctr.onDelete(newPod)
+	c.Assert(err, check.IsNil)
+	c.Assert(results, check.HasLen, 2)
+}
+
+type toggleSyncPodInformer struct {
+	v1informers.PodInformer
+	cache.SharedIndexInformer
+	synced int32
+}
+
+func (i *toggleSyncPodInformer) Informer() cache.SharedIndexInformer {
+	return i
+}
+
+func (i *toggleSyncPodInformer) HasSynced() bool {
+	return atomic.LoadInt32(&i.synced) == 1
+}
+
+func (i *toggleSyncPodInformer) LastSyncResourceVersion() string {
+	return "1"
+}
+
+func (s *S) TestClusterControllerWatchdogInformerDesync(c *check.C) {
+	desyncCh := make(chan string, 10)
+	s.p.SetInformerDesyncHandler(func(cluster string) {
+		desyncCh <- cluster
+	})
+	defer s.p.SetInformerDesyncHandler(nil)
+	informer := &toggleSyncPodInformer{}
+	ctr := &clusterController{
+		cluster:       s.clusterClient,
+		stopCh:        make(chan struct{}),
+		podInformer:   informer,
+		desyncHandler: s.p.desyncHandler,
+	}
+	defer ctr.stop()
+	go ctr.watchdog(10*time.Millisecond, time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(desyncCh, check.HasLen, 0)
+	atomic.StoreInt32(&informer.synced, 1)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(desyncCh, check.HasLen, 0)
+	atomic.StoreInt32(&informer.synced, 0)
+	select {
+	case cluster := <-desyncCh:
+		c.Assert(cluster, check.Equals, s.clusterClient.Name)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for desync callback")
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(desyncCh, check.HasLen, 0)
+	c.Assert(ctr.status().LastError, check.ErrorMatches, "pod informer lost sync")
+}
+
+func (s *S) TestActiveClusterControllersSyncFailure(c *check.C) {
+	blockedClient := fake.NewSimpleClientset()
+	block := make(chan struct{})
+	defer close(block)
+	blockedClient.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		<-block
+		return false, nil, nil
+	})
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		if client.Name == "c2" {
+			return informers.NewSharedInformerFactory(blockedClient, time.Minute), nil
+		}
+		return s.factory, nil
+	}
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c2Client := *s.clusterClient
+	c2Client.Cluster = &provTypes.Cluster{Name: "c2", Provisioner: provisionerName}
+	c2 := &clusterController{cluster: &c2Client, stopCh: make(chan struct{})}
+	defer c2.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = c2.start(ctx)
+	c.Assert(err, check.NotNil)
+	s.p.mu.Lock()
+	s.p.clusterControllers["c2"] = c2
+	s.p.mu.Unlock()
+	statuses := s.p.ActiveClusterControllers()
+	c.Assert(statuses, check.HasLen, 2)
+	c.Assert(statuses[0].Cluster, check.Equals, "c1")
+	c.Assert(statuses[0].Synced, check.Equals, true)
+	c.Assert(statuses[0].LastError, check.IsNil)
+	c.Assert(statuses[0].LastSync.IsZero(), check.Equals, false)
+	c.Assert(statuses[1].Cluster, check.Equals, "c2")
+	c.Assert(statuses[1].Synced, check.Equals, false)
+	c.Assert(statuses[1].LastError, check.Equals, ErrInformerSyncTimeout)
+	c.Assert(statuses[1].LastSync.IsZero(), check.Equals, true)
+}
+
+func (s *S) TestActiveClusterControllers(c *check.C) {
+	c.Assert(s.p.ActiveClusterControllers(), check.HasLen, 0)
+	_, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c2Client := *s.clusterClient
+	c2Client.Cluster = &provTypes.Cluster{Name: "c2", Provisioner: provisionerName}
+	_, err = getClusterController(context.Background(), s.p, &c2Client)
+	c.Assert(err, check.IsNil)
+	defer stopClusterController(s.p, &c2Client)
+	time.Sleep(10 * time.Millisecond)
+	statuses := s.p.ActiveClusterControllers()
+	c.Assert(statuses, check.HasLen, 2)
+	c.Assert(statuses[0].Cluster, check.Equals, "c1")
+	c.Assert(statuses[0].Synced, check.Equals, true)
+	c.Assert(statuses[0].LastError, check.IsNil)
+	c.Assert(statuses[1].Cluster, check.Equals, "c2")
+	c.Assert(statuses[1].Synced, check.Equals, true)
+	c.Assert(statuses[1].LastError, check.IsNil)
+	c.Assert(statuses[1].Uptime >= 10*time.Millisecond, check.Equals, true)
+	c.Assert(statuses[0].Uptime >= statuses[1].Uptime, check.Equals, true)
+	stopClusterController(s.p, s.clusterClient)
+	statuses = s.p.ActiveClusterControllers()
+	c.Assert(statuses, check.HasLen, 1)
+	c.Assert(statuses[0].Cluster, check.Equals, "c2")
+}
+
+func (s *S) TestInformerFactoryResyncPeriod(c *check.C) {
+	factory, err := defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(factoryResync(factory), check.Equals, time.Minute)
+	s.clusterClient.CustomData[informerResyncKey] = "2m"
+	factory, err = defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(factoryResync(factory), check.Equals, 2*time.Minute)
+	s.clusterClient.CustomData[informerResyncKey] = "100ms"
+	_, err = defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.ErrorMatches, ".*must be at least 5s.*")
+}
+
+func (s *S) TestInformerFactoryResyncJitter(c *check.C) {
+	values := []float64{0, 0.25, 0.999}
+	resyncJitterRand = func() float64 {
+		v := values[0]
+		values = values[1:]
+		return v
+	}
+	var periods []time.Duration
+	for range values {
+		factory, err := defaultInformerFactory(s.clusterClient)
+		c.Assert(err, check.IsNil)
+		periods = append(periods, factoryResync(factory))
+	}
+	c.Assert(periods[0], check.Equals, 54*time.Second)
+	c.Assert(periods[1], check.Equals, 57*time.Second)
+	c.Assert(periods[2] > 65*time.Second && periods[2] < 66*time.Second, check.Equals, true)
+	s.clusterClient.CustomData[informerResyncKey] = "5s"
+	values = []float64{0, 0.999}
+	periods = nil
+	for range values {
+		factory, err := defaultInformerFactory(s.clusterClient)
+		c.Assert(err, check.IsNil)
+		periods = append(periods, factoryResync(factory))
+	}
+	c.Assert(periods[0], check.Equals, minInformerResync)
+	c.Assert(periods[1] > 5*time.Second && periods[1] < 6*time.Second, check.Equals, true)
+}
+
+func (s *S) TestInformerFactoryNilRestConfig(c *check.C) {
+	client := &ClusterClient{Cluster: &provTypes.Cluster{Name: "c1"}}
+	factory, err := defaultInformerFactory(client)
+	c.Assert(err, check.ErrorMatches, `cluster "c1" has no rest config, unable to create informers`)
+	c.Assert(factory, check.IsNil)
+}
+
+func (s *S) TestInformerFactoryCABundle(c *check.C) {
+	var configs []*rest.Config
+	ClientForConfig = func(conf *rest.Config) (kubernetes.Interface, error) {
+		configs = append(configs, conf)
+		return s.client, nil
+	}
+	s.clusterClient.restConfig.TLSClientConfig.CAData = []byte("cluster-ca")
+	_, err := defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	s.clusterClient.CABundle = []byte("custom-ca")
+	_, err = defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(configs, check.HasLen, 2)
+	c.Assert(string(configs[0].TLSClientConfig.CAData), check.Equals, "cluster-ca")
+	c.Assert(string(configs[1].TLSClientConfig.CAData), check.Equals, "custom-ca")
+	c.Assert(string(s.clusterClient.restConfig.TLSClientConfig.CAData), check.Equals, "cluster-ca")
+}
+
+func (s *S) TestInformerFactoryImpersonate(c *check.C) {
+	var configs []*rest.Config
+	ClientForConfig = func(conf *rest.Config) (kubernetes.Interface, error) {
+		configs = append(configs, conf)
+		return s.client, nil
+	}
+	_, err := defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	s.clusterClient.Impersonate = rest.ImpersonationConfig{
+		UserName: "system:serviceaccount:tsuru:c1",
+		Groups:   []string{"tsuru-informers"},
+	}
+	_, err = defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(configs, check.HasLen, 2)
+	c.Assert(configs[0].Impersonate, check.DeepEquals, rest.ImpersonationConfig{})
+	c.Assert(configs[1].Impersonate, check.DeepEquals, rest.ImpersonationConfig{
+		UserName: "system:serviceaccount:tsuru:c1",
+		Groups:   []string{"tsuru-informers"},
+	})
+	c.Assert(s.clusterClient.restConfig.Impersonate, check.DeepEquals, rest.ImpersonationConfig{})
+	s.clusterClient.Impersonate = rest.ImpersonationConfig{Groups: []string{"tsuru-informers"}}
+	_, err = defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.ErrorMatches, `cluster "c1" impersonates groups without a user`)
+}
+
+func (s *S) TestInformerFactoryRateLimit(c *check.C) {
+	var configs []*rest.Config
+	ClientForConfig = func(conf *rest.Config) (kubernetes.Interface, error) {
+		configs = append(configs, conf)
+		return s.client, nil
+	}
+	_, err := defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	s.clusterClient.CustomData[informerQPSKey] = "10"
+	s.clusterClient.CustomData[informerBurstKey] = "15"
+	_, err = defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	c.Assert(configs, check.HasLen, 2)
+	c.Assert(configs[0].QPS, check.Equals, float32(50))
+	c.Assert(configs[0].Burst, check.Equals, 100)
+	c.Assert(configs[1].QPS, check.Equals, float32(10))
+	c.Assert(configs[1].Burst, check.Equals, 15)
+	c.Assert(s.clusterClient.restConfig.QPS, check.Equals, float32(0))
+	s.clusterClient.CustomData[informerBurstKey] = "-1"
+	_, err = defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.ErrorMatches, "informer-burst must be greater than 0, got -1")
+}
+
+func (s *S) TestInformerFactoryWithResync(c *check.C) {
+	s.clusterClient.CustomData[informerResyncKey] = "2m"
+	factory, err := defaultInformerFactory(s.clusterClient, WithResync(30*time.Second))
+	c.Assert(err, check.IsNil)
+	c.Assert(factoryResync(factory), check.Equals, 30*time.Second)
+}
+
+func (s *S) TestInformerFactoryWithTweakListOptions(c *check.C) {
+	var mu sync.Mutex
+	var labelSelectors []string
+	s.client.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		labelSelectors = append(labelSelectors, action.(ktesting.ListAction).GetListRestrictions().Labels.String())
+		return false, nil, nil
+	})
+	factory, err := defaultInformerFactory(s.clusterClient, WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.LabelSelector = "team=admin"
+	}))
+	c.Assert(err, check.IsNil)
+	factory.Core().V1().Pods().Informer()
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(labelSelectors, check.DeepEquals, []string{"team=admin"})
+}
+
+func (s *S) TestInformerFactoryWithNamespace(c *check.C) {
+	s.clusterClient.CustomData[informerNamespacesKey] = "ns1, ns2"
+	for _, ns := range []string{"ns1", "ns2", "ns3"} {
+		_, err := s.client.CoreV1().Pods(ns).Create(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-" + ns, Namespace: ns},
+		})
+		c.Assert(err, check.IsNil)
+	}
+	factory, err := defaultInformerFactory(s.clusterClient, WithNamespace("ns3"))
+	c.Assert(err, check.IsNil)
+	informer := factory.Core().V1().Pods()
+	informer.Informer()
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	cachedPods, err := informer.Lister().List(labels.Everything())
+	c.Assert(err, check.IsNil)
+	c.Assert(cachedPods, check.HasLen, 1)
+	c.Assert(cachedPods[0].Name, check.Equals, "pod-ns3")
+}
+
+func (s *S) TestInformerFactoryWithClientForConfig(c *check.C) {
+	oldClientForConfig := ClientForConfig
+	defer func() { ClientForConfig = oldClientForConfig }()
+	ClientForConfig = func(conf *rest.Config) (kubernetes.Interface, error) {
+		return nil, errors.New("default client builder should not be used")
+	}
+	seeded := fake.NewSimpleClientset(
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod2", Namespace: "other"}},
+	)
+	var configs []*rest.Config
+	factory, err := defaultInformerFactory(s.clusterClient, WithClientForConfig(func(conf *rest.Config) (kubernetes.Interface, error) {
+		configs = append(configs, conf)
+		return seeded, nil
+	}))
+	c.Assert(err, check.IsNil)
+	c.Assert(configs, check.HasLen, 1)
+	c.Assert(configs[0].Host, check.Equals, s.clusterClient.restConfig.Host)
+	informer := factory.Core().V1().Pods()
+	informer.Informer()
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	cachedPods, err := informer.Lister().List(labels.Everything())
+	c.Assert(err, check.IsNil)
+	names := make([]string, len(cachedPods))
+	for i, pod := range cachedPods {
+		names[i] = pod.Name
+	}
+	sort.Strings(names)
+	c.Assert(names, check.DeepEquals, []string{"pod1", "pod2"})
+}
+
+func (s *S) TestInformerFactoryWithPodListWatchReporter(c *check.C) {
+	cli := fake.NewSimpleClientset()
+	cli.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	reported := make(chan error, 10)
+	factory, err := defaultInformerFactory(s.clusterClient, WithClientForConfig(func(conf *rest.Config) (kubernetes.Interface, error) {
+		return cli, nil
+	}), WithPodListWatchReporter(func(err error) {
+		select {
+		case reported <- err:
+		default:
+		}
+	}))
+	c.Assert(err, check.IsNil)
+	factory.Core().V1().Pods().Informer()
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	select {
+	case err = <-reported:
+		c.Assert(err, check.ErrorMatches, "connection refused")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for list error to be reported")
+	}
+}
+
+func (s *S) TestInformerFactoryPodAppNameIndex(c *check.C) {
+	appLabels := func(appName string) map[string]string {
+		return map[string]string{tsuruLabelPrefix + provision.LabelAppName: appName}
+	}
+	pods := []*apiv1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-1", Namespace: "ns1", Labels: appLabels("myapp")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "myapp-2", Namespace: "ns2", Labels: appLabels("myapp")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "otherapp-1", Namespace: "ns1", Labels: appLabels("otherapp")}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled", Namespace: "ns1"}},
+	}
+	for _, pod := range pods {
+		_, err := s.client.CoreV1().Pods(pod.Namespace).Create(pod)
+		c.Assert(err, check.IsNil)
+	}
+	for _, namespaces := range []string{"", "ns1,ns2"} {
+		s.clusterClient.CustomData[informerNamespacesKey] = namespaces
+		factory, err := defaultInformerFactory(s.clusterClient)
+		c.Assert(err, check.IsNil)
+		informer := factory.Core().V1().Pods()
+		informer.Informer()
+		stop := make(chan struct{})
+		factory.Start(stop)
+		factory.WaitForCacheSync(stop)
+		objs, err := informer.Informer().GetIndexer().ByIndex(appNameIndex, "myapp")
+		c.Assert(err, check.IsNil)
+		var names []string
+		for _, obj := range objs {
+			names = append(names, obj.(*apiv1.Pod).Name)
+		}
+		sort.Strings(names)
+		c.Assert(names, check.DeepEquals, []string{"myapp-1", "myapp-2"}, check.Commentf("namespaces %q", namespaces))
+		appPods, err := cachedAppPods(informer, "otherapp")
+		c.Assert(err, check.IsNil)
+		c.Assert(appPods, check.HasLen, 1)
+		c.Assert(appPods[0].Name, check.Equals, "otherapp-1")
+		close(stop)
+	}
+}
+
+func factoryResync(factory informers.SharedInformerFactory) time.Duration {
+	return time.Duration(reflect.ValueOf(factory).Elem().FieldByName("defaultResync").Int())
+}
+
+func (s *S) appPodLabels(c *check.C, a provision.App) map[string]string {
+	labels, err := provision.ServiceLabels(provision.ServiceLabelsOpts{
+		App:     a,
+		Process: "p1",
+		ServiceLabelExtendedOpts: provision.ServiceLabelExtendedOpts{
+			Prefix:      tsuruLabelPrefix,
+			Provisioner: provisionerName,
+		},
+	})
+	c.Assert(err, check.IsNil)
+	return labels.ToLabels()
+}
+
+func (s *S) watchRebuilds(c *check.C) <-chan string {
+	rebuildCh := make(chan string, 100)
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		rebuildCh <- appName
+		return nil, nil
+	})
+	c.Assert(err, check.IsNil)
+	return rebuildCh
+}
+
+func podStatusReady(ready bool) apiv1.PodStatus {
+	status := apiv1.ConditionFalse
+	phase := apiv1.PodPending
+	if ready {
+		status = apiv1.ConditionTrue
+		phase = apiv1.PodRunning
+	}
+	return apiv1.PodStatus{
+		Phase: phase,
+		Conditions: []apiv1.PodCondition{
+			{Type: apiv1.PodReady, Status: status},
+		},
+	}
+}
+
+func (s *S) TestInformerFactoryAppPodsOnly(c *check.C) {
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	pods := []*apiv1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "app-pod", Namespace: "default", Labels: s.appPodLabels(c, a)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other-pod", Namespace: "default", Labels: map[string]string{"app": "other"}}},
+	}
+	for _, pod := range pods {
+		_, err := s.client.CoreV1().Pods(pod.Namespace).Create(pod)
+		c.Assert(err, check.IsNil)
+	}
+	podNames := func() []string {
+		factory, err := defaultInformerFactory(s.clusterClient)
+		c.Assert(err, check.IsNil)
+		informer := factory.Core().V1().Pods()
+		informer.Informer()
+		stop := make(chan struct{})
+		defer close(stop)
+		factory.Start(stop)
+		factory.WaitForCacheSync(stop)
+		cachedPods, err := informer.Lister().List(labels.Everything())
+		c.Assert(err, check.IsNil)
+		var names []string
+		for _, pod := range cachedPods {
+			names = append(names, pod.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	c.Assert(podNames(), check.DeepEquals, []string{"app-pod", "other-pod"})
+	s.clusterClient.CustomData[informerAppPodsOnlyKey] = "true"
+	c.Assert(podNames(), check.DeepEquals, []string{"app-pod"})
+}
+
+func (s *S) TestInformerFactoryActivePodsOnly(c *check.C) {
+	var pods []apiv1.Pod
+	for _, phase := range []apiv1.PodPhase{apiv1.PodPending, apiv1.PodRunning, apiv1.PodSucceeded, apiv1.PodFailed} {
+		pod, err := s.client.CoreV1().Pods("default").Create(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: strings.ToLower(string(phase)) + "-pod", Namespace: "default"},
+			Status:     apiv1.PodStatus{Phase: phase},
+		})
+		c.Assert(err, check.IsNil)
+		pods = append(pods, *pod)
+	}
+	var mu sync.Mutex
+	var fieldSelectors []string
+	s.client.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		restrictions := action.(ktesting.ListAction).GetListRestrictions()
+		mu.Lock()
+		fieldSelectors = append(fieldSelectors, restrictions.Fields.String())
+		mu.Unlock()
+		// the fake client ignores field selectors, filter the pods here
+		list := &apiv1.PodList{}
+		for _, pod := range pods {
+			if restrictions.Fields.Matches(fields.Set{"status.phase": string(pod.Status.Phase)}) {
+				list.Items = append(list.Items, pod)
+			}
+		}
+		return true, list, nil
+	})
+	podNames := func() []string {
+		factory, err := defaultInformerFactory(s.clusterClient)
+		c.Assert(err, check.IsNil)
+		informer := factory.Core().V1().Pods()
+		informer.Informer()
+		stop := make(chan struct{})
+		defer close(stop)
+		factory.Start(stop)
+		factory.WaitForCacheSync(stop)
+		cachedPods, err := informer.Lister().List(labels.Everything())
+		c.Assert(err, check.IsNil)
+		var names []string
+		for _, pod := range cachedPods {
+			names = append(names, pod.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	c.Assert(podNames(), check.DeepEquals, []string{"failed-pod", "pending-pod", "running-pod", "succeeded-pod"})
+	s.clusterClient.CustomData[informerActivePodsOnlyKey] = "true"
+	c.Assert(podNames(), check.DeepEquals, []string{"pending-pod", "running-pod"})
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(fieldSelectors, check.HasLen, 2)
+	c.Assert(fieldSelectors[0], check.Equals, "")
+	c.Assert(fieldSelectors[1], check.Equals, "status.phase!=Failed,status.phase!=Succeeded")
+}
+
+func (s *S) TestInformerFactoryConfigMaps(c *check.C) {
+	for _, ns := range []string{"ns1", "ns2", "ns3"} {
+		for _, cm := range []*apiv1.ConfigMap{
+			{ObjectMeta: metav1.ObjectMeta{Name: "app-" + ns, Namespace: ns, Labels: map[string]string{"tsuru.io/app-name": "myapp"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "other-" + ns, Namespace: ns}},
+		} {
+			_, err := s.client.CoreV1().ConfigMaps(ns).Create(cm)
+			c.Assert(err, check.IsNil)
+		}
+	}
+	configMapNames := func() []string {
+		factory, err := defaultInformerFactory(s.clusterClient)
+		c.Assert(err, check.IsNil)
+		informer := factory.Core().V1().ConfigMaps()
+		informer.Informer()
+		stop := make(chan struct{})
+		defer close(stop)
+		factory.Start(stop)
+		factory.WaitForCacheSync(stop)
+		cached, err := informer.Lister().List(labels.Everything())
+		c.Assert(err, check.IsNil)
+		var names []string
+		for _, cm := range cached {
+			names = append(names, cm.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	c.Assert(configMapNames(), check.DeepEquals, []string{"app-ns1", "app-ns2", "app-ns3"})
+	s.clusterClient.CustomData[informerNamespacesKey] = "ns1, ns2"
+	c.Assert(configMapNames(), check.DeepEquals, []string{"app-ns1", "app-ns2"})
+}
+
+func (s *S) TestInformerFactoryNamespaces(c *check.C) {
+	s.clusterClient.CustomData[informerNamespacesKey] = "ns1, ns2"
+	for _, ns := range []string{"ns1", "ns2", "ns3"} {
+		_, err := s.client.CoreV1().Pods(ns).Create(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-" + ns, Namespace: ns},
+		})
+		c.Assert(err, check.IsNil)
+	}
+	var mu sync.Mutex
+	watchedNamespaces := map[string]struct{}{}
+	s.client.PrependReactor("list", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		watchedNamespaces[action.GetNamespace()] = struct{}{}
+		return false, nil, nil
+	})
+	s.client.PrependWatchReactor("pods", func(action ktesting.Action) (bool, watch.Interface, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		watchedNamespaces[action.GetNamespace()] = struct{}{}
+		return false, nil, nil
+	})
+	factory, err := defaultInformerFactory(s.clusterClient)
+	c.Assert(err, check.IsNil)
+	informer := factory.Core().V1().Pods()
+	informer.Informer()
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	podNames := func() []string {
+		cachedPods, errList := informer.Lister().List(labels.Everything())
+		c.Assert(errList, check.IsNil)
+		var names []string
+		for _, pod := range cachedPods {
+			names = append(names, pod.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	c.Assert(podNames(), check.DeepEquals, []string{"pod-ns1", "pod-ns2"})
+	for _, ns := range []string{"ns3", "ns2"} {
+		_, err = s.client.CoreV1().Pods(ns).Create(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "new-pod-" + ns, Namespace: ns},
+		})
+		c.Assert(err, check.IsNil)
+	}
+	timeout := time.After(5 * time.Second)
+	for len(podNames()) < 3 {
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for pod in ns2, got: %v", podNames())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(podNames(), check.DeepEquals, []string{"new-pod-ns2", "pod-ns1", "pod-ns2"})
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(watchedNamespaces, check.DeepEquals, map[string]struct{}{"ns1": {}, "ns2": {}})
+}
+
+func counterValue(counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	counter.Write(&metric)
+	return metric.Counter.GetValue()
+}
+
+func gaugeValue(gauge prometheus.Gauge) float64 {
+	var metric dto.Metric
+	gauge.Write(&metric)
+	return metric.Gauge.GetValue()
+}
+
+func histogramCount(histogram prometheus.Histogram) uint64 {
+	var metric dto.Metric
+	histogram.Write(&metric)
+	return metric.Histogram.GetSampleCount()
+}
+
+func (s *S) TestClusterControllerNodesByPool(c *check.C) {
+	s.clusterClient.CustomData[nodePoolLabelClusterKey] = "example.com/node-group"
+	nodes := []*apiv1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"example.com/node-group": "p1"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "n2", Labels: map[string]string{"example.com/node-group": "p2"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "n3", Labels: map[string]string{"example.com/node-group": "p1"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "n4", Labels: map[string]string{"tsuru.io/pool": "p1"}}},
+	}
+	for _, node := range nodes {
+		_, err := s.client.CoreV1().Nodes().Create(node)
+		c.Assert(err, check.IsNil)
+	}
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	result, err := ctr.nodesByPool()
+	c.Assert(err, check.IsNil)
+	names := map[string][]string{}
+	for pool, poolNodes := range result {
+		for _, node := range poolNodes {
+			names[pool] = append(names[pool], node.Name)
+		}
+		sort.Strings(names[pool])
+	}
+	c.Assert(names, check.DeepEquals, map[string][]string{
+		"p1": {"n1", "n3"},
+		"p2": {"n2"},
+	})
+}
+
+func (s *S) TestClusterNodesHealth(c *check.C) {
+	nodeStatus := func(status apiv1.ConditionStatus) apiv1.NodeStatus {
+		return apiv1.NodeStatus{
+			Conditions: []apiv1.NodeCondition{{Type: apiv1.NodeReady, Status: status}},
+		}
+	}
+	nodes := []*apiv1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "n1"}, Status: nodeStatus(apiv1.ConditionTrue)},
+		{ObjectMeta: metav1.ObjectMeta{Name: "n2"}, Status: nodeStatus(apiv1.ConditionFalse)},
+		{ObjectMeta: metav1.ObjectMeta{Name: "n3"}, Status: nodeStatus(apiv1.ConditionTrue)},
+		{ObjectMeta: metav1.ObjectMeta{Name: "n4"}, Status: nodeStatus(apiv1.ConditionUnknown)},
+		{ObjectMeta: metav1.ObjectMeta{Name: "n5"}},
+	}
+	for _, node := range nodes {
+		_, err := s.client.CoreV1().Nodes().Create(node)
+		c.Assert(err, check.IsNil)
+	}
+	_, err := s.p.ClusterNodesHealth(s.clusterClient.Name)
+	c.Assert(err, check.ErrorMatches, `no controller running for cluster "c1"`)
+	_, err = getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	health, err := s.p.ClusterNodesHealth(s.clusterClient.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(health, check.DeepEquals, NodesHealth{Cluster: "c1", Ready: 2, NotReady: 3})
+}
+
+func (s *S) TestClusterControllerStuckLoadBalancer(c *check.C) {
+	oldThreshold, oldCallback := loadBalancerPendingThreshold, onStuckLoadBalancer
+	defer func() {
+		loadBalancerPendingThreshold, onStuckLoadBalancer = oldThreshold, oldCallback
+	}()
+	loadBalancerPendingThreshold = 200 * time.Millisecond
+	stuckCh := make(chan string, 10)
+	onStuckLoadBalancer = func(cluster string, svc *apiv1.Service, pending time.Duration) {
+		c.Check(cluster, check.Equals, s.clusterClient.Name)
+		c.Check(pending >= loadBalancerPendingThreshold, check.Equals, true)
+		stuckCh <- svc.Name
+	}
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
+		return informers.NewSharedInformerFactory(s.client, time.Minute), nil
+	}
+	now := metav1.Now()
+	services := []*apiv1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "lb-pending", Namespace: "default", UID: "uid1", CreationTimestamp: now},
+			Spec:       apiv1.ServiceSpec{Type: apiv1.ServiceTypeLoadBalancer},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "lb-ready", Namespace: "default", UID: "uid2", CreationTimestamp: now},
+			Spec:       apiv1.ServiceSpec{Type: apiv1.ServiceTypeLoadBalancer},
+			Status: apiv1.ServiceStatus{LoadBalancer: apiv1.LoadBalancerStatus{
+				Ingress: []apiv1.LoadBalancerIngress{{IP: "10.0.0.1"}},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "lb-assigned-later", Namespace: "default", UID: "uid3", CreationTimestamp: now},
+			Spec:       apiv1.ServiceSpec{Type: apiv1.ServiceTypeLoadBalancer},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-port", Namespace: "default", UID: "uid4", CreationTimestamp: now},
+			Spec:       apiv1.ServiceSpec{Type: apiv1.ServiceTypeNodePort},
+		},
+	}
+	for _, svc := range services {
+		_, err := s.client.CoreV1().Services(svc.Namespace).Create(svc)
+		c.Assert(err, check.IsNil)
+	}
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	defer stopClusterController(s.p, s.clusterClient)
+	_, err = ctr.getServiceInformer()
+	c.Assert(err, check.IsNil)
+	assigned := services[2].DeepCopy()
+	assigned.Status.LoadBalancer.Ingress = []apiv1.LoadBalancerIngress{{IP: "10.0.0.2"}}
+	_, err = s.client.CoreV1().Services(assigned.Namespace).UpdateStatus(assigned)
+	c.Assert(err, check.IsNil)
+	select {
+	case name := <-stuckCh:
+		c.Assert(name, check.Equals, "lb-pending")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for stuck load balancer callback")
+	}
+	select {
+	case name := <-stuckCh:
+		c.Fatalf("unexpected stuck load balancer callback for %q", name)
+	case <-time.After(2 * loadBalancerPendingThreshold):
+	}
+}
+
+func (s *S) TestClusterControllerWaitForReadyPods(c *check.C) {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "myapp-pod-1",
+			Namespace: "default",
+			Labels:    map[string]string{"tsuru.io/app-name": "myapp"},
+		},
+		Status: apiv1.PodStatus{
+			Conditions: []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionFalse}},
+		},
+	}
+	_, err := s.client.CoreV1().Pods("default").Create(pod)
+	c.Assert(err, check.IsNil)
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	defer stopClusterController(s.p, s.clusterClient)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = ctr.waitForReadyPods(ctx, "default", "myapp", 1)
+	c.Assert(err, check.ErrorMatches, `error waiting for 1 ready pods for app "myapp", 0 ready: context deadline exceeded`)
+	errCh := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errCh <- ctr.waitForReadyPods(ctx, "default", "myapp", 1)
+	}()
+	pod.ResourceVersion = "1"
+	pod.Status.Conditions[0].Status = apiv1.ConditionTrue
+	_, err = s.client.CoreV1().Pods("default").Update(pod)
+	c.Assert(err, check.IsNil)
+	c.Assert(<-errCh, check.IsNil)
+}
+
+func (s *S) TestClusterControllerNodeDeleteRemovesNodeData(c *check.C) {
+	removedCh := make(chan string, 10)
+	defer func(old func(provision.Node) error) { removeNodeData = old }(removeNodeData)
+	removeNodeData = func(node provision.Node) error {
+		removedCh <- node.Address()
+		return nil
+	}
+	nodes := []*apiv1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: map[string]string{"tsuru.io/pool": "p1"}},
+			Status:     apiv1.NodeStatus{Addresses: []apiv1.NodeAddress{{Type: apiv1.NodeInternalIP, Address: "192.168.99.1"}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "n2"},
+			Status:     apiv1.NodeStatus{Addresses: []apiv1.NodeAddress{{Type: apiv1.NodeInternalIP, Address: "192.168.99.2"}}},
+		},
+	}
+	for _, node := range nodes {
+		_, err := s.client.CoreV1().Nodes().Create(node)
+		c.Assert(err, check.IsNil)
+	}
+	ctr, err := getClusterController(context.Background(), s.p, s.clusterClient)
+	c.Assert(err, check.IsNil)
+	_, err = ctr.getNodeInformer()
+	c.Assert(err, check.IsNil)
+	for _, node := range nodes {
+		err = s.client.CoreV1().Nodes().Delete(node.Name, &metav1.DeleteOptions{})
+		c.Assert(err, check.IsNil)
+	}
+	select {
+	case addr := <-removedCh:
+		c.Assert(addr, check.Equals, "192.168.99.1")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for node data removal")
+	}
+	stopClusterController(s.p, s.clusterClient)
+	c.Assert(removedCh, check.HasLen, 0)
+}
+
+func (s *S) TestClusterControllerNodeDeleteInvalidObject(c *check.C) {
+	ctr := &clusterController{cluster: s.clusterClient}
+	err := ctr.onNodeDelete(&apiv1.Pod{})
+	c.Assert(err, check.ErrorMatches, "couldn't get object from tombstone .*")
+	err = ctr.onNodeDelete(cache.DeletedFinalStateUnknown{Key: "n1", Obj: &apiv1.Pod{}})
+	c.Assert(err, check.ErrorMatches, "tombstone contained object that is not a Node: .*")
+	err = ctr.onNodeDelete(cache.DeletedFinalStateUnknown{Key: "n1", Obj: &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1"}}})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) createDrainFixtures(c *check.C) {
+	a := provisiontest.NewFakeApp("myapp", "python", 0)
+	_, err := s.client.CoreV1().Nodes().Create(&apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "n1"},
+	})
+	c.Assert(err, check.IsNil)
+	ns := s.client.PoolNamespace("")
+	pods := []struct{ name, node string }{
+		{"myapp-pod-1", "n1"},
+		{"myapp-pod-2", "n1"},
+		{"myapp-pod-3", "n2"},
+	}
+	for _, p := range pods {
+		_, err = s.client.CoreV1().Pods(ns).Create(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      p.name,
+				Namespace: ns,
+				Labels:    s.appPodLabels(c, a),
+			},
+			Spec: apiv1.PodSpec{NodeName: p.node},
+		})
+		c.Assert(err, check.IsNil)
+	}
+	_, err = s.client.CoreV1().Pods(ns).Create(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "other-pod", Namespace: ns},
+		Spec:       apiv1.PodSpec{NodeName: "n1"},
+	})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestClusterControllerDrainNode(c *check.C) {
+	s.createDrainFixtures(c)
+	var actions []string
+	s.client.PrependReactor("patch", "nodes", func(action ktesting.Action) (bool, runtime.Object, error) {
+		patch := action.(ktesting.PatchAction)
+		c.Check(string(patch.GetPatch()), check.Equals, `{"spec":{"unschedulable":true}}`)
+		actions = append(actions, "cordon "+patch.GetName())
+		return false, nil, nil
+	})
+	s.client.PrependReactor("create", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(ktesting.CreateAction).GetObject().(*policy.Eviction)
+		actions = append(actions, "evict "+eviction.Name)
+		return true, eviction, nil
+	})
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	err := ctr.drainNode("n1")
+	c.Assert(err, check.IsNil)
+	c.Assert(actions, check.HasLen, 3)
+	c.Assert(actions[0], check.Equals, "cordon n1")
+	evictions := actions[1:]
+	sort.Strings(evictions)
+	c.Assert(evictions, check.DeepEquals, []string{"evict myapp-pod-1", "evict myapp-pod-2"})
+	node, err := s.client.CoreV1().Nodes().Get("n1", metav1.GetOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(node.Spec.Unschedulable, check.Equals, true)
+}
+
+func (s *S) TestClusterControllerDrainNodeRetriesDisruptionBudget(c *check.C) {
+	oldInterval := drainEvictionRetryInterval
+	drainEvictionRetryInterval = 10 * time.Millisecond
+	defer func() { drainEvictionRetryInterval = oldInterval }()
+	s.createDrainFixtures(c)
+	attempts := map[string]int{}
+	s.client.PrependReactor("create", "pods", func(action ktesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(ktesting.CreateAction).GetObject().(*policy.Eviction)
+		attempts[eviction.Name]++
+		if attempts[eviction.Name] < 3 {
+			return true, nil, k8sErrors.NewTooManyRequests("disruption budget", 0)
+		}
+		return true, eviction, nil
+	})
+	ctr := &clusterController{cluster: s.clusterClient, stopCh: make(chan struct{})}
+	defer ctr.stop()
+	err := ctr.drainNode("n1")
+	c.Assert(err, check.IsNil)
+	c.Assert(attempts, check.DeepEquals, map[string]int{"myapp-pod-1": 3, "myapp-pod-2": 3})
+}
@@ -35,7 +35,6 @@ import (
 	provTypes "github.com/tsuru/tsuru/types/provision"
 	"github.com/tsuru/tsuru/volume"
 	apiv1 "k8s.io/api/core/v1"
-	policy "k8s.io/api/policy/v1beta1"
 	v1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -54,11 +53,19 @@ const (
 	defaultDeploymentProgressTimeout           = 10 * time.Minute
 	defaultAttachTimeoutAfterContainerFinished = time.Minute
 	defaultSidecarImageName                    = "tsuru/deploy-agent:0.8.2"
+	defaultControllersStartParallelism         = 10
+	defaultInformerSyncAttempts                = 1
 )
 
 type kubernetesProvisioner struct {
 	mu                 sync.Mutex
 	clusterControllers map[string]*clusterController
+	controllerFailures map[string]controllerFailure
+	clusterLocks       map[string]*sync.Mutex
+	rebuildDecider     RebuildDecider
+	desyncHandler      func(cluster string)
+	deployPodHandler   DeployPodHandler
+	restartHandler     ContainerRestartHandler
 }
 
 var (
@@ -118,6 +125,13 @@ type kubernetesConfig struct {
 	// HeadlessServicePort is the port used in headless service, by default the
 	// same port number used for container is used.
 	HeadlessServicePort int
+	// ControllersStartParallelism is the maximum number of cluster
+	// controllers started concurrently during initialization.
+	ControllersStartParallelism int
+	// InformerSyncAttempts is the number of times the initial sync of an
+	// informer is waited for, each attempt waiting up to the cluster
+	// informer sync timeout.
+	InformerSyncAttempts int
 }
 
 func getKubeConfig() kubernetesConfig {
@@ -171,6 +185,14 @@ func getKubeConfig() kubernetesConfig {
 	if conf.HeadlessServicePort == 0 {
 		conf.HeadlessServicePort, _ = strconv.Atoi(provision.WebProcessDefaultPort())
 	}
+	conf.ControllersStartParallelism, _ = config.GetInt("kubernetes:controllers-start-parallelism")
+	if conf.ControllersStartParallelism <= 0 {
+		conf.ControllersStartParallelism = defaultControllersStartParallelism
+	}
+	conf.InformerSyncAttempts, _ = config.GetInt("kubernetes:informer-sync-attempts")
+	if conf.InformerSyncAttempts <= 0 {
+		conf.InformerSyncAttempts = defaultInformerSyncAttempts
+	}
 	return conf
 }
 
@@ -182,7 +204,7 @@ func (p *kubernetesProvisioner) Initialize() error {
 		// there's a better way to control glog.
 		flag.CommandLine.Parse([]string{"-v", strconv.Itoa(conf.LogLevel), "-logtostderr"})
 	}
-	err := initAllControllers(p)
+	err := initAllControllers(context.Background(), p)
 	if err == provTypes.ErrNoCluster {
 		return nil
 	}
@@ -195,7 +217,7 @@ func (p *kubernetesProvisioner) InitializeCluster(c *provTypes.Cluster) error {
 		return err
 	}
 	stopClusterController(p, clusterClient)
-	_, err = getClusterController(p, clusterClient)
+	_, err = getClusterController(context.Background(), p, clusterClient)
 	return err
 }
 
@@ -393,7 +415,7 @@ func (p *kubernetesProvisioner) podsToUnitsMultiple(client *ClusterClient, pods
 	for _, baseApp := range baseApps {
 		appMap[baseApp.GetName()] = baseApp
 	}
-	controller, err := getClusterController(p, client)
+	controller, err := getClusterController(context.Background(), p, client)
 	if err != nil {
 		return nil, err
 	}
@@ -558,7 +580,7 @@ func (p *kubernetesProvisioner) podsForApps(client *ClusterClient, apps []provis
 		}
 		sel = sel.Add(*req)
 	}
-	controller, err := getClusterController(p, client)
+	controller, err := getClusterController(context.Background(), p, client)
 	if err != nil {
 		return nil, err
 	}
@@ -601,7 +623,7 @@ func (p *kubernetesProvisioner) RoutableAddresses(a provision.App) ([]url.URL, e
 	if err != nil {
 		return nil, err
 	}
-	controller, err := getClusterController(p, client)
+	controller, err := getClusterController(context.Background(), p, client)
 	if err != nil {
 		return nil, err
 	}
@@ -628,7 +650,7 @@ func (p *kubernetesProvisioner) addressesForApp(client *ClusterClient, a provisi
 	if err != nil {
 		return nil, err
 	}
-	controller, err := getClusterController(p, client)
+	controller, err := getClusterController(context.Background(), p, client)
 	if err != nil {
 		return nil, err
 	}
@@ -665,7 +687,7 @@ func (p *kubernetesProvisioner) addressesForPool(client *ClusterClient, poolName
 		Pool:   poolName,
 		Prefix: tsuruLabelPrefix,
 	}).ToNodeByPoolSelector()
-	controller, err := getClusterController(p, client)
+	controller, err := getClusterController(context.Background(), p, client)
 	if err != nil {
 		return nil, err
 	}
@@ -860,27 +882,15 @@ func (p *kubernetesProvisioner) RemoveNode(opts provision.RemoveNodeOptions) err
 	}
 	node := nodeWrapper.node
 	if opts.Rebalance {
-		node.Spec.Unschedulable = true
-		_, err = client.CoreV1().Nodes().Update(node)
+		var controller *clusterController
+		controller, err = getClusterController(context.Background(), p, client)
 		if err != nil {
-			return errors.WithStack(err)
+			return err
 		}
-		var pods []apiv1.Pod
-		pods, err = podsFromNode(client, node.Name, tsuruLabelPrefix+provision.LabelAppPool)
+		err = controller.drainNode(node.Name)
 		if err != nil {
 			return err
 		}
-		for _, pod := range pods {
-			err = client.CoreV1().Pods(pod.Namespace).Evict(&policy.Eviction{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      pod.Name,
-					Namespace: pod.Namespace,
-				},
-			})
-			if err != nil {
-				return errors.WithStack(err)
-			}
-		}
 	}
 	err = client.CoreV1().Nodes().Delete(node.Name, &metav1.DeleteOptions{})
 	if err != nil {
@@ -1004,6 +1014,7 @@ func (p *kubernetesProvisioner) Deploy(a provision.App, buildImageID string, evt
 			attachOutput:      evt,
 			attachInput:       strings.NewReader("."),
 			inputFile:         "/dev/null",
+			eventID:           evt.UniqueID.Hex(),
 		}
 		ctx, cancel := evt.CancelableContext(context.Background())
 		err = createDeployPod(ctx, params)
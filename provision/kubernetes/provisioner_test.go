@@ -39,6 +39,7 @@ import (
 	check "gopkg.in/check.v1"
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ktesting "k8s.io/client-go/testing"
@@ -109,26 +110,31 @@ func (s *S) TestRemoveNodeNotFound(c *check.C) {
 }
 
 func (s *S) TestRemoveNodeWithRebalance(c *check.C) {
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c.Assert(r.FormValue("labelSelector"), check.Equals, "tsuru.io/app-pool")
-		output := `{"items": [
-			{"metadata": {"name": "myapp-web-pod-1-1", "labels": {"tsuru.io/app-name": "myapp", "tsuru.io/app-process": "web", "tsuru.io/app-platform": "python"}}, "status": {"phase": "Running"}},
-			{"metadata": {"name": "myapp-worker-pod-2-1", "labels": {"tsuru.io/app-name": "myapp", "tsuru.io/app-process": "worker", "tsuru.io/app-platform": "python"}}, "status": {"phase": "Running"}}
-		]}`
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(output))
-	}))
-	defer srv.Close()
-	s.mock.MockfakeNodes(c, srv.URL)
+	s.mock.MockfakeNodes(c)
 	ns := s.client.PoolNamespace("")
+	for _, name := range []string{"myapp-web-pod-1-1", "myapp-worker-pod-2-1"} {
+		_, err := s.client.CoreV1().Pods(ns).Create(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+				Labels: map[string]string{
+					"tsuru.io/app-name": "myapp",
+					"tsuru.io/app-pool": "test-default",
+				},
+			},
+			Spec: apiv1.PodSpec{NodeName: "n1"},
+		})
+		c.Assert(err, check.IsNil)
+	}
 	_, err := s.client.CoreV1().Pods(ns).Create(&apiv1.Pod{
 		ObjectMeta: metav1.ObjectMeta{Name: "p1", Namespace: ns},
+		Spec:       apiv1.PodSpec{NodeName: "n1"},
 	})
 	c.Assert(err, check.IsNil)
-	evictionCalled := false
+	var evicted []string
 	s.client.PrependReactor("create", "pods", func(action ktesting.Action) (handled bool, ret runtime.Object, err error) {
 		if action.GetSubresource() == "eviction" {
-			evictionCalled = true
+			evicted = append(evicted, action.(ktesting.CreateAction).GetObject().(*policy.Eviction).Name)
 			return true, action.(ktesting.CreateAction).GetObject(), nil
 		}
 		return
@@ -142,7 +148,8 @@ func (s *S) TestRemoveNodeWithRebalance(c *check.C) {
 	nodes, err := s.p.ListNodes([]string{})
 	c.Assert(err, check.IsNil)
 	c.Assert(nodes, check.HasLen, 1)
-	c.Assert(evictionCalled, check.Equals, true)
+	sort.Strings(evicted)
+	c.Assert(evicted, check.DeepEquals, []string{"myapp-web-pod-1-1", "myapp-worker-pod-2-1"})
 }
 
 func (s *S) TestAddNode(c *check.C) {
@@ -1905,6 +1912,7 @@ func (s *S) TestGetKubeConfig(c *check.C) {
 	config.Set("kubernetes:deployment-progress-timeout", 3*60)
 	config.Set("kubernetes:attach-after-finish-timeout", 5)
 	config.Set("kubernetes:headless-service-port", 8889)
+	config.Set("kubernetes:informer-sync-attempts", 3)
 	defer config.Unset("kubernetes")
 	kubeConf := getKubeConfig()
 	c.Assert(kubeConf, check.DeepEquals, kubernetesConfig{
@@ -1917,6 +1925,8 @@ func (s *S) TestGetKubeConfig(c *check.C) {
 		DeploymentProgressTimeout:           3 * time.Minute,
 		AttachTimeoutAfterContainerFinished: 5 * time.Second,
 		HeadlessServicePort:                 8889,
+		ControllersStartParallelism:         10,
+		InformerSyncAttempts:                3,
 	})
 }
 
@@ -1933,6 +1943,8 @@ func (s *S) TestGetKubeConfigDefaults(c *check.C) {
 		DeploymentProgressTimeout:           10 * time.Minute,
 		AttachTimeoutAfterContainerFinished: time.Minute,
 		HeadlessServicePort:                 8888,
+		ControllersStartParallelism:         10,
+		InformerSyncAttempts:                1,
 	})
 }
 
@@ -52,6 +52,7 @@ type S struct {
 var suiteInstance = &S{}
 var _ = check.Suite(suiteInstance)
 var defaultClientForConfig = ClientForConfig
+var defaultInformerFactory = InformerFactory
 
 func Test(t *testing.T) {
 	suiteInstance.t = t
@@ -119,7 +120,8 @@ func (s *S) SetUpTest(c *check.C) {
 	})
 	c.Assert(err, check.IsNil)
 	s.factory = informers.NewSharedInformerFactory(s.client, 1)
-	InformerFactory = func(client *ClusterClient) (informers.SharedInformerFactory, error) {
+	resyncJitterRand = func() float64 { return 0.5 }
+	InformerFactory = func(client *ClusterClient, opts ...InformerFactoryOption) (informers.SharedInformerFactory, error) {
 		return s.factory, nil
 	}
 	s.p = &kubernetesProvisioner{
@@ -24,7 +24,7 @@ var (
 	labelIsService         = "is-service"
 	labelIsHeadlessService = "is-headless-service"
 
-	labelAppName            = "app-name"
+	LabelAppName            = "app-name"
 	labelAppProcess         = "app-process"
 	labelAppProcessReplicas = "app-process-replicas"
 	LabelAppPool            = "app-pool"
@@ -65,11 +65,11 @@ func (s *LabelSet) ToLabels() map[string]string {
 }
 
 func (s *LabelSet) ToSelector() map[string]string {
-	return withPrefix(subMap(s.Labels, labelAppName, labelAppProcess, labelIsBuild, labelIsIsolatedRun), s.Prefix)
+	return withPrefix(subMap(s.Labels, LabelAppName, labelAppProcess, labelIsBuild, labelIsIsolatedRun), s.Prefix)
 }
 
 func (s *LabelSet) ToAppSelector() map[string]string {
-	return withPrefix(subMap(s.Labels, labelAppName), s.Prefix)
+	return withPrefix(subMap(s.Labels, LabelAppName), s.Prefix)
 }
 
 func (s *LabelSet) ToNodeContainerSelector() map[string]string {
@@ -93,7 +93,7 @@ func (s *LabelSet) ToVolumeSelector() map[string]string {
 }
 
 func (s *LabelSet) AppName() string {
-	return s.getLabel(labelAppName)
+	return s.getLabel(LabelAppName)
 }
 
 func (s *LabelSet) AppProcess() string {
@@ -108,6 +108,14 @@ func (s *LabelSet) AppPool() string {
 	return s.getLabel(LabelAppPool)
 }
 
+func (s *LabelSet) RouterTypes() []string {
+	v := s.getLabel(labelRouterType)
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
 func (s *LabelSet) NodeAddr() string {
 	return s.getLabel(labelNodeAddr)
 }
@@ -191,6 +199,10 @@ func (s *LabelSet) BuildImage() string {
 	return s.getLabel(labelBuildImage)
 }
 
+func (s *LabelSet) IsTsuru() bool {
+	return s.getBoolLabel(labelIsTsuru)
+}
+
 func (s *LabelSet) IsStopped() bool {
 	return s.getBoolLabel(labelIsStopped)
 }
@@ -203,6 +215,10 @@ func (s *LabelSet) IsDeploy() bool {
 	return s.getBoolLabel(labelIsDeploy)
 }
 
+func (s *LabelSet) IsBuild() bool {
+	return s.getBoolLabel(labelIsBuild)
+}
+
 func (s *LabelSet) IsService() bool {
 	return s.getBoolLabel(labelIsService)
 }
@@ -342,7 +358,7 @@ func ProcessLabels(opts ProcessLabelsOpts) (*LabelSet, error) {
 			labelIsTsuru:     strconv.FormatBool(true),
 			labelIsStopped:   strconv.FormatBool(false),
 			labelIsDeploy:    strconv.FormatBool(opts.IsDeploy),
-			labelAppName:     opts.App.GetName(),
+			LabelAppName:     opts.App.GetName(),
 			labelAppProcess:  opts.Process,
 			labelAppPlatform: opts.App.GetPlatform(),
 			LabelAppPool:     opts.App.GetPool(),
@@ -370,7 +386,7 @@ func ServiceAccountLabels(opts ServiceAccountLabelsOpts) *LabelSet {
 	if opts.App == nil {
 		labelMap[labelNodeContainerName] = opts.NodeContainerName
 	} else {
-		labelMap[labelAppName] = opts.App.GetName()
+		labelMap[LabelAppName] = opts.App.GetName()
 	}
 	return &LabelSet{
 		Labels: labelMap,
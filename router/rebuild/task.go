@@ -7,28 +7,142 @@ package rebuild
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/api/shutdown"
 	"github.com/tsuru/tsuru/log"
 	"k8s.io/client-go/util/workqueue"
 	_ "k8s.io/kubernetes/pkg/util/workqueue/prometheus"
 )
 
-const rebuildWorkers = 20
+const (
+	rebuildWorkers         = 20
+	defaultEnqueueDebounce = 500 * time.Millisecond
+	defaultRebuildCooldown = 2 * time.Second
+)
 
 var (
 	appFinder func(string) (RebuildApp, error)
 	task      *rebuildTask
 )
 
+// Priority defines the order in which enqueued rebuilds are processed, apps
+// with high priority are rebuilt before the others.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+)
+
+// EnqueueOpts changes how a routes rebuild is scheduled by
+// EnqueueRoutesRebuildOpts.
+type EnqueueOpts struct {
+	// Delay postpones the rebuild, the debounce window is used instead if
+	// it's longer and Debounce is set.
+	Delay time.Duration
+	// Debounce postpones the rebuild until the end of the debounce window,
+	// coalescing the enqueues for the same app within it into a single
+	// rebuild, which always sees the latest app state. It's meant for bursts
+	// of events, like the pods of an app becoming ready in a rolling update.
+	Debounce bool
+	// UnlessRecent ignores the enqueue if the app routes were successfully
+	// rebuilt within the cooldown. It should be set for events that are not
+	// expected to change the app routes, like trailing events after a
+	// rebuild, but never for events changing the readiness of the app units.
+	UnlessRecent bool
+	Priority     Priority
+}
+
+type queuedItem struct {
+	queue    workqueue.RateLimitingInterface
+	priority Priority
+	key      interface{}
+}
+
 type rebuildTask struct {
-	queue workqueue.RateLimitingInterface
-	wg    sync.WaitGroup
+	queue         workqueue.RateLimitingInterface
+	highQueue     workqueue.RateLimitingInterface
+	normalCh      chan queuedItem
+	highCh        chan queuedItem
+	debounce      time.Duration
+	cooldown      time.Duration
+	wg            sync.WaitGroup
+	lastRebuildMu sync.Mutex
+	lastRebuild   map[string]time.Time
+	pendingMu     sync.Mutex
+	pending       map[interface{}]Priority
+}
+
+// setPending tracks the apps with enqueued rebuilds which were not picked by
+// a worker yet, returning the priority of the queue where the rebuild must be
+// added. An app is only pending in a single queue: enqueues for an app
+// pending with a higher priority join it, while a higher priority enqueue
+// promotes the app, leaving its entry in the lower priority queue stale.
+func (t *rebuildTask) setPending(key interface{}, priority Priority) Priority {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+	if current, ok := t.pending[key]; ok && current > priority {
+		priority = current
+	}
+	t.pending[key] = priority
+	return priority
+}
+
+// takePending is called when an app is taken from the queue with the given
+// priority, reporting whether its rebuild must be processed. Stale entries,
+// from apps promoted to a higher priority queue or already picked from it,
+// are ignored.
+func (t *rebuildTask) takePending(key interface{}, priority Priority) bool {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+	if current, ok := t.pending[key]; !ok || current != priority {
+		return false
+	}
+	delete(t.pending, key)
+	return true
+}
+
+func (t *rebuildTask) pendingCount() int {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+	return len(t.pending)
+}
+
+func (t *rebuildTask) markRebuilt(appName string) {
+	t.lastRebuildMu.Lock()
+	defer t.lastRebuildMu.Unlock()
+	t.lastRebuild[appName] = time.Now()
+}
+
+// recentlyRebuilt reports whether the app routes were successfully rebuilt
+// within the cooldown.
+func (t *rebuildTask) recentlyRebuilt(appName string) bool {
+	t.lastRebuildMu.Lock()
+	defer t.lastRebuildMu.Unlock()
+	last, ok := t.lastRebuild[appName]
+	if !ok {
+		return false
+	}
+	if time.Since(last) >= t.cooldown {
+		delete(t.lastRebuild, appName)
+		return false
+	}
+	return true
+}
+
+func (t *rebuildTask) queueFor(priority Priority) workqueue.RateLimitingInterface {
+	if priority >= PriorityHigh {
+		return t.highQueue
+	}
+	return t.queue
 }
 
 func (t *rebuildTask) Shutdown(ctx context.Context) error {
 	t.queue.ShutDown()
+	t.highQueue.ShutDown()
 	done := make(chan struct{})
 	go func() {
 		t.wg.Wait()
@@ -43,36 +157,80 @@ func (t *rebuildTask) Shutdown(ctx context.Context) error {
 }
 
 func (t *rebuildTask) runWorkers() {
+	t.wg.Add(2)
+	go t.dispatch(PriorityNormal, t.normalCh)
+	go t.dispatch(PriorityHigh, t.highCh)
 	for i := 0; i < rebuildWorkers; i++ {
 		t.wg.Add(1)
 		go t.runConsumer()
 	}
 }
 
-func (t *rebuildTask) runConsumer() {
+// dispatch hands the items from the queue to the workers until the queue is
+// shut down.
+func (t *rebuildTask) dispatch(priority Priority, ch chan<- queuedItem) {
 	defer t.wg.Done()
+	defer close(ch)
+	queue := t.queueFor(priority)
 	for {
-		shutdown := t.consumer()
+		key, shutdown := queue.Get()
 		if shutdown {
 			return
 		}
+		if !t.takePending(key, priority) {
+			queue.Forget(key)
+			queue.Done(key)
+			continue
+		}
+		ch <- queuedItem{queue: queue, priority: priority, key: key}
 	}
 }
 
-func (t *rebuildTask) consumer() (shutdown bool) {
-	key, shutdown := t.queue.Get()
-	if shutdown {
-		return true
+// runConsumer processes the dispatched items, always taking a high priority
+// item if there is one available.
+func (t *rebuildTask) runConsumer() {
+	defer t.wg.Done()
+	highCh, normalCh := t.highCh, t.normalCh
+	for highCh != nil || normalCh != nil {
+		var item queuedItem
+		var ok bool
+		select {
+		case item, ok = <-highCh:
+			if !ok {
+				highCh = nil
+				continue
+			}
+		default:
+			select {
+			case item, ok = <-highCh:
+				if !ok {
+					highCh = nil
+					continue
+				}
+			case item, ok = <-normalCh:
+				if !ok {
+					normalCh = nil
+					continue
+				}
+			}
+		}
+		t.consumer(item)
 	}
-	defer t.queue.Done(key)
-	err := process(key)
+}
+
+func (t *rebuildTask) consumer(item queuedItem) {
+	defer item.queue.Done(item.key)
+	err := process(item.key)
 	if err == nil {
-		t.queue.Forget(key)
-		return false
+		item.queue.Forget(item.key)
+		return
 	}
-	log.Errorf("[routes-rebuild-task] error processing app %v: %s", key, err)
-	t.queue.AddRateLimited(key)
-	return false
+	log.Errorf("[routes-rebuild-task] error processing app %v: %s", item.key, err)
+	priority := t.setPending(item.key, item.priority)
+	if priority != item.priority {
+		item.queue.Forget(item.key)
+	}
+	t.queueFor(priority).AddRateLimited(item.key)
 }
 
 func process(key interface{}) error {
@@ -85,11 +243,29 @@ func process(key interface{}) error {
 
 func Initialize(finder func(string) (RebuildApp, error)) error {
 	appFinder = finder
+	debounce := defaultEnqueueDebounce
+	if seconds, err := config.GetFloat("routes-rebuild-debounce"); err == nil {
+		debounce = time.Duration(seconds * float64(time.Second))
+	}
+	cooldown := defaultRebuildCooldown
+	if seconds, err := config.GetFloat("routes-rebuild-cooldown"); err == nil {
+		cooldown = time.Duration(seconds * float64(time.Second))
+	}
 	task = &rebuildTask{
 		queue: workqueue.NewNamedRateLimitingQueue(
 			workqueue.DefaultControllerRateLimiter(),
 			"tsuru_workqueue_rebuild",
 		),
+		highQueue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.DefaultControllerRateLimiter(),
+			"tsuru_workqueue_rebuild_high",
+		),
+		normalCh:    make(chan queuedItem),
+		highCh:      make(chan queuedItem),
+		debounce:    debounce,
+		cooldown:    cooldown,
+		lastRebuild: map[string]time.Time{},
+		pending:     map[interface{}]Priority{},
 	}
 	task.runWorkers()
 	shutdown.Register(task)
@@ -120,6 +296,9 @@ func runRoutesRebuildOnce(appName string, lock bool) error {
 	if err != nil {
 		return errors.Wrapf(err, "error rebuilding app %q", appName)
 	}
+	if task != nil {
+		task.markRebuilt(appName)
+	}
 	return nil
 }
 
@@ -131,10 +310,39 @@ func LockedRoutesRebuildOrEnqueue(appName string) {
 	routesRebuildOrEnqueueOptionalLock(appName, true)
 }
 
+// EnqueueRoutesRebuild schedules a routes rebuild for the app.
 func EnqueueRoutesRebuild(appName string) {
-	if task != nil {
-		task.queue.Add(appName)
+	EnqueueRoutesRebuildOpts(appName, EnqueueOpts{})
+}
+
+// EnqueueRoutesRebuildOpts schedules a routes rebuild for the app as
+// described by opts.
+func EnqueueRoutesRebuildOpts(appName string, opts EnqueueOpts) {
+	if task == nil {
+		return
+	}
+	if opts.UnlessRecent && task.cooldown > 0 && task.recentlyRebuilt(appName) {
+		return
+	}
+	queue := task.queueFor(task.setPending(appName, opts.Priority))
+	delay := opts.Delay
+	if opts.Debounce && delay < task.debounce {
+		delay = task.debounce
+	}
+	if delay <= 0 {
+		queue.Add(appName)
+		return
+	}
+	queue.AddAfter(appName, delay)
+}
+
+// PendingRebuilds returns the number of distinct apps with enqueued routes
+// rebuilds, including delayed ones, not yet picked by a worker.
+func PendingRebuilds() int {
+	if task == nil {
+		return 0
 	}
+	return task.pendingCount()
 }
 
 func routesRebuildOrEnqueueOptionalLock(appName string, lock bool) {
@@ -6,12 +6,18 @@ package rebuild_test
 
 import (
 	"context"
+	"fmt"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/tsuru/config"
 	"github.com/tsuru/tsuru/app"
 	"github.com/tsuru/tsuru/router/rebuild"
 	"github.com/tsuru/tsuru/router/routertest"
+	appTypes "github.com/tsuru/tsuru/types/app"
 	check "gopkg.in/check.v1"
 )
 
@@ -77,6 +83,203 @@ func (s *S) TestRoutesRebuildOrEnqueueLocked(c *check.C) {
 	rebuild.Shutdown(context.Background())
 }
 
+func (s *S) TestEnqueueRoutesRebuildDebounce(c *check.C) {
+	rebuild.Shutdown(context.Background())
+	config.Set("routes-rebuild-debounce", 0.2)
+	defer config.Unset("routes-rebuild-debounce")
+	var calls int32
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		c.Check(appName, check.Equals, "almah")
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	c.Assert(err, check.IsNil)
+	defer rebuild.Shutdown(context.Background())
+	for i := 0; i < 10; i++ {
+		rebuild.EnqueueRoutesRebuildOpts("almah", rebuild.EnqueueOpts{Debounce: true})
+	}
+	waitFor(c, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&calls) > 0
+	})
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+}
+
+func (s *S) TestEnqueueRoutesRebuildNoDebounceByDefault(c *check.C) {
+	rebuild.Shutdown(context.Background())
+	config.Set("routes-rebuild-debounce", 60)
+	defer config.Unset("routes-rebuild-debounce")
+	var calls int32
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	c.Assert(err, check.IsNil)
+	defer rebuild.Shutdown(context.Background())
+	rebuild.EnqueueRoutesRebuild("almah")
+	waitFor(c, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&calls) == 1
+	})
+}
+
+func (s *S) TestPendingRebuilds(c *check.C) {
+	rebuild.Shutdown(context.Background())
+	config.Set("routes-rebuild-debounce", 0.2)
+	defer config.Unset("routes-rebuild-debounce")
+	var calls int32
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	c.Assert(err, check.IsNil)
+	defer rebuild.Shutdown(context.Background())
+	c.Assert(rebuild.PendingRebuilds(), check.Equals, 0)
+	rebuild.EnqueueRoutesRebuildOpts("almah", rebuild.EnqueueOpts{Debounce: true})
+	rebuild.EnqueueRoutesRebuildOpts("almah", rebuild.EnqueueOpts{Debounce: true})
+	rebuild.EnqueueRoutesRebuildOpts("nahuel", rebuild.EnqueueOpts{Debounce: true, Priority: rebuild.PriorityHigh})
+	c.Assert(rebuild.PendingRebuilds(), check.Equals, 2)
+	waitFor(c, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&calls) == 2
+	})
+	c.Assert(rebuild.PendingRebuilds(), check.Equals, 0)
+}
+
+type cooldownApp struct {
+	rebuild.RebuildApp
+	name string
+}
+
+func (a *cooldownApp) GetName() string                   { return a.name }
+func (a *cooldownApp) GetRouters() []appTypes.AppRouter  { return nil }
+func (a *cooldownApp) InternalLock(string) (bool, error) { return true, nil }
+func (a *cooldownApp) Unlock()                           {}
+
+func (s *S) TestEnqueueRoutesRebuildUnlessRecentCooldown(c *check.C) {
+	rebuild.Shutdown(context.Background())
+	config.Set("routes-rebuild-debounce", 0)
+	defer config.Unset("routes-rebuild-debounce")
+	config.Set("routes-rebuild-cooldown", 1)
+	defer config.Unset("routes-rebuild-cooldown")
+	var calls int32
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		atomic.AddInt32(&calls, 1)
+		return &cooldownApp{name: appName}, nil
+	})
+	c.Assert(err, check.IsNil)
+	defer rebuild.Shutdown(context.Background())
+	rebuild.RoutesRebuildOrEnqueue("almah")
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+	for i := 0; i < 10; i++ {
+		rebuild.EnqueueRoutesRebuildOpts("almah", rebuild.EnqueueOpts{UnlessRecent: true})
+	}
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&calls), check.Equals, int32(1))
+	rebuild.EnqueueRoutesRebuild("almah")
+	waitFor(c, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&calls) == 2
+	})
+	rebuild.EnqueueRoutesRebuildOpts("other", rebuild.EnqueueOpts{UnlessRecent: true})
+	waitFor(c, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&calls) == 3
+	})
+	time.Sleep(time.Second)
+	rebuild.EnqueueRoutesRebuildOpts("almah", rebuild.EnqueueOpts{UnlessRecent: true})
+	waitFor(c, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&calls) == 4
+	})
+}
+
+func (s *S) TestEnqueueRoutesRebuildPriority(c *check.C) {
+	rebuild.Shutdown(context.Background())
+	config.Set("routes-rebuild-debounce", 0)
+	defer config.Unset("routes-rebuild-debounce")
+	release := make(chan struct{})
+	var blocked int32
+	var mu sync.Mutex
+	var processed []string
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		if strings.HasPrefix(appName, "blocker") {
+			atomic.AddInt32(&blocked, 1)
+			<-release
+			return nil, nil
+		}
+		mu.Lock()
+		processed = append(processed, appName)
+		mu.Unlock()
+		return nil, nil
+	})
+	c.Assert(err, check.IsNil)
+	defer rebuild.Shutdown(context.Background())
+	// keeps all workers busy so that the next enqueues wait in the queues
+	for i := 0; i < 20; i++ {
+		rebuild.EnqueueRoutesRebuild(fmt.Sprintf("blocker-%d", i))
+	}
+	waitFor(c, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&blocked) == 20
+	})
+	rebuild.EnqueueRoutesRebuildOpts("low", rebuild.EnqueueOpts{Priority: rebuild.PriorityNormal})
+	rebuild.EnqueueRoutesRebuildOpts("high", rebuild.EnqueueOpts{Priority: rebuild.PriorityHigh})
+	time.Sleep(100 * time.Millisecond)
+	// a single worker is released, processing the waiting apps in order
+	release <- struct{}{}
+	defer close(release)
+	waitFor(c, 5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(processed, check.DeepEquals, []string{"high", "low"})
+}
+
+func (s *S) TestEnqueueRoutesRebuildPriorityPromotion(c *check.C) {
+	rebuild.Shutdown(context.Background())
+	config.Set("routes-rebuild-debounce", 0)
+	defer config.Unset("routes-rebuild-debounce")
+	release := make(chan struct{})
+	var blocked int32
+	var mu sync.Mutex
+	var processed []string
+	err := rebuild.Initialize(func(appName string) (rebuild.RebuildApp, error) {
+		if strings.HasPrefix(appName, "blocker") {
+			atomic.AddInt32(&blocked, 1)
+			<-release
+			return nil, nil
+		}
+		mu.Lock()
+		processed = append(processed, appName)
+		mu.Unlock()
+		return nil, nil
+	})
+	c.Assert(err, check.IsNil)
+	defer rebuild.Shutdown(context.Background())
+	for i := 0; i < 20; i++ {
+		rebuild.EnqueueRoutesRebuild(fmt.Sprintf("blocker-%d", i))
+	}
+	waitFor(c, 5*time.Second, func() bool {
+		return atomic.LoadInt32(&blocked) == 20
+	})
+	rebuild.EnqueueRoutesRebuild("low")
+	rebuild.EnqueueRoutesRebuild("almah")
+	rebuild.EnqueueRoutesRebuildOpts("almah", rebuild.EnqueueOpts{Priority: rebuild.PriorityHigh})
+	rebuild.EnqueueRoutesRebuild("almah")
+	c.Assert(rebuild.PendingRebuilds(), check.Equals, 2)
+	time.Sleep(100 * time.Millisecond)
+	release <- struct{}{}
+	defer close(release)
+	waitFor(c, 5*time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(processed) == 2
+	})
+	time.Sleep(200 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(processed, check.DeepEquals, []string{"almah", "low"})
+	c.Assert(rebuild.PendingRebuilds(), check.Equals, 0)
+}
+
 func waitFor(c *check.C, t time.Duration, fn func() bool) {
 	timeout := time.After(t)
 	for !fn() {